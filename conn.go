@@ -0,0 +1,271 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConnStats is implemented by the connections returned by the proxy
+// dialers made with WithConnStats, to attribute the traffic to each
+// connection:
+//
+//	if st, ok := conn.(netproxy.ConnStats); ok {
+//		log.Printf("%d bytes in, %d out", st.BytesRead(), st.BytesWritten())
+//	}
+type ConnStats interface {
+	// BytesRead and BytesWritten return the bytes exchanged with the
+	// target so far, the proxy handshake excluded.
+	BytesRead() int64
+	BytesWritten() int64
+
+	// DialDuration returns the time the dial took.
+	DialDuration() time.Duration
+
+	// HandshakeDuration returns the part of the dial spent once
+	// connected to the proxy: the TLS and proxy handshakes.
+	HandshakeDuration() time.Duration
+
+	// Timings returns the time the dial spent in each phase.
+	Timings() DialTimings
+}
+
+// WithConnStats makes the proxy dialers return connections implementing
+// ConnStats, if enable is true.
+func WithConnStats(enable bool) Option {
+	return func(o *Options) {
+		o.ConnStats = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// statsConn is a connection implementing ConnStats.
+type statsConn struct {
+	net.Conn
+	read, written   atomic.Int64
+	dial, handshake time.Duration
+	timings         DialTimings
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *statsConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := readFrom(c.Conn, r)
+	c.written.Add(n)
+	return n, err
+}
+
+func (c *statsConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := writeTo(c.Conn, w)
+	c.read.Add(n)
+	return n, err
+}
+
+func (c *statsConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *statsConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *statsConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(c.Conn) }
+
+func (c *statsConn) BytesRead() int64                 { return c.read.Load() }
+func (c *statsConn) BytesWritten() int64              { return c.written.Load() }
+func (c *statsConn) DialDuration() time.Duration      { return c.dial }
+func (c *statsConn) HandshakeDuration() time.Duration { return c.handshake }
+func (c *statsConn) Timings() DialTimings             { return c.timings }
+
+// ------------------------------------------------------------------
+
+// WithIdleTimeout makes the proxy dialers close the connections they return
+// after d without traffic in either direction, e.g. before the proxy drops
+// them silently. Zero disables it.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.IdleTimeout = d
+	}
+}
+
+// ------------------------------------------------------------------
+
+// idleConn is a connection closed after a time without traffic. It has no
+// ReadFrom and WriteTo, which would copy without tracking the traffic.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() { conn.Close() })
+	return c
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.timer.Reset(c.timeout)
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.timer.Reset(c.timeout)
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+func (c *idleConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *idleConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *idleConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(c.Conn) }
+
+// ------------------------------------------------------------------
+
+// WithActivityDeadline changes the deadline the proxy dialers leave on the
+// connections they return, if enable is true: instead of expiring the
+// timeout of the dialer after the dial, it is pushed forward by the timeout
+// on each read or write that moves data, so active transfers never time out
+// but stalled ones do. Setting a deadline on the connection ends it.
+func WithActivityDeadline(enable bool) Option {
+	return func(o *Options) {
+		o.ActivityDeadline = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// activityConn is a connection whose deadline follows its traffic. Like
+// idleConn, it has no ReadFrom and WriteTo.
+type activityConn struct {
+	net.Conn
+	timeout time.Duration
+	fixed   atomic.Bool // the caller set a deadline
+}
+
+func newActivityConn(conn net.Conn, timeout time.Duration) *activityConn {
+	conn.SetDeadline(time.Now().Add(timeout))
+	return &activityConn{Conn: conn, timeout: timeout}
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.fixed.Load() {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && !c.fixed.Load() {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return n, err
+}
+
+func (c *activityConn) SetDeadline(t time.Time) error {
+	c.fixed.Store(true)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *activityConn) SetReadDeadline(t time.Time) error {
+	c.fixed.Store(true)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *activityConn) SetWriteDeadline(t time.Time) error {
+	c.fixed.Store(true)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *activityConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *activityConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *activityConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(c.Conn) }
+
+// ------------------------------------------------------------------
+
+// closeWriter and closeReader are the connections that can be half closed,
+// as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeReader interface {
+	CloseRead() error
+}
+
+// closeWrite shuts down the writing side of conn, so that the peer reads
+// EOF, if conn supports it.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return fmt.Errorf("proxy: closing the writing side of %T: %w", conn, errors.ErrUnsupported)
+}
+
+// closeRead shuts down the reading side of conn, if it supports it.
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(closeReader); ok {
+		return c.CloseRead()
+	}
+	return fmt.Errorf("proxy: closing the reading side of %T: %w", conn, errors.ErrUnsupported)
+}
+
+// ------------------------------------------------------------------
+
+// syscallConn returns the raw network connection under conn, the one under
+// TLS for a TLS connection, if there is one.
+func syscallConn(conn net.Conn) (syscall.RawConn, error) {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	if c, ok := conn.(syscall.Conn); ok {
+		return c.SyscallConn()
+	}
+	return nil, fmt.Errorf("proxy: raw connection of %T: %w", conn, errors.ErrUnsupported)
+}
+
+// ------------------------------------------------------------------
+
+// readFrom copies r to conn, with the io.ReaderFrom of conn if it has one,
+// so that wrappers keep the sendfile and splice of *net.TCPConn.
+func readFrom(conn net.Conn, r io.Reader) (int64, error) {
+	if rf, ok := conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{conn}, r)
+}
+
+// writeTo copies conn to w, with the io.WriterTo of conn if it has one.
+func writeTo(conn net.Conn, w io.Writer) (int64, error) {
+	if wt, ok := conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{conn})
+}
@@ -0,0 +1,162 @@
+// (c) biter
+
+// Package consul follows the healthy instances of a Consul service as the
+// members of a netproxy.ProxyPool, with the blocking queries of the HTTP
+// API of the agent:
+//
+//	pool := netproxy.NewProxyPool(&consul.Service{Name: "egress", Scheme: "socks5"}, netproxy.Direct, timeout)
+//	defer pool.Close()
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+const (
+	// wait is the longest time a blocking query waits for a change.
+	wait = 5 * time.Minute
+	// minInterval is the shortest time between the starts of two queries,
+	// against the agents answering the blocking queries at once.
+	minInterval = time.Second
+)
+
+// Service is a netproxy.Membership whose proxies are the instances of a
+// Consul service passing their health checks.
+type Service struct {
+	Addr   string        // URL of the Consul agent, "http://127.0.0.1:8500" if empty
+	Token  string        // ACL token, if any
+	Client *http.Client  // http.DefaultClient if nil
+	Name   string        // name of the service
+	Tag    string        // if not empty, the tag of the instances
+	Scheme string        // scheme of the proxy URLs, "socks5" if empty
+	User   *url.Userinfo // credentials of the proxies, if any
+}
+
+var _ netproxy.Membership = (*Service)(nil)
+
+// serviceEntry is an entry of the /v1/health/service endpoint.
+type serviceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// ------------------------------------------------------------------
+
+// Watch calls update with the proxy URLs of the instances of the service,
+// then again whenever they change, until ctx is done or a query fails.
+func (s *Service) Watch(ctx context.Context, update func([]*url.URL)) error {
+	var index uint64
+	var last []*url.URL
+	for first := true; ; first = false {
+		start := time.Now()
+		urls, next, err := s.query(ctx, index)
+		if err != nil {
+			return err
+		}
+		// The index is reset when it is not positive or goes backwards, see
+		// the documentation of the blocking queries.
+		if next == 0 || next < index {
+			next = 1
+		}
+		if first || !equal(urls, last) {
+			update(urls)
+			last = urls
+		}
+		index = next
+
+		if d := minInterval - time.Since(start); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// query returns the proxy URLs of the instances of the service once the
+// index of the service passes index, and the new index.
+func (s *Service) query(ctx context.Context, index uint64) ([]*url.URL, uint64, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	q := url.Values{"passing": {"true"}}
+	if s.Tag != "" {
+		q.Set("tag", s.Tag)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", wait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/health/service/"+url.PathEscape(s.Name)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.Token != "" {
+		req.Header.Set("X-Consul-Token", s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s: %s", s.Name, resp.Status)
+	}
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("consul: %s: %w", s.Name, err)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: %s: invalid X-Consul-Index: %w", s.Name, err)
+	}
+
+	scheme := s.Scheme
+	if scheme == "" {
+		scheme = "socks5"
+	}
+	urls := make([]*url.URL, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		urls = append(urls, &url.URL{Scheme: scheme, User: s.User, Host: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))})
+	}
+	return urls, next, nil
+}
+
+// equal reports whether a and b are the same URLs.
+func equal(a, b []*url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
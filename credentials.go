@@ -0,0 +1,61 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"fmt"
+)
+
+// CredentialsProvider supplies the credentials of a proxy at each dial,
+// e.g. short-lived tokens from Vault or STS used as proxy passwords, so that
+// they can rotate without rebuilding the dialers.
+type CredentialsProvider interface {
+	// GetCredentials returns the credentials of the proxy at proxyAddr
+	// for a dial with ctx. An empty User makes the dial unauthenticated.
+	GetCredentials(ctx context.Context, proxyAddr string) (Auth, error)
+}
+
+// CredentialsFunc is a function implementing CredentialsProvider.
+type CredentialsFunc func(ctx context.Context, proxyAddr string) (Auth, error)
+
+// GetCredentials returns f(ctx, proxyAddr).
+func (f CredentialsFunc) GetCredentials(ctx context.Context, proxyAddr string) (Auth, error) {
+	return f(ctx, proxyAddr)
+}
+
+// ------------------------------------------------------------------
+
+// WithCredentials makes the SOCKS5 and HTTP proxy dialers authenticate
+// with the credentials returned by p at each dial instead of those given
+// to the dialer, e.g. in the proxy URL. A failure of p fails the dial. The
+// credentials of ContextWithAuth still take precedence for SOCKS5.
+func WithCredentials(p CredentialsProvider) Option {
+	return func(o *Options) {
+		o.Credentials = p
+	}
+}
+
+// ------------------------------------------------------------------
+
+// credentials returns the credentials of a dial through b with ctx: those
+// of WithDialAuth, of the CredentialsProvider of the options, if any, or
+// static, or else those of the netrc file.
+func (b *base) credentials(ctx context.Context, static Auth) (Auth, error) {
+	if o := dialOptionsFrom(ctx); o != nil && o.auth != nil {
+		return *o.auth, nil
+	}
+	if b.opts.Credentials == nil {
+		if static.User == "" && b.opts.Netrc != "" && b.network != "unix" {
+			if auth, ok := netrcAuth(b.opts.Netrc, netrcHost(b.addr)); ok {
+				return auth, nil
+			}
+		}
+		return static, nil
+	}
+	auth, err := b.opts.Credentials.GetCredentials(ctx, b.addr)
+	if err != nil {
+		return Auth{}, fmt.Errorf("proxy: credentials for %s: %w", b.addr, err)
+	}
+	return auth, nil
+}
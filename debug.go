@@ -0,0 +1,110 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugMu serializes the records written to Options.Debug writers.
+var debugMu sync.Mutex
+
+// debugConn copies the bytes of a proxy handshake to a writer, with
+// credentials redacted. SOCKS5 negotiation is written as a hex dump, the HTTP
+// CONNECT exchange as text.
+type debugConn struct {
+	net.Conn
+	w      io.Writer
+	prefix string
+	text   bool
+}
+
+// WithDebug writes the raw proxy handshakes (SOCKS5 negotiation bytes,
+// CONNECT request and response) of each dial to w, with credentials
+// redacted. It is meant for diagnosing interop problems with proxy servers.
+func WithDebug(w io.Writer) Option {
+	return func(o *Options) {
+		o.Debug = w
+	}
+}
+
+// ------------------------------------------------------------------
+
+func (b *base) newDebugConn(conn net.Conn, target string) *debugConn {
+	return &debugConn{
+		Conn:   conn,
+		w:      b.opts.Debug,
+		prefix: b.scheme + " " + b.addr + " " + target,
+		text:   strings.HasPrefix(b.scheme, "http"),
+	}
+}
+
+// ------------------------------------------------------------------
+
+func (c *debugConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record("<", b[:n])
+	}
+	return n, err
+}
+
+// ------------------------------------------------------------------
+
+func (c *debugConn) Write(b []byte) (int, error) {
+	c.record(">", c.redact(b))
+	return c.Conn.Write(b)
+}
+
+// ------------------------------------------------------------------
+
+func (c *debugConn) record(dir string, b []byte) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s netproxy: %s %s %d bytes\n", time.Now().Format("15:04:05.000000"), c.prefix, dir, len(b))
+	if c.text {
+		buf.Write(b)
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else {
+		buf.WriteString(hex.Dump(b))
+	}
+
+	debugMu.Lock()
+	c.w.Write(buf.Bytes())
+	debugMu.Unlock()
+}
+
+// ------------------------------------------------------------------
+
+var proxyAuthorization = []byte("\r\nProxy-Authorization: ")
+
+// redact returns b with the credentials it carries masked.
+func (c *debugConn) redact(b []byte) []byte {
+	if c.text {
+		i := bytes.Index(b, proxyAuthorization)
+		if i < 0 {
+			return b
+		}
+		i += len(proxyAuthorization)
+		end := bytes.Index(b[i:], []byte("\r\n"))
+		if end < 0 {
+			end = len(b) - i
+		}
+		return append(append(append([]byte(nil), b[:i]...), "[redacted]"...), b[i+end:]...)
+	}
+
+	// A SOCKS5 username/password request (RFC 1929) is the only message
+	// the client sends that starts with version 1.
+	if len(b) > 0 && b[0] == 1 {
+		return append([]byte{b[0]}, bytes.Repeat([]byte{'*'}, len(b)-1)...)
+	}
+	return b
+}
@@ -0,0 +1,93 @@
+// (c) biter
+
+package netproxy
+
+// A DerivableDialer is a Dialer whose variants are derived from it without
+// parsing its proxy URL nor setting up its TLS state again. The built-in
+// dialers, those of FromURL, SOCKS5, HTTPProxyDialer, DialerSpec and
+// NewDirect, implement it:
+//
+//	base, _ := netproxy.FromURL(u, netproxy.Direct, 5*time.Second, netproxy.WithTLSConfig(cfg))
+//	quick := base.(netproxy.DerivableDialer).With(netproxy.WithTimeout(time.Second))
+//	chained := base.(netproxy.DerivableDialer).With(netproxy.WithForward(jump))
+type DerivableDialer interface {
+	Dialer
+	// Clone returns a copy of the dialer.
+	Clone() Dialer
+	// With returns a copy of the dialer with opts applied over its
+	// options. WithTimeout and WithForward replace its timeout and forward
+	// dialer.
+	With(opts ...Option) Dialer
+}
+
+var (
+	_ DerivableDialer = (*socks5)(nil)
+	_ DerivableDialer = (*httpProxy)(nil)
+	_ DerivableDialer = direct{}
+)
+
+// WithForward sets the forward dialer of the dialers derived with
+// DerivableDialer.With, through which they reach their proxy; nil is
+// Direct.
+func WithForward(forward ForwardDialer) Option {
+	return func(o *Options) {
+		o.Forward = WrapDialer(forward)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// with returns a copy of b with opts applied over its options.
+func (b base) with(opts []Option) base {
+	o := *b.opts
+	o.Timeout, o.Forward = b.timeout, b.forward
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	if b.tls && o.ClientSessionCache != nil && o.ClientSessionCache != b.opts.ClientSessionCache {
+		b.sessions = o.ClientSessionCache
+	}
+	b.timeout, b.forward = o.Timeout, o.Forward
+	if b.forward == nil {
+		b.forward = Direct
+	}
+	b.opts = &o
+	return b
+}
+
+func (s *socks5) Clone() Dialer {
+	c := *s
+	return &c
+}
+
+func (s *socks5) With(opts ...Option) Dialer {
+	return &socks5{base: s.base.with(opts), user: s.user, password: s.password}
+}
+
+func (s *httpProxy) Clone() Dialer {
+	c := *s
+	return &c
+}
+
+func (s *httpProxy) With(opts ...Option) Dialer {
+	return &httpProxy{base: s.base.with(opts), user: s.user, password: s.password}
+}
+
+func (d direct) Clone() Dialer {
+	return d
+}
+
+func (d direct) With(opts ...Option) Dialer {
+	o := new(Options)
+	if d.opts != nil {
+		*o = *d.opts
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	return direct{opts: o}
+}
@@ -0,0 +1,322 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// base holds what the proxy dialers of this package need to reach the proxy
+// server itself. It is embedded by socks5 and httpProxy.
+type base struct {
+	scheme  string
+	network string
+	addr    string
+	forward Dialer
+	timeout time.Duration
+	opts    *Options
+
+	tls      bool // the proxy is reached over TLS, see initTLS
+	sessions tls.ClientSessionCache
+}
+
+// handshakeFunc speaks a proxy protocol over conn and asks the proxy to
+// connect to target. It may return a net.Conn wrapping conn.
+type handshakeFunc func(conn net.Conn, target string) (net.Conn, error)
+
+// ------------------------------------------------------------------
+
+// dialTimeout returns the deadline budget for a dial made with ctx: the
+// time left until the context deadline if it has one, the configured
+// timeout otherwise.
+func (b *base) dialTimeout(ctx context.Context) time.Duration {
+	timeout := b.timeout
+	if o := dialOptionsFrom(ctx); o != nil && o.timeout > 0 {
+		timeout = o.timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout < 0 {
+		timeout = 1
+	}
+	return timeout
+}
+
+// ------------------------------------------------------------------
+
+// dial connects to the proxy through the forward dialer and runs handshake
+// on the new connection to reach addr.
+func (b *base) dial(ctx context.Context, network, addr string, handshake handshakeFunc) (net.Conn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// The dial records its own timings, if needed, and hides those of an
+	// enclosing dial from the phases of its forward dialer.
+	var tm *DialTimings
+	if b.opts.ConnStats || b.opts.Hooks.OnHandshakeDone != nil || b.opts.Hooks.OnDialError != nil {
+		tm = new(DialTimings)
+	}
+	if tm != nil || timings(ctx) != nil {
+		ctx = context.WithValue(ctx, timingsKey{}, tm)
+	}
+	ctx, end := b.trace(ctx, PhaseDial, network, addr)
+	m := b.opts.Metrics
+	if m != nil {
+		m.DialStarted(b.scheme, b.addr)
+	}
+	b.log(ctx, slog.LevelDebug, "netproxy: dial", "network", network, "target", addr)
+	start := time.Now()
+	b.fire(ctx, b.opts.Hooks.OnDialStart, network, addr, start, nil)
+
+	conn, handshakeTime, err := b.tunnel(ctx, network, addr, start, handshake)
+	end(PhaseEnd{Err: err})
+	if err != nil {
+		if m != nil {
+			m.DialFailed(b.scheme, b.addr, err)
+		}
+		b.fire(ctx, b.opts.Hooks.OnDialError, network, addr, start, err)
+		b.log(ctx, slog.LevelWarn, "netproxy: dial failed", "network", network, "target", addr, "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+	dialTime := time.Since(start)
+	b.log(ctx, slog.LevelDebug, "netproxy: connected", "network", network, "target", addr, "duration", dialTime)
+
+	if m != nil {
+		conn = newMeteredConn(conn, m, b.scheme, b.addr)
+	}
+	if b.opts.ActivityDeadline && b.timeout > 0 {
+		conn = newActivityConn(conn, b.timeout)
+	}
+	if b.opts.IdleTimeout > 0 {
+		conn = newIdleConn(conn, b.opts.IdleTimeout)
+	}
+	if b.opts.ConnStats {
+		conn = &statsConn{Conn: conn, dial: dialTime, handshake: handshakeTime, timings: *tm}
+	}
+	return conn, nil
+}
+
+// ------------------------------------------------------------------
+
+// tunnel connects to the proxy and runs handshake, returning the tunnel and
+// the time spent once connected to the proxy.
+func (b *base) tunnel(ctx context.Context, network, addr string, start time.Time, handshake handshakeFunc) (net.Conn, time.Duration, error) {
+	target := addr
+	if b.opts.ResolveLocally {
+		var err error
+		if target, err = b.resolveTarget(ctx, network, addr); err != nil {
+			return nil, 0, b.opError("resolve", network, addr, err)
+		}
+	}
+
+	connectCtx := ctx
+	if b.opts.ResponseTimeout > 0 {
+		// The timeout of the dialer is that of the connection only.
+		if timeout := b.dialTimeout(ctx); timeout > 0 {
+			var cancel context.CancelFunc
+			connectCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+	conn, err := b.connectProxy(connectCtx, network, addr)
+	if err != nil {
+		return nil, 0, b.opError("connect", network, addr, fmt.Errorf("%w: %w", ErrProxyUnreachable, err))
+	}
+	connected := time.Now()
+	b.fire(ctx, b.opts.Hooks.OnProxyConnected, network, addr, start, nil)
+
+	if timeout := b.dialTimeout(ctx); timeout > 0 {
+		err = conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			conn.Close()
+			return nil, 0, b.opError("connect", network, addr, err)
+		}
+	}
+	// The cancelation of ctx interrupts the handshakes.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if b.tls {
+		if conn, err = b.tlsHandshake(ctx, conn, network, addr); err != nil {
+			return nil, 0, b.opError("tls handshake", network, addr, err)
+		}
+	}
+
+	if b.opts.ResponseTimeout > 0 {
+		timeout := b.opts.ResponseTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = min(timeout, max(time.Until(deadline), 1))
+		}
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, 0, b.opError(b.scheme+" handshake", network, addr, err)
+		}
+	}
+
+	_, end := b.trace(ctx, PhaseHandshake, network, addr)
+	hc := conn
+	var cc *countingConn
+	if b.opts.Tracer != nil {
+		cc = &countingConn{Conn: hc}
+		hc = cc
+	}
+	if b.opts.Debug != nil {
+		hc = b.newDebugConn(hc, addr)
+	}
+
+	handshakeStart := time.Now()
+	c, err := handshake(hc, target)
+	c = unwrapConn(c, hc, conn)
+	result := PhaseEnd{Err: err}
+	if cc != nil {
+		result.BytesRead, result.BytesWritten = cc.read.Load(), cc.written.Load()
+	}
+	end(result)
+	if err == nil && !stop() {
+		c.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			err = ctx.Err()
+		}
+		return nil, 0, b.opError(b.scheme+" handshake", network, addr, err)
+	}
+	if m := b.opts.Metrics; m != nil {
+		m.DialSucceeded(b.scheme, b.addr, time.Since(handshakeStart))
+	}
+	b.fire(ctx, b.opts.Hooks.OnHandshakeDone, network, addr, start, nil)
+	return c, time.Since(connected), nil
+}
+
+// ------------------------------------------------------------------
+
+// resolveTarget resolves the host of addr locally, with the resolver and
+// family preference of b, and returns the first address. It fails with
+// ErrDNSLeak in strict DNS mode.
+func (b *base) resolveTarget(ctx context.Context, network, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	if b.opts.StrictDNS {
+		return "", ErrDNSLeak
+	}
+	ctx, end := b.trace(ctx, PhaseDNS, network, addr)
+	addrs, err := b.opts.lookup(ctx, b.opts.Family.narrow(network), host, port)
+	end(PhaseEnd{Err: err})
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// ------------------------------------------------------------------
+
+// connectProxy opens the connection to the proxy server. When the proxy is
+// dialed directly and a Tracer is set, the proxy host is resolved here so
+// that DNS and TCP connect show up as separate phases.
+func (b *base) connectProxy(ctx context.Context, network, target string) (net.Conn, error) {
+	forward := b.forwardDialer()
+	if _, ok := forward.(direct); !ok || b.opts.Tracer == nil && timings(ctx) == nil || !strings.HasPrefix(b.network, "tcp") {
+		ctx, end := b.trace(ctx, PhaseConnect, network, target)
+		conn, err := forward.DialContext(ctx, b.network, b.addr)
+		end(PhaseEnd{Err: err})
+		return conn, err
+	}
+
+	host, port, err := net.SplitHostPort(b.addr)
+	if err != nil {
+		return nil, err
+	}
+	proxyNetwork := b.opts.Family.narrow(b.network)
+	addrs := []string{b.addr}
+	if net.ParseIP(host) == nil && host != "" {
+		dnsCtx, end := b.trace(ctx, PhaseDNS, network, target)
+		addrs, err = b.opts.lookup(dnsCtx, proxyNetwork, host, port)
+		end(PhaseEnd{Err: err})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, end := b.trace(ctx, PhaseConnect, network, target)
+	conn, err := b.opts.dialAddrs(ctx, proxyNetwork, addrs)
+	end(PhaseEnd{Err: err})
+	return conn, err
+}
+
+// ------------------------------------------------------------------
+
+// forwardDialer returns the dialer used to reach the proxy: the forward
+// dialer, or a direct one with the socket options of b when forward is the
+// plain Direct.
+func (b *base) forwardDialer() Dialer {
+	if d, ok := b.forward.(direct); ok && d.opts == nil {
+		return direct{opts: b.opts}
+	}
+	return b.forward
+}
+
+// ------------------------------------------------------------------
+
+// ipNetwork maps a dial network to the matching LookupIP network.
+func ipNetwork(network string) string {
+	switch network {
+	case "tcp4", "udp4":
+		return "ip4"
+	case "tcp6", "udp6":
+		return "ip6"
+	}
+	return "ip"
+}
+
+// ------------------------------------------------------------------
+
+// countingConn counts the bytes exchanged during a traced handshake.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// unwrapConn replaces wrapper by orig in the connection returned by a
+// handshake, so that wrappers only used during the handshake cost nothing
+// afterwards.
+func unwrapConn(conn, wrapper, orig net.Conn) net.Conn {
+	if wrapper == orig {
+		return conn
+	}
+	switch v := conn.(type) {
+	case *bufferedConn:
+		if v.Conn == wrapper {
+			v.Conn = orig
+		}
+	default:
+		if conn == wrapper {
+			return orig
+		}
+	}
+	return conn
+}
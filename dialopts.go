@@ -0,0 +1,116 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A DialOption overrides a setting of the dialers for a single dial, see
+// DialWithOptions.
+type DialOption func(*dialOptions)
+
+// dialOptions are the overrides of a dial.
+type dialOptions struct {
+	timeout time.Duration
+	auth    *Auth
+	header  http.Header
+	dialers []Dialer
+}
+
+type dialOptionsKey struct{}
+
+// WithDialTimeout bounds the dial by timeout, as a context deadline does,
+// instead of the timeout of the dialer.
+func WithDialTimeout(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithDialAuth makes the SOCKS5 and HTTP proxies of the dial authenticate
+// with auth instead of the credentials of their dialers, of their
+// CredentialsProvider or of ContextWithAuth. A nil auth, or one with an
+// empty User, makes them unauthenticated.
+func WithDialAuth(auth *Auth) DialOption {
+	if auth == nil {
+		auth = new(Auth)
+	}
+	return func(o *dialOptions) {
+		o.auth = auth
+	}
+}
+
+// WithDialHeader adds header to the CONNECT requests sent to the HTTP
+// proxies of the dial, e.g. to tag it for the proxy logs or to route it.
+// The Proxy-Authorization header is that of the credentials.
+func WithDialHeader(header http.Header) DialOption {
+	return func(o *dialOptions) {
+		o.header = header
+	}
+}
+
+// WithDialVia makes the ProxySelectors of the dial try dialers in turn,
+// whatever their selection, see ContextWithDialers.
+func WithDialVia(dialers ...Dialer) DialOption {
+	return func(o *dialOptions) {
+		o.dialers = dialers
+	}
+}
+
+// ------------------------------------------------------------------
+
+// ContextWithDialOptions returns a copy of ctx applying opts to the dials
+// with it, after those of the dial options of ctx, if any. The dialers of
+// this package pass the context on to the dialers they wrap, so that the
+// overrides reach those of the proxies, e.g. behind a ProxyPool.
+func ContextWithDialOptions(ctx context.Context, opts ...DialOption) context.Context {
+	o := new(dialOptions)
+	if prev := dialOptionsFrom(ctx); prev != nil {
+		*o = *prev
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if len(o.dialers) > 0 {
+		ctx = ContextWithDialers(ctx, o.dialers...)
+	}
+	return context.WithValue(ctx, dialOptionsKey{}, o)
+}
+
+// dialOptionsFrom returns the dial options of ctx, nil if none.
+func dialOptionsFrom(ctx context.Context) *dialOptions {
+	if ctx == nil {
+		return nil
+	}
+	o, _ := ctx.Value(dialOptionsKey{}).(*dialOptions)
+	return o
+}
+
+// ------------------------------------------------------------------
+
+// DialWithOptions connects to the address addr on the given network with
+// d, overriding its settings with opts for this dial only, so that the
+// variations of a dialer, e.g. with other credentials for a session, need
+// no dialer of their own:
+//
+//	conn, err := netproxy.DialWithOptions(d, "tcp", "example.com:443",
+//		netproxy.WithDialTimeout(2*time.Second),
+//		netproxy.WithDialAuth(&netproxy.Auth{User: session, Password: "x"}))
+func DialWithOptions(d Dialer, network, addr string, opts ...DialOption) (net.Conn, error) {
+	return DialContextWithOptions(context.Background(), d, network, addr, opts...)
+}
+
+// DialContextWithOptions is DialWithOptions with ctx.
+func DialContextWithOptions(ctx context.Context, d Dialer, network, addr string, opts ...DialOption) (net.Conn, error) {
+	ctx = ContextWithDialOptions(ctx, opts...)
+	if o := dialOptionsFrom(ctx); o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	return d.DialContext(ctx, network, addr)
+}
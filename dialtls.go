@@ -0,0 +1,58 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DialTLS connects to the address addr on the given network with d, through
+// its proxy, then runs the TLS handshake with the target over the tunnel,
+// with cfg, and returns the TLS connection:
+//
+//	conn, err := netproxy.DialTLS(d, "tcp", "example.com:443", nil)
+//
+// The ServerName of cfg defaults to the host of addr, to verify the
+// certificate of the target and send it as SNI; a nil cfg is the zero
+// configuration. This is TLS to the target, end to end through the proxy,
+// unlike WithTLSConfig, which configures the TLS to the proxy itself.
+func DialTLS(d Dialer, network, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	return DialTLSContext(context.Background(), d, network, addr, cfg)
+}
+
+// DialTLSContext is DialTLS with ctx, which bounds the handshake as well.
+func DialTLSContext(ctx context.Context, d Dialer, network, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, targetTLSConfig(cfg, addr))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: TLS handshake with %s: %w", addr, err)
+	}
+	return tc, nil
+}
+
+// targetTLSConfig returns cfg, or a zero configuration if nil, with the
+// host of addr as ServerName if it has none.
+func targetTLSConfig(cfg *tls.Config, addr string) *tls.Config {
+	if cfg == nil {
+		cfg = new(tls.Config)
+	} else if cfg.ServerName != "" {
+		return cfg
+	} else {
+		cfg = cfg.Clone()
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	// A trailing dot is not part of the names of the certificates.
+	cfg.ServerName = strings.TrimSuffix(host, ".")
+	return cfg
+}
@@ -9,16 +9,37 @@ import (
 	"net"
 )
 
-type direct struct{}
+type direct struct {
+	opts *Options
+}
 
 // Direct is a direct proxy: one that makes network connections directly.
+// Connections to a dual-stack host race IPv6 and IPv4 (RFC 8305), as
+// net.Dialer does, so a broken IPv6 path does not stall them.
 var Direct = direct{}
 
-func (direct) Dial(network, addr string) (net.Conn, error) {
-	return net.Dial(network, addr)
+// NewDirect returns a Dialer that makes network connections directly, with
+// the socket level options (WithLocalAddr...) applied. It returns Direct if
+// no option is given.
+func NewDirect(opts ...Option) Dialer {
+	if len(opts) == 0 {
+		return Direct
+	}
+	return direct{opts: newOptions(opts)}
+}
+
+// IsDirect reports whether d makes network connections directly: whether
+// it is Direct or a Dialer returned by NewDirect.
+func IsDirect(d Dialer) bool {
+	_, ok := d.(direct)
+	return ok
+}
+
+func (d direct) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
 }
 
-func (direct) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return (&net.Dialer{}).DialContext(ctx, network, addr)
+func (d direct) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.opts.dial(ctx, network, addr)
 }
  
\ No newline at end of file
@@ -0,0 +1,200 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxDNSMessage is the largest DNS message, the limit of the TCP framing.
+const maxDNSMessage = 65535
+
+// DNSResolver returns a resolver that sends its queries to the encrypted DNS
+// server of rawURL: "https://host[:port]/path" for DNS over HTTPS (RFC 8484),
+// e.g. "https://1.1.1.1/dns-query", or "tls://host[:port]" for DNS over TLS
+// (RFC 7858, port 853 by default), e.g. "tls://9.9.9.9". The connections to
+// the server are made with d, Direct or a proxy dialer, and secured with
+// cfg, which may be nil; the server name defaults to the URL host. The
+// resolver can be given to WithResolver.
+func DNSResolver(rawURL string, d Dialer, cfg *tls.Config) (*net.Resolver, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: parsing the DNS server URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy: DNS server URL %q has no host", rawURL)
+	}
+	if cfg == nil {
+		cfg = new(tls.Config)
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch u.Scheme {
+	case "tls":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	case "https":
+		client := &http.Client{Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			TLSClientConfig:   cfg,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}}
+		endpoint := u.String()
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, url: endpoint}, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s for a DNS server", ErrUnsupportedScheme, u.Scheme)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// The Go resolver uses the TCP framing on a conn that is
+			// not a net.PacketConn, whatever the network.
+			return dial(ctx)
+		},
+	}, nil
+}
+
+// ------------------------------------------------------------------
+
+// dohConn carries the TCP framed DNS exchanges of the Go resolver over DNS
+// over HTTPS: each query written is POSTed when the answer is read.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	mu       sync.Mutex
+	deadline time.Time
+	query    bytes.Buffer
+	answer   bytes.Buffer
+	closed   bool
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.query.Len()+len(b) > 2+maxDNSMessage {
+		return 0, errors.New("proxy: DNS query too large")
+	}
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.answer.Len() == 0 {
+		if err := c.roundTrip(); err != nil {
+			return 0, err
+		}
+	}
+	return c.answer.Read(b)
+}
+
+// roundTrip POSTs the framed query and frames the answer.
+func (c *dohConn) roundTrip() error {
+	q := c.query.Bytes()
+	if len(q) < 2 || len(q) < 2+(int(q[0])<<8|int(q[1])) {
+		return io.ErrUnexpectedEOF
+	}
+	n := 2 + (int(q[0])<<8 | int(q[1]))
+	msg := q[2:n]
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy: DNS over HTTPS server: %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return err
+	}
+	if len(answer) > maxDNSMessage {
+		return errors.New("proxy: DNS answer too large")
+	}
+	c.query.Next(n)
+	c.answer.Write([]byte{byte(len(answer) >> 8), byte(len(answer))})
+	c.answer.Write(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+
+// dohAddr is the address of a dohConn.
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return "dns-over-https" }
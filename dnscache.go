@@ -0,0 +1,125 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// dnsLookupTimeout bounds a query shared by concurrent lookups, which does
+// not end with the context of any of them.
+const dnsLookupTimeout = 30 * time.Second
+
+// CachingResolver returns a Resolver that caches the successful lookups of
+// r (net.DefaultResolver if nil) for ttl, keeping at most size entries and
+// evicting the least recently used ones. Concurrent lookups of the same host
+// share a single query to r, which lasts at most 30 seconds. Give it to WithResolver so that the proxy and
+// target hosts resolved locally are not looked up at every dial.
+func CachingResolver(r Resolver, size int, ttl time.Duration) Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &dnsCache{
+		r:        r,
+		size:     max(size, 1),
+		ttl:      ttl,
+		entries:  make(map[dnsKey]*list.Element),
+		inflight: make(map[dnsKey]*dnsCall),
+		lru:      list.New(),
+		now:      time.Now,
+		timeout:  dnsLookupTimeout,
+	}
+}
+
+// ------------------------------------------------------------------
+
+// dnsKey identifies a lookup.
+type dnsKey struct {
+	network, host string
+}
+
+// dnsEntry is a cached lookup.
+type dnsEntry struct {
+	key     dnsKey
+	ips     []netip.Addr
+	expires time.Time
+}
+
+// dnsCall is a lookup in flight.
+type dnsCall struct {
+	done chan struct{}
+	ips  []netip.Addr
+	err  error
+}
+
+// dnsCache is the Resolver returned by CachingResolver.
+type dnsCache struct {
+	r    Resolver
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	entries  map[dnsKey]*list.Element
+	inflight map[dnsKey]*dnsCall
+	lru      *list.List // of *dnsEntry, most recently used first
+	now      func() time.Time
+	timeout  time.Duration // of the queries
+}
+
+func (c *dnsCache) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	key := dnsKey{network, host}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*dnsEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.mu.Unlock()
+			return slices.Clone(entry.ips), nil
+		}
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &dnsCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		// The query outlives a canceled caller, as others may share
+		// it.
+		go c.lookup(context.WithoutCancel(ctx), key, call)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return slices.Clone(call.ips), call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup queries the resolver for key and caches the result of call.
+func (c *dnsCache) lookup(ctx context.Context, key dnsKey, call *dnsCall) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	call.ips, call.err = c.r.LookupNetIP(ctx, key.network, key.host)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(call.done)
+	delete(c.inflight, key)
+	if call.err != nil || len(call.ips) == 0 {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&dnsEntry{key: key, ips: call.ips, expires: c.now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*dnsEntry).key)
+	}
+}
@@ -0,0 +1,132 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Errors returned by the dialers of this package, wrapped with details about
+// the failing dial. Use errors.Is to test for them.
+var (
+	// ErrProxyUnreachable is returned when the connection to the proxy
+	// server itself cannot be established.
+	ErrProxyUnreachable = errors.New("proxy: proxy unreachable")
+	// ErrProxyAuthRequired is returned when the proxy requires
+	// authentication and no credentials were configured.
+	ErrProxyAuthRequired = errors.New("proxy: authentication required")
+	// ErrProxyAuthFailed is returned when the proxy rejects the
+	// configured credentials.
+	ErrProxyAuthFailed = errors.New("proxy: authentication failed")
+	// ErrTargetRefusedByProxy is returned when the proxy reports that it
+	// could not or would not connect to the target.
+	ErrTargetRefusedByProxy = errors.New("proxy: target refused by proxy")
+	// ErrUnsupportedScheme is returned by FromURL for an unknown scheme.
+	ErrUnsupportedScheme = errors.New("proxy: unknown scheme")
+	// ErrUnsupportedNetwork is returned when a dialer cannot carry the
+	// requested network.
+	ErrUnsupportedNetwork = errors.New("proxy: unsupported network")
+	// ErrProtocol is returned when the proxy sends a malformed or
+	// unexpected reply.
+	ErrProtocol = errors.New("proxy: protocol error")
+	// ErrCertificatePin is returned when the certificate of a proxy
+	// reached over TLS does not match the pinned keys.
+	ErrCertificatePin = errors.New("proxy: certificate does not match pinned keys")
+	// ErrDNSLeak is returned in strict DNS mode (see WithStrictDNS)
+	// instead of resolving a proxied target locally.
+	ErrDNSLeak = errors.New("proxy: local DNS resolution refused in strict mode")
+)
+
+// ------------------------------------------------------------------
+
+// OpError is the error type returned by the dialers of this package. It
+// records which hop of the dial failed and implements net.Error.
+type OpError struct {
+	// Op is the failed operation: "dial", "resolve" for the local
+	// resolution of the target, "connect" for the connection to the
+	// proxy server, "tls handshake" or "<scheme> handshake" for the proxy
+	// protocol, e.g. "socks5 handshake"; "listen" or "accept" for the
+	// listeners of Listen.
+	Op string
+	// Scheme and Proxy identify the proxy server.
+	Scheme string
+	Proxy  string
+	// Network and Target are what the proxy was asked to connect to.
+	Network string
+	Target  string
+	// Err is the underlying error.
+	Err error
+}
+
+var _ net.Error = (*OpError)(nil)
+
+func (e *OpError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := e.Op
+	if e.Network != "" {
+		s += " " + e.Network
+	}
+	if e.Target != "" {
+		s += " " + e.Target
+	}
+	if e.Proxy != "" {
+		s += " via " + e.Scheme + "://" + e.Proxy
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the dial failed because a deadline was exceeded,
+// either the dialer timeout or the context deadline.
+func (e *OpError) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// Temporary reports whether retrying the dial may succeed: timeouts,
+// connections refused or reset and the SOCKS5 reply codes for which
+// SOCKS5Error.Temporary is true. Authentication, protocol and configuration
+// errors are not temporary.
+//
+// Deprecated: Temporary errors are not well-defined, as in net.Error.
+func (e *OpError) Temporary() bool {
+	var socksErr SOCKS5Error
+	switch {
+	case errors.As(e.Err, &socksErr):
+		return socksErr.Temporary()
+	case errors.Is(e.Err, ErrProxyAuthRequired), errors.Is(e.Err, ErrProxyAuthFailed),
+		errors.Is(e.Err, ErrProtocol), errors.Is(e.Err, ErrUnsupportedNetwork),
+		errors.Is(e.Err, context.Canceled):
+		return false
+	}
+	return isTimeout(e.Err) || errors.Is(e.Err, syscall.ECONNREFUSED) || errors.Is(e.Err, syscall.ECONNRESET)
+}
+
+// ------------------------------------------------------------------
+
+// opError returns an *OpError for a failed dial through b.
+func (b *base) opError(op, network, target string, err error) *OpError {
+	return &OpError{
+		Op:      op,
+		Scheme:  b.scheme,
+		Proxy:   b.addr,
+		Network: network,
+		Target:  target,
+		Err:     err,
+	}
+}
+
+// ------------------------------------------------------------------
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
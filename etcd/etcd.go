@@ -0,0 +1,184 @@
+// (c) biter
+
+// Package etcd follows the keys under a prefix in etcd, whose values are
+// proxy URLs, as the members of a netproxy.ProxyPool, with the JSON gateway
+// of the v3 API:
+//
+//	pool := netproxy.NewProxyPool(&etcd.Prefix{Prefix: "/egress/"}, netproxy.Direct, timeout)
+//	defer pool.Close()
+//
+// A proxy joins the pool with a key under the prefix, e.g.
+// "/egress/proxy-1" = "socks5://10.0.0.1:1080", best bound to a lease so
+// that it leaves the pool when it stops.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/biter777/netproxy"
+)
+
+// Prefix is a netproxy.Membership whose proxies are the values of the keys
+// under a prefix.
+type Prefix struct {
+	Endpoint string       // URL of an etcd server, "http://127.0.0.1:2379" if empty
+	Token    string       // authentication token, if any
+	Client   *http.Client // http.DefaultClient if nil
+	Prefix   string       // prefix of the keys
+}
+
+var _ netproxy.Membership = (*Prefix)(nil)
+
+// keyValue is a key and its value, base64 encoded by encoding/json.
+type keyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// header is the response header of the API, with its int64 encoded as a
+// string.
+type header struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// ------------------------------------------------------------------
+
+// Watch calls update with the proxy URLs of the keys under the prefix, then
+// again whenever they change, until ctx is done or the watch fails. The
+// values which are not valid URLs are skipped.
+func (p *Prefix) Watch(ctx context.Context, update func([]*url.URL)) error {
+	rangeEnd := prefixEnd([]byte(p.Prefix))
+	var resp struct {
+		Header header     `json:"header"`
+		KVs    []keyValue `json:"kvs"`
+	}
+	body, err := p.post(ctx, "/v3/kv/range", map[string]any{"key": []byte(p.Prefix), "range_end": rangeEnd})
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(body).Decode(&resp)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("etcd: %w", err)
+	}
+	values := make(map[string]string, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		values[string(kv.Key)] = string(kv.Value)
+	}
+	update(urls(values))
+
+	body, err = p.post(ctx, "/v3/watch", map[string]any{"create_request": map[string]any{
+		"key":            []byte(p.Prefix),
+		"range_end":      rangeEnd,
+		"start_revision": strconv.FormatInt(resp.Header.Revision+1, 10),
+	}})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					Type string   `json:"type"` // "PUT" is omitted
+					KV   keyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("etcd: watch: %w", err)
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("etcd: watch canceled: %s", msg.Result.CancelReason)
+		}
+		if len(msg.Result.Events) == 0 {
+			continue
+		}
+		for _, e := range msg.Result.Events {
+			if e.Type == "DELETE" {
+				delete(values, string(e.KV.Key))
+			} else {
+				values[string(e.KV.Key)] = string(e.KV.Value)
+			}
+		}
+		update(urls(values))
+	}
+}
+
+// post sends the JSON of req to the API endpoint path, and returns the
+// response body.
+func (p *Prefix) post(ctx context.Context, path string, req any) (io.ReadCloser, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "http://127.0.0.1:2379"
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		r.Header.Set("Authorization", p.Token)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd: %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// prefixEnd returns the end of the range of the keys starting with prefix,
+// as clientv3.GetPrefixRangeEnd.
+func prefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All the keys.
+	return []byte{0}
+}
+
+// urls returns the proxy URLs of values, in the order of their keys.
+func urls(values map[string]string) []*url.URL {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	urls := make([]*url.URL, 0, len(keys))
+	for _, k := range keys {
+		if u, err := url.Parse(values[k]); err == nil {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
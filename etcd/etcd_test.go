@@ -0,0 +1,84 @@
+// (c) biter
+
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tt := range []struct{ prefix, end string }{
+		{"/egress/", "/egress0"},
+		{"a\xff", "b"},
+		{"\xff", "\x00"},
+	} {
+		if got := string(prefixEnd([]byte(tt.prefix))); got != tt.end {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.end)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// An etcd server with one proxy at revision 7, where a second one is
+	// put and the first deleted.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			fmt.Fprint(w, `{"header":{"revision":"7"},"kvs":[{"key":"L2VncmVzcy9h","value":"c29ja3M1Oi8vMTAuMC4wLjE6MTA4MA=="}]}`)
+		case "/v3/watch":
+			var create struct {
+				CreateRequest struct {
+					Key           []byte `json:"key"`
+					StartRevision string `json:"start_revision"`
+				} `json:"create_request"`
+			}
+			b, _ := json.Marshal(req)
+			json.Unmarshal(b, &create)
+			if string(create.CreateRequest.Key) != "/egress/" || create.CreateRequest.StartRevision != "8" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, `{"result":{"created":true}}`)
+			fmt.Fprintln(w, `{"result":{"events":[{"kv":{"key":"L2VncmVzcy9i","value":"aHR0cDovLzEwLjAuMC4yOjMxMjg="}}]}}`)
+			fmt.Fprintln(w, `{"result":{"events":[{"type":"DELETE","kv":{"key":"L2VncmVzcy9h"}}]}}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	p := &Prefix{Endpoint: srv.URL, Prefix: "/egress/"}
+	updates := make(chan []*url.URL, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go p.Watch(ctx, func(urls []*url.URL) { updates <- urls })
+
+	for _, want := range [][]string{
+		{"socks5://10.0.0.1:1080"},
+		{"socks5://10.0.0.1:1080", "http://10.0.0.2:3128"},
+		{"http://10.0.0.2:3128"},
+	} {
+		select {
+		case urls := <-updates:
+			if len(urls) != len(want) {
+				t.Fatalf("got %v, want %v", urls, want)
+			}
+			for i := range urls {
+				if urls[i].String() != want[i] {
+					t.Errorf("got %v, want %v", urls[i], want[i])
+				}
+			}
+		case <-ctx.Done():
+			t.Fatal("no update")
+		}
+	}
+}
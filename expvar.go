@@ -0,0 +1,99 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// expvarMetrics publishes dial statistics under expvar. The published map
+// holds one map per proxy, keyed "scheme://proxy", with the counters
+// dial_attempts, dial_successes, dial_failures, open_connections,
+// bytes_read and bytes_written, and errors, a map of failures by
+// ErrorClass.
+type expvarMetrics struct {
+	root *expvar.Map
+	mu   sync.Mutex
+}
+
+var (
+	expvarMu       sync.Mutex
+	expvarRegistry = map[string]*expvarMetrics{}
+)
+
+// WithExpvar publishes dial statistics under the expvar name, e.g.
+// "netproxy". Dialers configured with the same name share the published
+// variable.
+func WithExpvar(name string) Option {
+	return WithMetrics(expvarFor(name))
+}
+
+// ------------------------------------------------------------------
+
+func expvarFor(name string) *expvarMetrics {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if m, ok := expvarRegistry[name]; ok {
+		return m
+	}
+	root, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		root = expvar.NewMap(name)
+	}
+	m := &expvarMetrics{root: root}
+	expvarRegistry[name] = m
+	return m
+}
+
+// ------------------------------------------------------------------
+
+// proxy returns the map of the proxy, creating it on first use.
+func (m *expvarMetrics) proxy(scheme, proxy string) *expvar.Map {
+	key := scheme + "://" + proxy
+	if v, ok := m.root.Get(key).(*expvar.Map); ok {
+		return v
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.root.Get(key).(*expvar.Map); ok {
+		return v
+	}
+	v := new(expvar.Map).Init()
+	v.Set("errors", new(expvar.Map).Init())
+	m.root.Set(key, v)
+	return v
+}
+
+// ------------------------------------------------------------------
+
+func (m *expvarMetrics) DialStarted(scheme, proxy string) {
+	m.proxy(scheme, proxy).Add("dial_attempts", 1)
+}
+
+func (m *expvarMetrics) DialFailed(scheme, proxy string, err error) {
+	v := m.proxy(scheme, proxy)
+	v.Add("dial_failures", 1)
+	v.Get("errors").(*expvar.Map).Add(ErrorClass(err), 1)
+}
+
+func (m *expvarMetrics) DialSucceeded(scheme, proxy string, _ time.Duration) {
+	v := m.proxy(scheme, proxy)
+	v.Add("dial_successes", 1)
+	v.Add("open_connections", 1)
+}
+
+func (m *expvarMetrics) BytesTransferred(scheme, proxy string, read, written int) {
+	v := m.proxy(scheme, proxy)
+	if read > 0 {
+		v.Add("bytes_read", int64(read))
+	}
+	if written > 0 {
+		v.Add("bytes_written", int64(written))
+	}
+}
+
+func (m *expvarMetrics) ConnClosed(scheme, proxy string) {
+	m.proxy(scheme, proxy).Add("open_connections", -1)
+}
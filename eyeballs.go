@@ -0,0 +1,150 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// errNoAddress is returned when there is no address to dial.
+var errNoAddress = errors.New("proxy: no address to dial")
+
+// defaultFallbackDelay is the RFC 8305 Connection Attempt Delay, as used by
+// net.Dialer.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// fallbackDelay returns the time to wait before racing the other address
+// family, or a negative duration if racing is disabled.
+func (o *Options) fallbackDelay() time.Duration {
+	if o == nil || o.FallbackDelay == 0 {
+		return defaultFallbackDelay
+	}
+	return o.FallbackDelay
+}
+
+// ------------------------------------------------------------------
+
+// dialAddrs connects to the first of the resolved addrs ("ip:port") that
+// accepts a connection, racing the address families as RFC 8305 ("Happy
+// Eyeballs") does.
+func (o *Options) dialAddrs(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	return dialParallel(ctx, addrs, o.fallbackDelay(), func(ctx context.Context, addr string) (net.Conn, error) {
+		return o.dialContext(ctx, network, addr)
+	})
+}
+
+// ------------------------------------------------------------------
+
+// dialParallel tries addrs in turn with dial. The addresses of the family of
+// the first one are the primaries; the others, the fallbacks, are tried in
+// parallel from delay after the start, or as soon as the primaries fail. The
+// first connection wins and the other attempt is canceled. A negative delay
+// tries all addresses in order.
+func dialParallel(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	primaries, fallbacks := partitionAddrs(addrs)
+	if len(fallbacks) == 0 || delay < 0 {
+		return dialSerial(ctx, addrs, dial)
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result) // unbuffered: a late winner is closed
+	returned := make(chan struct{})
+	defer close(returned)
+
+	race := func(primary bool, addrs []string) {
+		conn, err := dialSerial(ctx, addrs, dial)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	go race(true, primaries)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var primary, fallback *result
+	for {
+		select {
+		case <-timer.C:
+			go race(false, fallbacks)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = &res
+			} else {
+				fallback = &res
+			}
+			if primary != nil && fallback != nil {
+				return nil, primary.err
+			}
+			if res.primary && timer.Stop() {
+				go race(false, fallbacks)
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+
+// dialSerial tries addrs in order and returns the first connection, or the
+// first error.
+func dialSerial(ctx context.Context, addrs []string, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		if err := ctx.Err(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			break
+		}
+		conn, err := dial(ctx, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errNoAddress
+	}
+	return nil, firstErr
+}
+
+// ------------------------------------------------------------------
+
+// partitionAddrs splits addrs into those of the family of the first one and
+// the others, keeping their order.
+func partitionAddrs(addrs []string) (primaries, fallbacks []string) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	is4 := func(addr string) bool {
+		ap, err := netip.ParseAddrPort(addr)
+		return err != nil || ap.Addr().Unmap().Is4()
+	}
+	want := is4(addrs[0])
+	for _, addr := range addrs {
+		if is4(addr) == want {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
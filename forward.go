@@ -0,0 +1,281 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithPlainHTTPForwarding makes the transports of NewTransport and
+// NewHTTPClient send the plain HTTP requests to their HTTP proxy in the
+// classic forward-proxy style, a request with the absolute URI of the
+// target, rather than through a CONNECT tunnel, for the proxies refusing
+// CONNECT to port 80. The HTTPS requests are still tunneled. It needs an
+// "http" or "https" proxy URL.
+//
+// The connections to the proxy are kept alive and reused across the
+// requests, up to MaxIdleConnsPerHost of the transport for IdleConnTimeout,
+// unless the proxy closes them with a "Connection: close" or
+// "Proxy-Connection: close" header; a "Proxy-Connection: keep-alive" keeps
+// those of the HTTP/1.0 proxies.
+func WithPlainHTTPForwarding(enabled bool) Option {
+	return func(o *Options) {
+		o.PlainHTTPForwarding = enabled
+	}
+}
+
+// ------------------------------------------------------------------
+
+// forwardPlainHTTP makes t send its plain HTTP requests to the proxy of s
+// in forward-proxy style, and tunnel the others with its DialContext.
+func (s *httpProxy) forwardPlainHTTP(t *http.Transport) error {
+	if s.network == "unix" {
+		return errors.New("proxy: plain HTTP forwarding needs a TCP proxy, not a Unix socket")
+	}
+	maxIdle := t.MaxIdleConnsPerHost
+	if maxIdle == 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+	t.RegisterProtocol("http", &forwardTransport{proxy: s, maxIdle: maxIdle, idleTimeout: t.IdleConnTimeout})
+	return nil
+}
+
+// dialProxy connects to the proxy of s, over TLS if it is reached so, to
+// send it requests.
+func (s *httpProxy) dialProxy(ctx context.Context) (net.Conn, error) {
+	if timeout := s.dialTimeout(ctx); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := s.connectProxy(ctx, s.network, s.addr)
+	if err != nil {
+		return nil, s.opError("connect", s.network, s.addr, fmt.Errorf("%w: %w", ErrProxyUnreachable, err))
+	}
+	if s.tls {
+		if conn, err = s.tlsHandshake(ctx, conn, s.network, s.addr); err != nil {
+			return nil, s.opError("tls handshake", s.network, s.addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// ------------------------------------------------------------------
+
+// forwardTransport sends the requests to an HTTP proxy in forward-proxy
+// style, over a pool of persistent connections per credentials.
+type forwardTransport struct {
+	proxy       *httpProxy
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*forwardConn // by user-pass
+}
+
+// forwardConn is a connection to the proxy.
+type forwardConn struct {
+	net.Conn
+	br     *bufio.Reader
+	key    string
+	idleAt time.Time
+}
+
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.proxy
+	auth, err := s.credentials(req.Context(), Auth{User: s.user, Password: s.password})
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	key := basicAuth(auth)
+	out := req.Clone(req.Context())
+	if out.Header == nil {
+		out.Header = make(http.Header)
+	}
+	if key != "" {
+		out.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(key)))
+	}
+	if !out.Close {
+		out.Header.Set("Proxy-Connection", "keep-alive")
+	}
+
+	for {
+		c := t.get(key)
+		reused := c != nil
+		if c == nil {
+			conn, err := s.dialProxy(req.Context())
+			if err != nil {
+				closeBody(req)
+				return nil, err
+			}
+			c = &forwardConn{Conn: conn, br: bufio.NewReader(conn), key: key}
+		}
+		resp, err := t.send(c, out)
+		// A kept connection may have been closed by the proxy meanwhile:
+		// the requests that can be sent again are, on a new one.
+		if err != nil && reused && replayable(req) && req.Context().Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// send sends req on c, and returns its response, whose body releases c.
+func (t *forwardTransport) send(c *forwardConn, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Unix(1, 0)) })
+	err := req.WriteProxy(c)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(c.br, req)
+	}
+	if err != nil {
+		stop()
+		c.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body = &forwardBody{ReadCloser: resp.Body, t: t, c: c, stop: stop, keep: keepAlive(req, resp)}
+	return resp, nil
+}
+
+// keepAlive reports whether the connection of resp to req may be reused.
+func keepAlive(req *http.Request, resp *http.Response) bool {
+	pc := resp.Header["Proxy-Connection"]
+	switch {
+	case req.Close, hasToken(pc, "close"), hasToken(resp.Header["Connection"], "close"):
+		return false
+	case resp.ProtoMajor == 1 && resp.ProtoMinor == 0:
+		// resp.Close only honors the Connection header.
+		return !resp.Close || hasToken(pc, "keep-alive")
+	}
+	return !resp.Close
+}
+
+// hasToken reports whether the comma-separated values of a header hold
+// token, case-insensitively.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replayable reports whether req may be sent again after a failure: an
+// idempotent request without a body.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// ------------------------------------------------------------------
+
+// get returns a connection to the proxy with the user-pass key kept alive,
+// nil if none.
+func (t *forwardTransport) get(key string) *forwardConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conns := t.idle[key]; len(conns) > 0; conns = t.idle[key] {
+		c := conns[len(conns)-1]
+		t.idle[key] = conns[:len(conns)-1]
+		if t.idleTimeout <= 0 || time.Since(c.idleAt) < t.idleTimeout {
+			return c
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// put keeps c alive for the next requests, or closes it if enough are.
+func (t *forwardTransport) put(c *forwardConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[c.key]) >= t.maxIdle {
+		c.Close()
+		return
+	}
+	if t.idle == nil {
+		t.idle = make(map[string][]*forwardConn)
+	}
+	c.idleAt = time.Now()
+	t.idle[c.key] = append(t.idle[c.key], c)
+}
+
+// CloseIdleConnections closes the connections to the proxy kept alive.
+func (t *forwardTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conns := range t.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	t.idle = nil
+}
+
+// ------------------------------------------------------------------
+
+// forwardBody is the body of a response of the proxy, which releases its
+// connection once read to the end, or closes it if closed before.
+type forwardBody struct {
+	io.ReadCloser
+	t    *forwardTransport
+	c    *forwardConn
+	stop func() bool
+	keep bool
+
+	once sync.Once
+}
+
+func (b *forwardBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release(true)
+	}
+	return n, err
+}
+
+// Close closes the connection first if the body was not read to the end,
+// rather than reading the rest of it.
+func (b *forwardBody) Close() error {
+	b.release(false)
+	return b.ReadCloser.Close()
+}
+
+// release keeps the connection alive if the body was read to the end and
+// the proxy allows it, or closes it.
+func (b *forwardBody) release(eof bool) {
+	b.once.Do(func() {
+		if b.stop() && eof && b.keep && b.c.br.Buffered() == 0 {
+			b.t.put(b.c)
+			return
+		}
+		b.c.Close()
+	})
+}
@@ -0,0 +1,142 @@
+// (c) biter
+
+package grpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func echoTarget(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func ping(t *testing.T, d netproxy.Dialer, addr string) {
+	t.Helper()
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != addr {
+		t.Errorf("got remote address %s, want %s", c.RemoteAddr(), addr)
+	}
+	msg := strings.Repeat("ping", 20000) // more than a message
+	go c.Write([]byte(msg))
+	b := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != msg {
+		t.Errorf("got %d bytes, %v, want the %d bytes written", len(b), err, len(msg))
+	}
+}
+
+func TestH2C(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(Handler(nil))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, _ := url.Parse("grpc+h2c://" + srv.Listener.Addr().String())
+	d, err := netproxy.FromURL(u, netproxy.Direct, 5*time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ping(t, d, target.Addr().String())
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("got %d connections to the relay, want 1", n)
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	_, err = d.Dial("tcp", closed.Addr().String())
+	var grpcErr *Error
+	if !errors.As(err, &grpcErr) || grpcErr.Code != codeUnavailable || !errors.Is(err, netproxy.ErrTargetRefusedByProxy) {
+		t.Errorf("got %v, want an unavailable status", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	target := echoTarget(t)
+	defer target.Close()
+
+	auth := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tunnel.Relay/Open" {
+			http.NotFound(w, r)
+			return
+		}
+		user, _, _ := r.BasicAuth()
+		auth <- user
+		Handler(netproxy.Direct).ServeHTTP(w, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, _ := url.Parse("grpc://user:pass@" + srv.Listener.Addr().String() + "/tunnel.Relay/Open")
+	d, err := NewDialer(u, nil, srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	defer d.CloseIdleConnections()
+	ping(t, d, target.Addr().String())
+	if got := <-auth; got != "user" {
+		t.Errorf("got user %q, want user", got)
+	}
+}
+
+func TestChunkData(t *testing.T) {
+	buf := make([]byte, 16+300)
+	copy(buf[16:], strings.Repeat("x", 300))
+	msg := frame(buf, 300)
+	if len(msg) != 5+3+300 {
+		t.Fatalf("got a message of %d bytes, want %d", len(msg), 5+3+300)
+	}
+	// An unknown varint field before the data.
+	data, err := chunkData(append([]byte{0x10, 0x96, 0x01}, msg[5:]...))
+	if err != nil || string(data) != strings.Repeat("x", 300) {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err := chunkData([]byte{0x0a, 0x05, 'x'}); !errors.Is(err, netproxy.ErrProtocol) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrProtocol)
+	}
+}
@@ -0,0 +1,107 @@
+// (c) biter
+
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// dialTimeout bounds the connection of the relay to a target.
+const dialTimeout = 30 * time.Second
+
+// Handler returns the handler of a relay, connecting the tunnels of the
+// Dialers to their targets with d (netproxy.Direct if nil). It is served
+// over HTTP/2, by an http.Server with TLS or unencrypted HTTP/2 enabled in
+// its Protocols. It does not authenticate the calls: wrap it in a handler
+// checking the Authorization header.
+func Handler(d netproxy.Dialer) http.Handler {
+	if d == nil {
+		d = netproxy.Direct
+	}
+	return relay{d}
+}
+
+// relay is the handler of the tunnel calls.
+type relay struct {
+	dialer netproxy.Dialer
+}
+
+func (h relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpc: not a gRPC call", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	target := r.Header.Get(TargetHeader)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		fail(w, codeInvalidArgument, "invalid target "+strconv.Quote(target))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	conn, err := h.dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		fail(w, codeUnavailable, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	go func() {
+		// The end of the call half-closes the connection to the target,
+		// whose response still goes back.
+		if err := copyFromFrames(conn, r.Body); err != nil && !errors.Is(err, io.EOF) {
+			conn.Close()
+			return
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	err = copyToFrames(flushWriter{w, rc}, conn)
+	code, msg := codeOK, ""
+	if !errors.Is(err, io.EOF) {
+		code, msg = codeUnavailable, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// fail replies to a call with a status and no message.
+func fail(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// flushWriter flushes each write to the client.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
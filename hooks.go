@@ -0,0 +1,71 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"time"
+)
+
+// DialEvent is passed to the Hooks of a dial.
+type DialEvent struct {
+	Scheme  string        // scheme of the proxy, e.g. "socks5"
+	Proxy   string        // address of the proxy server
+	Network string        // network of the target
+	Target  string        // address the proxy is asked to connect to
+	Start   time.Time     // when the dial started
+	Elapsed time.Duration // time since Start
+	Err     error         // the error, for OnDialError
+
+	// Timings are the time spent in the phases of the dial so far, for
+	// OnHandshakeDone and OnDialError.
+	Timings DialTimings
+}
+
+// Hooks are callbacks invoked during the dials of the proxy dialers of this
+// package. Any of them may be nil. They are called synchronously from the
+// dialing goroutine, so they should return quickly.
+type Hooks struct {
+	// OnDialStart is called when a dial begins.
+	OnDialStart func(DialEvent)
+	// OnProxyConnected is called once the connection to the proxy server
+	// is established, before the proxy handshake.
+	OnProxyConnected func(DialEvent)
+	// OnHandshakeDone is called once the proxy has connected to the
+	// target; the dial has succeeded.
+	OnHandshakeDone func(DialEvent)
+	// OnDialError is called when the dial fails.
+	OnDialError func(DialEvent)
+}
+
+// ------------------------------------------------------------------
+
+// WithHooks sets the callbacks invoked during each dial.
+func WithHooks(h Hooks) Option {
+	return func(o *Options) {
+		o.Hooks = h
+	}
+}
+
+// ------------------------------------------------------------------
+
+// fire calls hook, if set, with an event for the dial with ctx started at
+// start.
+func (b *base) fire(ctx context.Context, hook func(DialEvent), network, target string, start time.Time, err error) {
+	if hook == nil {
+		return
+	}
+	ev := DialEvent{
+		Scheme:  b.scheme,
+		Proxy:   b.addr,
+		Network: network,
+		Target:  target,
+		Start:   start,
+		Elapsed: time.Since(start),
+		Err:     err,
+	}
+	if tm := timings(ctx); tm != nil {
+		ev.Timings = *tm
+	}
+	hook(ev)
+}
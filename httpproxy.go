@@ -4,22 +4,24 @@ package netproxy
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type httpProxy struct {
+	base
 	user     string
 	password string
-	network  string
-	addr     string
-	forward  Dialer
-	timeout  time.Duration
 }
 
 // ------------------------------------------------------------------
@@ -30,96 +32,335 @@ type httpProxy struct {
 // underlying connection.
 type bufferedConn struct {
 	net.Conn
-	reader *bufio.Reader
+	reader *bufio.Reader // nil once drained
 }
 
 // Read first reads from the *bufio.Reader any data that has already been
-// buffered. Once all buffered data has been read, reads go to the net.Conn.
+// buffered. Once all buffered data has been read, the *bufio.Reader goes
+// back to the pool and reads go to the net.Conn.
 func (bc *bufferedConn) Read(b []byte) (n int, err error) {
+	if bc.reader == nil {
+		return bc.Conn.Read(b)
+	}
 	if bc.reader.Buffered() > 0 {
-		return bc.reader.Read(b)
+		n, err = bc.reader.Read(b)
+	} else {
+		n, err = bc.Conn.Read(b)
+	}
+	if bc.reader.Buffered() == 0 {
+		putReader(bc.reader)
+		bc.reader = nil
+	}
+	return n, err
+}
+
+// CloseWrite and CloseRead half close the connection, and SyscallConn
+// returns its socket, if the underlying net.Conn supports it, as
+// *net.TCPConn.
+func (bc *bufferedConn) CloseWrite() error { return closeWrite(bc.Conn) }
+func (bc *bufferedConn) CloseRead() error  { return closeRead(bc.Conn) }
+
+func (bc *bufferedConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(bc.Conn) }
+
+// WriteTo writes the buffered data to w, then the data of the underlying
+// net.Conn, with its io.WriterTo if it has one (splice on Linux).
+func (bc *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if bc.reader != nil {
+		b, _ := bc.reader.Peek(bc.reader.Buffered())
+		m, err := w.Write(b)
+		bc.reader.Discard(m)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		putReader(bc.reader)
+		bc.reader = nil
 	}
-	return bc.Conn.Read(b)
+	m, err := writeTo(bc.Conn, w)
+	return n + m, err
 }
 
+// ReadFrom writes the data of r on the underlying net.Conn, with its
+// io.ReaderFrom if it has one (sendfile, splice).
+func (bc *bufferedConn) ReadFrom(r io.Reader) (int64, error) { return readFrom(bc.Conn, r) }
+
 // ------------------------------------------------------------------
 
-func (s *httpProxy) auth() string {
-	a := s.user
-	if s.password != "" {
-		return a + ":" + s.password
+// defaultReadBufferSize is the default size of the readers of the CONNECT
+// responses.
+const defaultReadBufferSize = 4096
+
+// bufioReaders pools the readers of the CONNECT responses of the default
+// size, which are usually empty once the response is read: a server holding
+// many tunnels would otherwise keep a buffer per tunnel.
+var bufioReaders sync.Pool
+
+// getReader returns a reader of r with a buffer of size bytes, the default
+// if zero.
+func getReader(r io.Reader, size int) *bufio.Reader {
+	if size > 0 && size != defaultReadBufferSize {
+		return bufio.NewReaderSize(r, size)
+	}
+	if br, ok := bufioReaders.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, defaultReadBufferSize)
+}
+
+func putReader(br *bufio.Reader) {
+	if br.Size() == defaultReadBufferSize {
+		br.Reset(nil)
+		bufioReaders.Put(br)
 	}
-	return a
 }
 
 // ------------------------------------------------------------------
 
-func (s *httpProxy) dialAddr() string {
-	if s.user == "" {
-		return s.addr
+// WithReadBufferSize sets the size of the buffer reading the CONNECT
+// responses of HTTP proxies, which also holds any data the proxy sends
+// with the response; zero is 4096 bytes. The buffers of the default size
+// are pooled.
+func WithReadBufferSize(size int) Option {
+	return func(o *Options) {
+		o.ReadBufferSize = size
 	}
+}
 
-	addr := s.user
-	if s.password != "" {
-		addr = addr + ":" + s.password
+// WithHTTP10, if enabled, makes the HTTP proxy dialers send their CONNECT
+// requests as HTTP/1.0, for the old appliance proxies rejecting HTTP/1.1
+// ones, and ignore the Content-Length of the HTTP/1.0 responses, whose
+// bodies end with the connection.
+func WithHTTP10(enabled bool) Option {
+	return func(o *Options) {
+		o.HTTP10 = enabled
 	}
+}
 
-	return addr + "@" + s.addr
+// writeConnect10 writes req on w as an HTTP/1.0 request.
+func writeConnect10(w io.Writer, req *http.Request) error {
+	var b bytes.Buffer
+	b.WriteString("CONNECT " + req.Host + " HTTP/1.0\r\nHost: " + req.Host + "\r\n")
+	req.Header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// http10 reports whether resp is an HTTP/1.0 response whose Content-Length
+// is ignored.
+func (s *httpProxy) http10(resp *http.Response) bool {
+	return s.opts.HTTP10 && resp.ProtoMajor == 1 && resp.ProtoMinor == 0
 }
 
 // ------------------------------------------------------------------
 
-// DialContext - golang.org/x/net/proxy need to add DialContext
-func (s *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	if ctx != nil {
-		if deadline, ok := ctx.Deadline(); ok {
-			s.timeout = deadline.Sub(time.Now())
-		}
+// WithErrorBodyLimit sets how much of the body of the failed CONNECT
+// responses of HTTP proxies is read and discarded, so that the connection
+// closes cleanly; zero is 64 KiB, negative reads none. The start of the
+// body, often an error page telling why, is kept in the HTTPProxyError.
+func WithErrorBodyLimit(limit int) Option {
+	return func(o *Options) {
+		o.ErrorBodyLimit = limit
 	}
-	if s.timeout < 0 {
-		s.timeout = 1
+}
+
+// defaultErrorBodyLimit is the default limit of WithErrorBodyLimit.
+const defaultErrorBodyLimit = 64 << 10
+
+// errorSnippetSize bounds the body kept in an HTTPProxyError.
+const errorSnippetSize = 512
+
+// WithMaxResponseHeader bounds the header of the CONNECT responses of HTTP
+// proxies to maxBytes bytes, status line included, and maxFields fields, so
+// that a broken or malicious proxy cannot make the client allocate without
+// limit; zero is 64 KiB and 100 fields. The dials with a larger header
+// fail with an error wrapping ErrProtocol.
+func WithMaxResponseHeader(maxBytes, maxFields int) Option {
+	return func(o *Options) {
+		o.MaxHeaderBytes = maxBytes
+		o.MaxHeaderFields = maxFields
+	}
+}
+
+// The default limits of WithMaxResponseHeader.
+const (
+	defaultMaxHeaderBytes  = 64 << 10
+	defaultMaxHeaderFields = 100
+)
+
+// headerLimitReader fails with ErrProtocol once more than n bytes were
+// read, until disabled with a negative n.
+type headerLimitReader struct {
+	r     io.Reader
+	addr  string
+	n     int
+	limit int
+}
+
+func (r *headerLimitReader) Read(b []byte) (int, error) {
+	if r.n < 0 {
+		return r.r.Read(b)
+	}
+	if r.n == 0 {
+		return 0, fmt.Errorf("%w: HTTP proxy at %s sent more than %d bytes of header", ErrProtocol, r.addr, r.limit)
+	}
+	if len(b) > r.n {
+		b = b[:r.n]
 	}
-	return s.Dial(network, addr)
+	n, err := r.r.Read(b)
+	r.n -= n
+	return n, err
+}
+
+// headerLimits returns the limits of the header of the CONNECT responses
+// of s.
+func (s *httpProxy) headerLimits() (maxBytes, maxFields int) {
+	maxBytes, maxFields = s.opts.MaxHeaderBytes, s.opts.MaxHeaderFields
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxHeaderBytes
+	}
+	if maxFields <= 0 {
+		maxFields = defaultMaxHeaderFields
+	}
+	if s.opts.StrictProtocol {
+		maxBytes = min(maxBytes, strictMaxHeaderBytes)
+	}
+	return maxBytes, maxFields
+}
+
+// checkFields checks the number of fields of the header of resp.
+func (s *httpProxy) checkFields(resp *http.Response, maxFields int) error {
+	n := 0
+	for _, v := range resp.Header {
+		n += len(v)
+	}
+	if n > maxFields {
+		return fmt.Errorf("%w: HTTP proxy at %s sent %d header fields, more than %d", ErrProtocol, s.addr, n, maxFields)
+	}
+	return nil
 }
 
 // ------------------------------------------------------------------
 
-// Dial connects to the address addr on the given network via the HTTP/HTTPS proxy.
-func (s *httpProxy) Dial(network, addr string) (net.Conn, error) {
-	conn, err := s.forward.Dial(s.network, s.addr)
-	if err != nil {
-		return nil, err
+// HTTPProxyError is a failed CONNECT response of an HTTP proxy, wrapped
+// with ErrTargetRefusedByProxy, ErrProxyAuthRequired or
+// ErrProxyAuthFailed. Use errors.As to get it.
+type HTTPProxyError struct {
+	// StatusCode and Status are those of the response, e.g. 403 and
+	// "403 Forbidden".
+	StatusCode int
+	Status     string
+	// Body is the start of the body of the response, up to 512 bytes.
+	Body []byte
+}
+
+// Error returns the status of the response, followed by the first line of
+// its body, if any.
+func (e *HTTPProxyError) Error() string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(e.Body)), "\n")
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return e.Status
 	}
+	if len(line) > 100 {
+		line = line[:100] + "..."
+	}
+	return fmt.Sprintf("%s: %q", e.Status, line)
+}
 
-	if s.timeout > 0 {
-		err = conn.SetDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			conn.Close()
-			return nil, err
-		}
+// drain reads and discards the body of the failed CONNECT response resp
+// read with br, up to the ErrorBodyLimit, and returns its start. A body
+// without a length, which ends with the connection, is only read as far as
+// it is buffered, not to wait for the proxy to close.
+func (s *httpProxy) drain(resp *http.Response, br *bufio.Reader) []byte {
+	limit := int64(s.opts.ErrorBodyLimit)
+	if limit == 0 {
+		limit = defaultErrorBodyLimit
+	}
+	if limit < 0 {
+		return nil
+	}
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 || s.http10(resp) {
+		limit = min(limit, int64(br.Buffered()))
+	}
+	var snippet bytes.Buffer
+	io.Copy(io.Discard, io.TeeReader(io.LimitReader(resp.Body, limit), &snippetWriter{&snippet}))
+	resp.Body.Close()
+	return snippet.Bytes()
+}
+
+// snippetWriter keeps the first errorSnippetSize bytes written to it.
+type snippetWriter struct {
+	b *bytes.Buffer
+}
+
+func (w *snippetWriter) Write(p []byte) (int, error) {
+	if n := errorSnippetSize - w.b.Len(); n > 0 {
+		w.b.Write(p[:min(n, len(p))])
 	}
+	return len(p), nil
+}
 
-	if conn, err = s.connect(conn, addr); err != nil {
-		conn.Close()
-		return nil, err
+// ------------------------------------------------------------------
+
+// basicAuth returns the user-pass of the Basic authentication with auth,
+// empty without a user.
+func basicAuth(auth Auth) string {
+	if auth.Password != "" {
+		return auth.User + ":" + auth.Password
 	}
-	return conn, nil
+	return auth.User
 }
 
 // ------------------------------------------------------------------
 
-func (s *httpProxy) connect(conn net.Conn, target string) (net.Conn, error) {
+// DialContext - golang.org/x/net/proxy need to add DialContext
+func (s *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	auth, err := s.credentials(ctx, Auth{User: s.user, Password: s.password})
+	if err != nil {
+		return nil, s.opError("dial", network, addr, err)
+	}
+	var header http.Header
+	if o := dialOptionsFrom(ctx); o != nil {
+		header = o.header
+	}
+	return s.dial(ctx, network, addr, func(conn net.Conn, target string) (net.Conn, error) {
+		return s.connect(conn, target, auth, header)
+	})
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network via the HTTP/HTTPS proxy.
+func (s *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// ------------------------------------------------------------------
+
+func (s *httpProxy) connect(conn net.Conn, target string, auth Auth, header http.Header) (net.Conn, error) {
 	connectReq := &http.Request{
 		Method: http.MethodConnect,
 		URL:    &url.URL{Opaque: target},
 		Host:   target,
-		Header: make(http.Header),
+		Header: header.Clone(),
+	}
+	if connectReq.Header == nil {
+		connectReq.Header = make(http.Header)
 	}
 
-	if auth := s.auth(); auth != "" {
-		connectReq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	userPass := basicAuth(auth)
+	if userPass != "" {
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(userPass)))
+	}
+	var err error
+	if s.opts.HTTP10 {
+		err = writeConnect10(conn, connectReq)
+	} else {
+		err = connectReq.Write(conn)
 	}
-	err := connectReq.Write(conn)
 	if err != nil {
 		return conn, err
 	}
@@ -127,20 +368,52 @@ func (s *httpProxy) connect(conn net.Conn, target string) (net.Conn, error) {
 	// Read in the response. http.ReadResponse will read in the status line, mime
 	// headers, and potentially part of the response body. the body itself will
 	// not be read, but kept around so it can be read later.
-	br := bufio.NewReader(conn)
+	maxBytes, maxFields := s.headerLimits()
+	limit := &headerLimitReader{r: conn, addr: s.addr, limit: maxBytes}
+	br := getReader(limit, s.opts.ReadBufferSize)
+	// The reader may read ahead of the header by a buffer, checked once
+	// the header is read.
+	allowed := maxBytes + br.Size()
+	limit.n = allowed
 	resp, err := http.ReadResponse(br, connectReq)
-	if err != nil {
-		return conn, err
+	if err == nil && allowed-limit.n-br.Buffered() > maxBytes {
+		err = fmt.Errorf("%w: HTTP proxy at %s sent more than %d bytes of header", ErrProtocol, s.addr, maxBytes)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return conn, fmt.Errorf("unable to proxy connection: %v", resp.Status)
+	if err == nil {
+		err = s.checkFields(resp, maxFields)
+	}
+	if err == nil {
+		err = s.checkResponse(resp)
+	}
+	limit.n = -1
+	var respErr *HTTPProxyError
+	if err == nil && resp.StatusCode != http.StatusOK {
+		respErr = &HTTPProxyError{StatusCode: resp.StatusCode, Status: resp.Status, Body: s.drain(resp, br)}
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		putReader(br)
+	}
+	switch {
+	case err != nil:
+		return conn, err
+	case resp.StatusCode == http.StatusProxyAuthRequired && userPass == "":
+		return conn, fmt.Errorf("%w by HTTP proxy at %s: %w", ErrProxyAuthRequired, s.addr, respErr)
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return conn, fmt.Errorf("%w: HTTP proxy at %s: %w", ErrProxyAuthFailed, s.addr, respErr)
+	case resp.StatusCode != http.StatusOK:
+		return conn, fmt.Errorf("%w: unable to proxy connection: %w", ErrTargetRefusedByProxy, respErr)
 	}
 
 	// Return a bufferedConn that wraps a net.Conn and a *bufio.Reader. this
 	// needs to be done because http.ReadResponse will buffer part of the
 	// response body in the *bufio.Reader that was passed in. reads must first
 	// come from anything buffered, then from the underlying connection otherwise
-	// data will be lost.
+	// data will be lost. In the common case nothing is buffered, and conn
+	// itself is returned.
+	if br.Buffered() == 0 {
+		putReader(br)
+		return conn, nil
+	}
 	return &bufferedConn{
 		Conn:   conn,
 		reader: br,
@@ -151,19 +424,32 @@ func (s *httpProxy) connect(conn net.Conn, target string) (net.Conn, error) {
 
 // HTTPProxyDialer returns a Dialer that makes HTTP/HTTPS proxy connections to the given address
 // with an optional username and password.
-func HTTPProxyDialer(network, addr string, auth *Auth, forward Dialer, timeout time.Duration) (Dialer, error) {
+func HTTPProxyDialer(network, addr string, auth *Auth, forward Dialer, timeout time.Duration, opts ...Option) (Dialer, error) {
+	return newHTTPProxy("http", network, addr, auth, forward, timeout, opts), nil
+}
+
+// ------------------------------------------------------------------
+
+func newHTTPProxy(scheme, network, addr string, auth *Auth, forward Dialer, timeout time.Duration, opts []Option) *httpProxy {
 	s := &httpProxy{
-		network: network,
-		addr:    addr,
-		forward: forward,
-		timeout: timeout,
+		base: base{
+			scheme:  scheme,
+			network: network,
+			addr:    addr,
+			forward: forward,
+			timeout: timeout,
+			opts:    newOptions(opts),
+		},
+	}
+	if scheme == "https" {
+		s.initTLS()
 	}
 	if auth != nil {
 		s.user = auth.User
 		s.password = auth.Password
 	}
 
-	return s, nil
+	return s
 }
 
 // ------------------------------------------------------------------
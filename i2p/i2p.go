@@ -0,0 +1,316 @@
+// (c) biter
+
+// Package i2p provides a dialer of I2P destinations through the SAMv3
+// bridge of a local I2P router, and registers it for the "i2p" and "sam"
+// schemes of netproxy.FromURL:
+//
+//	import _ "github.com/biter777/netproxy/i2p"
+//
+//	u, _ := url.Parse("sam://127.0.0.1:7656")
+//	d, err := netproxy.FromURL(u, netproxy.Direct, 30*time.Second)
+//	...
+//	conn, err := d.Dial("tcp", "example.i2p:80")
+//
+// I2P tunnels take seconds to build: the first dial of a dialer, which
+// creates its SAM session, is slow, and the timeout should be generous.
+package i2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func init() {
+	netproxy.RegisterDialerType("i2p", fromURL)
+	netproxy.RegisterDialerType("sam", fromURL)
+}
+
+func fromURL(u *url.URL, forward netproxy.Dialer, timeout time.Duration) (netproxy.Dialer, error) {
+	return New(u.Host, forward, timeout), nil
+}
+
+// Error is a failure reported by the SAM bridge.
+type Error struct {
+	Result  string // e.g. "CANT_REACH_PEER"
+	Message string // optional details
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "SAM error " + e.Result
+	}
+	return "SAM error " + e.Result + ": " + e.Message
+}
+
+// Unwrap returns netproxy.ErrTargetRefusedByProxy for the failures to reach
+// a destination.
+func (e *Error) Unwrap() error {
+	switch e.Result {
+	case "CANT_REACH_PEER", "PEER_NOT_FOUND", "KEY_NOT_FOUND", "TIMEOUT":
+		return netproxy.ErrTargetRefusedByProxy
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// Dialer connects to I2P destinations through a SAMv3 bridge, over a
+// streaming session created by its first dial and kept until Close.
+type Dialer struct {
+	addr    string
+	forward netproxy.Dialer
+	timeout time.Duration
+
+	mu      sync.Mutex
+	session net.Conn // the control connection holding the session
+	id      string
+	version string
+}
+
+// New returns a Dialer using the SAM bridge at addr, e.g.
+// "127.0.0.1:7656", reached through forward (netproxy.Direct if nil), with
+// the timeout of each dial.
+func New(addr string, forward netproxy.Dialer, timeout time.Duration) *Dialer {
+	if forward == nil {
+		forward = netproxy.Direct
+	}
+	return &Dialer{addr: addr, forward: forward, timeout: timeout}
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the I2P destination addr, a host name ending with
+// ".i2p" or a base64 destination, with a port for the SAM bridges
+// supporting them (SAM 3.2).
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the I2P destination addr, see Dial.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("%w %s for I2P connections", netproxy.ErrUnsupportedNetwork, network)
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+
+	id, version, err := d.sessionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := d.hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	dest := host
+	if strings.HasSuffix(host, ".i2p") {
+		if dest, err = lookup(conn, host); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	cmd := "STREAM CONNECT ID=" + id + " DESTINATION=" + dest + " SILENT=false"
+	if port != "" && port != "0" && version >= "3.2" {
+		cmd += " TO_PORT=" + port
+	}
+	if _, err := command(conn, cmd, "STREAM", "STATUS"); err != nil {
+		conn.Close()
+		var samErr *Error
+		if errors.As(err, &samErr) && samErr.Result == "INVALID_ID" {
+			d.closeSession(id) // the bridge lost the session
+		}
+		return nil, fmt.Errorf("i2p: connecting to %s: %w", addr, err)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
+
+// ------------------------------------------------------------------
+
+// String describes the SAM bridge of d, see netproxy.Describe.
+func (d *Dialer) String() string {
+	s := "i2p SAM bridge " + d.addr + " (via " + netproxy.Describe(d.forward)
+	if d.timeout > 0 {
+		s += ", timeout " + d.timeout.String()
+	}
+	return s + ")"
+}
+
+// Close ends the SAM session of d. The next dial creates a new one.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
+
+// closeSession ends the session id, if it is still the session of d.
+func (d *Dialer) closeSession(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil && d.id == id {
+		d.session.Close()
+		d.session = nil
+	}
+}
+
+// ------------------------------------------------------------------
+
+// sessionID returns the ID of the session of d, creating it if needed, and
+// the SAM version of the bridge.
+func (d *Dialer) sessionID(ctx context.Context) (id, version string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session != nil {
+		return d.id, d.version, nil
+	}
+
+	conn, version, err := d.hello(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	id = "netproxy-" + hex.EncodeToString(b)
+	if _, err := command(conn, "SESSION CREATE STYLE=STREAM ID="+id+" DESTINATION=TRANSIENT SIGNATURE_TYPE=7", "SESSION", "STATUS"); err != nil {
+		conn.Close()
+		return "", "", fmt.Errorf("i2p: creating session: %w", err)
+	}
+	if !stop() {
+		conn.Close()
+		return "", "", ctx.Err()
+	}
+	d.session, d.id, d.version = conn, id, version
+	return id, version, nil
+}
+
+// ------------------------------------------------------------------
+
+// hello connects to the SAM bridge and negotiates the version.
+func (d *Dialer) hello(ctx context.Context) (net.Conn, string, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("i2p: %w: %w", netproxy.ErrProxyUnreachable, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	reply, err := command(conn, "HELLO VERSION MIN=3.0 MAX=3.3", "HELLO", "REPLY")
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("i2p: SAM bridge at %s: %w", d.addr, err)
+	}
+	return conn, reply["VERSION"], nil
+}
+
+// ------------------------------------------------------------------
+
+// lookup resolves an I2P host name to its destination.
+func lookup(conn net.Conn, name string) (string, error) {
+	reply, err := command(conn, "NAMING LOOKUP NAME="+name, "NAMING", "REPLY")
+	if err != nil {
+		return "", fmt.Errorf("i2p: looking up %s: %w", name, err)
+	}
+	return reply["VALUE"], nil
+}
+
+// ------------------------------------------------------------------
+
+// command sends a command on conn and reads its reply, which must start
+// with the words topic and typ and have RESULT=OK. It returns the options
+// of the reply.
+func command(conn net.Conn, cmd, topic, typ string) (map[string]string, error) {
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, err
+	}
+	words, opts := parseReply(line)
+	if len(words) < 2 || words[0] != topic || words[1] != typ {
+		return nil, fmt.Errorf("%w: unexpected SAM reply %q", netproxy.ErrProtocol, line)
+	}
+	if opts["RESULT"] != "OK" {
+		return nil, &Error{Result: opts["RESULT"], Message: opts["MESSAGE"]}
+	}
+	return opts, nil
+}
+
+// readLine reads a line of conn a byte at a time, so that the data of a
+// stream following its status stays in conn.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1<<16 {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("%w: SAM reply too long", netproxy.ErrProtocol)
+}
+
+// parseReply splits a SAM reply into its leading words and its KEY=VALUE
+// options, whose values may be double-quoted.
+func parseReply(line string) (words []string, opts map[string]string) {
+	opts = make(map[string]string)
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+		var field string
+		key, rest, ok := strings.Cut(line, "=")
+		if ok && !strings.Contains(key, " ") && strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && (rest[end] != '"' || rest[end-1] == '\\') {
+				end++
+			}
+			value := rest[:min(end+1, len(rest))]
+			if v, err := strconv.Unquote(value); err == nil {
+				opts[key] = v
+			} else {
+				opts[key] = strings.Trim(value, `"`)
+			}
+			line = rest[min(end+1, len(rest)):]
+			continue
+		}
+		field, line, _ = strings.Cut(line, " ")
+		if key, value, ok := strings.Cut(field, "="); ok {
+			opts[key] = value
+		} else {
+			words = append(words, field)
+		}
+	}
+	return words, opts
+}
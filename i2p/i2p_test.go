@@ -0,0 +1,114 @@
+// (c) biter
+
+package i2p
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// fakeSAM is a SAM bridge on a new listener, which the caller closes, with
+// the destination "echo.i2p" echoing the data of its streams. It counts the
+// sessions created.
+func fakeSAM(t *testing.T, sessions *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSAM(c, sessions)
+		}
+	}()
+	return l
+}
+
+func serveSAM(c net.Conn, sessions *atomic.Int32) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		words, opts := parseReply(line)
+		switch strings.Join(words, " ") {
+		case "HELLO VERSION":
+			io.WriteString(c, "HELLO REPLY RESULT=OK VERSION=3.3\n")
+		case "SESSION CREATE":
+			sessions.Add(1)
+			io.WriteString(c, "SESSION STATUS RESULT=OK DESTINATION=privkey\n")
+		case "NAMING LOOKUP":
+			if opts["NAME"] != "echo.i2p" {
+				io.WriteString(c, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME="+opts["NAME"]+"\n")
+				continue
+			}
+			io.WriteString(c, "NAMING REPLY RESULT=OK NAME=echo.i2p VALUE=echodest\n")
+		case "STREAM CONNECT":
+			if opts["DESTINATION"] != "echodest" || opts["TO_PORT"] != "80" || !strings.HasPrefix(opts["ID"], "netproxy-") {
+				io.WriteString(c, `STREAM STATUS RESULT=I2P_ERROR MESSAGE="bad request"`+"\n")
+				return
+			}
+			io.WriteString(c, "STREAM STATUS RESULT=OK\n")
+			io.Copy(c, br)
+			return
+		default:
+			return
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	var sessions atomic.Int32
+	l := fakeSAM(t, &sessions)
+	defer l.Close()
+
+	u, _ := url.Parse("sam://" + l.Addr().String())
+	d, err := netproxy.FromURL(u, netproxy.Direct, 5*time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	defer d.(*Dialer).Close()
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial("tcp", "echo.i2p:80")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Errorf("got %q, %v, want ping", b, err)
+		}
+		c.Close()
+	}
+	if n := sessions.Load(); n != 1 {
+		t.Errorf("got %d sessions, want 1", n)
+	}
+
+	if _, err := d.Dial("tcp", "unknown.i2p:80"); !errors.Is(err, netproxy.ErrTargetRefusedByProxy) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrTargetRefusedByProxy)
+	}
+	if _, err := d.Dial("udp", "echo.i2p:80"); !errors.Is(err, netproxy.ErrUnsupportedNetwork) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrUnsupportedNetwork)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	words, opts := parseReply(`STREAM STATUS RESULT=I2P_ERROR MESSAGE="no \"route\" found" X=1` + "\n")
+	if strings.Join(words, " ") != "STREAM STATUS" || opts["RESULT"] != "I2P_ERROR" || opts["MESSAGE"] != `no "route" found` || opts["X"] != "1" {
+		t.Errorf("got %q, %q", words, opts)
+	}
+}
@@ -0,0 +1,150 @@
+// (c) biter
+
+// Package kcp reaches proxies over KCP, a reliable protocol over UDP with
+// forward error correction that holds up on lossy links where TCP tunnels
+// collapse. It registers the "socks5+kcp" and "http+kcp" schemes of
+// netproxy.FromURL, whose proxy connections are KCP sessions, with the
+// parameters of the URL query, named as in kcptun:
+//
+//	socks5+kcp://proxy.example.com:4000?datashard=10&parityshard=3&sndwnd=1024&rcvwnd=1024
+//
+// The KCP implementation is plugged in with Register, e.g. for kcp-go:
+//
+//	kcp.Register(func(ctx context.Context, addr string, cfg kcp.Config) (net.Conn, error) {
+//		s, err := kcpgo.DialWithOptions(addr, nil, cfg.DataShards, cfg.ParityShards)
+//		if err != nil {
+//			return nil, err
+//		}
+//		s.SetWindowSize(cfg.SendWindow, cfg.ReceiveWindow)
+//		s.SetNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion)
+//		s.SetMtu(cfg.MTU)
+//		return s, nil
+//	})
+//
+// KCP runs over UDP from this host: the sessions cannot go through a forward
+// dialer, and FromURL fails with any other than a direct one
+// (netproxy.IsDirect).
+package kcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// Config holds the parameters of the KCP sessions, see the kcptun
+// documentation for their tuning.
+type Config struct {
+	DataShards, ParityShards  int // FEC: parity shards for data shards; 0 disables it
+	SendWindow, ReceiveWindow int // window sizes, in packets
+	MTU                       int // maximum size of the UDP packets
+	NoDelay                   int // 1 for fast retransmission
+	Interval                  int // internal update interval, in milliseconds
+	Resend                    int // fast resend after that many duplicate ACKs, 0 disables it
+	NoCongestion              int // 1 disables the congestion control
+}
+
+// DefaultConfig is the configuration of the sessions, before the
+// parameters of the URL: the "fast" mode of kcptun.
+var DefaultConfig = Config{
+	DataShards:    10,
+	ParityShards:  3,
+	SendWindow:    128,
+	ReceiveWindow: 512,
+	MTU:           1350,
+	NoDelay:       0,
+	Interval:      30,
+	Resend:        2,
+	NoCongestion:  1,
+}
+
+// DialFunc opens a KCP session to addr, a UDP address, with cfg.
+type DialFunc func(ctx context.Context, addr string, cfg Config) (net.Conn, error)
+
+// ------------------------------------------------------------------
+
+// Register registers the "socks5+kcp" and "http+kcp" schemes, opening the
+// KCP sessions with dial.
+func Register(dial DialFunc) {
+	f := func(u *url.URL, forward netproxy.Dialer, timeout time.Duration) (netproxy.Dialer, error) {
+		if forward != nil && !netproxy.IsDirect(forward) {
+			return nil, fmt.Errorf("kcp: %s proxies cannot be reached through the forward dialer %s", u.Scheme, netproxy.Describe(forward))
+		}
+		return fromURL(u, dial, timeout)
+	}
+	netproxy.RegisterDialerType("socks5+kcp", f)
+	netproxy.RegisterDialerType("http+kcp", f)
+}
+
+// fromURL returns the dialer of a KCP URL.
+func fromURL(u *url.URL, dial DialFunc, timeout time.Duration) (netproxy.Dialer, error) {
+	cfg, err := ParseConfig(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	inner := *u
+	inner.Scheme = strings.TrimSuffix(u.Scheme, "+kcp")
+	inner.RawQuery = ""
+	return netproxy.FromURL(&inner, transport{dial: dial, cfg: cfg}, timeout)
+}
+
+// ------------------------------------------------------------------
+
+// ParseConfig returns DefaultConfig with the parameters of q: datashard,
+// parityshard, sndwnd, rcvwnd, mtu, nodelay, interval, resend and nc.
+func ParseConfig(q url.Values) (Config, error) {
+	cfg := DefaultConfig
+	for name, field := range map[string]*int{
+		"datashard":   &cfg.DataShards,
+		"parityshard": &cfg.ParityShards,
+		"sndwnd":      &cfg.SendWindow,
+		"rcvwnd":      &cfg.ReceiveWindow,
+		"mtu":         &cfg.MTU,
+		"nodelay":     &cfg.NoDelay,
+		"interval":    &cfg.Interval,
+		"resend":      &cfg.Resend,
+		"nc":          &cfg.NoCongestion,
+	} {
+		if !q.Has(name) {
+			continue
+		}
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("kcp: invalid %s %q", name, q.Get(name))
+		}
+		*field = n
+	}
+	if cfg.MTU < 64 || cfg.MTU > 65507 {
+		return Config{}, fmt.Errorf("kcp: invalid mtu %d", cfg.MTU)
+	}
+	if cfg.SendWindow == 0 || cfg.ReceiveWindow == 0 {
+		return Config{}, errors.New("kcp: invalid zero window")
+	}
+	return cfg, nil
+}
+
+// ------------------------------------------------------------------
+
+// transport is the forward dialer opening the KCP sessions to the proxy.
+type transport struct {
+	dial DialFunc
+	cfg  Config
+}
+
+func (t transport) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+func (t transport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("%w %s for KCP proxy connections", netproxy.ErrUnsupportedNetwork, network)
+	}
+	return t.dial(ctx, addr, t.cfg)
+}
@@ -0,0 +1,90 @@
+// (c) biter
+
+package kcp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestRegister(t *testing.T) {
+	// An HTTP proxy echoing the tunneled data, reached over TCP in place
+	// of KCP.
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer gateway.Close()
+	go func() {
+		for {
+			c, err := gateway.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+				io.Copy(c, br)
+			}()
+		}
+	}()
+
+	cfgs := make(chan Config, 1)
+	Register(func(ctx context.Context, addr string, cfg Config) (net.Conn, error) {
+		cfgs <- cfg
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	})
+	u, _ := url.Parse("http+kcp://" + gateway.Addr().String() + "?datashard=0&parityshard=0&sndwnd=1024")
+	d, err := netproxy.FromURL(u, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v, want ping", b, err)
+	}
+
+	want := DefaultConfig
+	want.DataShards, want.ParityShards, want.SendWindow = 0, 0, 1024
+	if got := <-cfgs; got != want {
+		t.Errorf("got config %+v, want %+v", got, want)
+	}
+
+	// KCP cannot go through a forward dialer, only a direct one.
+	jump, _ := netproxy.SOCKS5("tcp", "jump:1080", nil, netproxy.Direct, time.Second)
+	if _, err := netproxy.FromURL(u, jump, time.Second); err == nil {
+		t.Error("FromURL ignored the forward dialer")
+	}
+	local := netproxy.NewDirect(netproxy.WithLocalAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if _, err := netproxy.FromURL(u, local, time.Second); err != nil {
+		t.Errorf("FromURL failed with a direct dialer: %v", err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, q := range []string{"mtu=10", "sndwnd=0", "resend=-1", "datashard=x"} {
+		v, _ := url.ParseQuery(q)
+		if _, err := ParseConfig(v); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded, want an error", q)
+		}
+	}
+}
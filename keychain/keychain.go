@@ -0,0 +1,114 @@
+// (c) biter
+
+// Package keychain reads the credentials of the proxies from the credential
+// store of the platform, keyed by the proxy host, so that applications do
+// not keep proxy passwords in plaintext configuration:
+//
+//	d, err := netproxy.FromURL(u, netproxy.Direct, timeout, netproxy.WithCredentials(keychain.Provider{}))
+//
+// The stores are:
+//
+//   - macOS: the internet passwords of the Keychain whose server is the
+//     proxy host, read with security(1), e.g. added with
+//     "security add-internet-password -s proxy.example.com -a user -w".
+//   - Windows: the generic credentials of the Credential Manager whose
+//     target is the proxy host.
+//   - Linux and BSD: the libsecret items with the attributes "service"
+//     (Provider.Service) and "host", and the user in the attribute "user",
+//     read with secret-tool(1), e.g. added with
+//     "secret-tool store --label=proxy service netproxy host proxy.example.com user alice".
+//     Without secret-tool, no proxy has credentials.
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/biter777/netproxy"
+)
+
+// Provider is a netproxy.CredentialsProvider reading the credentials of
+// the proxies from the credential store of the platform. The dials through
+// a proxy without an entry are unauthenticated.
+type Provider struct {
+	// Service is the "service" attribute of the libsecret items,
+	// "netproxy" if empty. It is not used on macOS and Windows.
+	Service string
+}
+
+var _ netproxy.CredentialsProvider = Provider{}
+
+// errNotFound is returned by lookup for a host without an entry.
+var errNotFound = errors.New("keychain: no credentials")
+
+// GetCredentials returns the credentials of the host of proxyAddr.
+func (p Provider) GetCredentials(ctx context.Context, proxyAddr string) (netproxy.Auth, error) {
+	host, _, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		host = proxyAddr
+	}
+	service := p.Service
+	if service == "" {
+		service = "netproxy"
+	}
+	auth, err := lookup(ctx, service, host)
+	if errors.Is(err, errNotFound) {
+		return netproxy.Auth{}, nil
+	}
+	return auth, err
+}
+
+// ------------------------------------------------------------------
+
+// run runs a command and returns its standard output; a variable for the
+// tests.
+var run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+// exitCode returns the exit status of a failed command, or -1.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// parseSecurity returns the account of the output of "security
+// find-internet-password", with lines such as:
+//
+//	"acct"<blob>="user"
+func parseSecurity(out []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		v, ok := strings.CutPrefix(strings.TrimSpace(s.Text()), `"acct"<blob>=`)
+		if !ok {
+			continue
+		}
+		if user, err := strconv.Unquote(v); err == nil {
+			return user
+		}
+	}
+	return ""
+}
+
+// parseSecretTool returns the user of the output of "secret-tool search",
+// with lines such as:
+//
+//	attribute.user = user
+func parseSecretTool(out []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if user, ok := strings.CutPrefix(s.Text(), "attribute.user = "); ok {
+			return user
+		}
+	}
+	return ""
+}
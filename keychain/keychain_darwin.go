@@ -0,0 +1,32 @@
+// (c) biter
+
+//go:build darwin
+
+package keychain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/biter777/netproxy"
+)
+
+// lookup returns the credentials of the internet password of host in the
+// Keychain.
+func lookup(ctx context.Context, service, host string) (netproxy.Auth, error) {
+	out, err := run(ctx, "security", "find-internet-password", "-s", host)
+	if exitCode(err) == 44 { // errSecItemNotFound
+		return netproxy.Auth{}, errNotFound
+	}
+	if err != nil {
+		return netproxy.Auth{}, fmt.Errorf("keychain: %s: %w", host, err)
+	}
+	auth := netproxy.Auth{User: parseSecurity(out)}
+	out, err = run(ctx, "security", "find-internet-password", "-s", host, "-a", auth.User, "-w")
+	if err != nil {
+		return netproxy.Auth{}, fmt.Errorf("keychain: %s: %w", host, err)
+	}
+	auth.Password = strings.TrimSuffix(string(out), "\n")
+	return auth, nil
+}
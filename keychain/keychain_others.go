@@ -0,0 +1,18 @@
+// (c) biter
+
+//go:build !darwin && !windows && !linux && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package keychain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/biter777/netproxy"
+)
+
+func lookup(ctx context.Context, service, host string) (netproxy.Auth, error) {
+	return netproxy.Auth{}, fmt.Errorf("keychain: %w on %s", errors.ErrUnsupported, runtime.GOOS)
+}
@@ -0,0 +1,33 @@
+// (c) biter
+
+//go:build linux || freebsd || netbsd || openbsd || dragonfly
+
+package keychain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/biter777/netproxy"
+)
+
+// lookup returns the credentials of the libsecret item of service and host.
+// Without secret-tool, there are none.
+func lookup(ctx context.Context, service, host string) (netproxy.Auth, error) {
+	out, err := run(ctx, "secret-tool", "lookup", "service", service, "host", host)
+	if exitCode(err) == 1 && len(out) == 0 || errors.Is(err, exec.ErrNotFound) {
+		return netproxy.Auth{}, errNotFound
+	}
+	if err != nil {
+		return netproxy.Auth{}, fmt.Errorf("keychain: %s: %w", host, err)
+	}
+	auth := netproxy.Auth{Password: string(out)}
+	out, err = run(ctx, "secret-tool", "search", "service", service, "host", host)
+	if err != nil {
+		return netproxy.Auth{}, fmt.Errorf("keychain: %s: %w", host, err)
+	}
+	auth.User = parseSecretTool(out)
+	return auth, nil
+}
@@ -0,0 +1,74 @@
+// (c) biter
+
+package keychain
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestParse(t *testing.T) {
+	security := `keychain: "/Users/me/Library/Keychains/login.keychain-db"
+version: 512
+class: "inet"
+attributes:
+    "acct"<blob>="alice"
+    "ptcl"<uint32>="htpx"
+    "srvr"<blob>="proxy.example.com"
+`
+	if got := parseSecurity([]byte(security)); got != "alice" {
+		t.Errorf("parseSecurity = %q, want alice", got)
+	}
+	secretTool := `[/org/freedesktop/secrets/collection/login/1]
+label = proxy
+secret = secret
+attribute.host = proxy.example.com
+attribute.service = netproxy
+attribute.user = alice
+`
+	if got := parseSecretTool([]byte(secretTool)); got != "alice" {
+		t.Errorf("parseSecretTool = %q, want alice", got)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("secret-tool is used on Linux only")
+	}
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { run = f }(run)
+	run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name != "secret-tool" || !slices.Equal(args[1:], []string{"service", "netproxy", "host", "proxy.example.com"}) {
+			// secret-tool exits with 1 for an unknown item.
+			return nil, exec.Command("false").Run()
+		}
+		if args[0] == "lookup" {
+			return []byte("p@ss/word"), nil
+		}
+		return []byte("attribute.user = alice\n"), nil
+	}
+
+	auth, err := Provider{}.GetCredentials(context.Background(), "proxy.example.com:1080")
+	if err != nil {
+		t.Fatalf("GetCredentials failed: %v", err)
+	}
+	if want := (netproxy.Auth{User: "alice", Password: "p@ss/word"}); auth != want {
+		t.Errorf("got %+v, want %+v", auth, want)
+	}
+	auth, err = Provider{}.GetCredentials(context.Background(), "other.example.com:1080")
+	if err != nil || auth != (netproxy.Auth{}) {
+		t.Errorf("got %+v, %v, want no credentials", auth, err)
+	}
+
+	run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		return nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	auth, err = Provider{}.GetCredentials(context.Background(), "proxy.example.com:1080")
+	if err != nil || auth != (netproxy.Auth{}) {
+		t.Errorf("got %+v, %v without secret-tool, want no credentials", auth, err)
+	}
+}
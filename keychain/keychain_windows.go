@@ -0,0 +1,81 @@
+// (c) biter
+
+//go:build windows
+
+package keychain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/biter777/netproxy"
+)
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric = 1
+	errorNotFound   = syscall.Errno(1168) // ERROR_NOT_FOUND
+)
+
+// credential is CREDENTIALW of <wincred.h>.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// lookup returns the credentials of the generic credential of host in the
+// Credential Manager.
+func lookup(ctx context.Context, service, host string) (netproxy.Auth, error) {
+	target, err := syscall.UTF16PtrFromString(host)
+	if err != nil {
+		return netproxy.Auth{}, err
+	}
+	var cred *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if errors.Is(err, errorNotFound) {
+			return netproxy.Auth{}, errNotFound
+		}
+		return netproxy.Auth{}, fmt.Errorf("keychain: %s: %w", host, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	auth := netproxy.Auth{User: utf16PtrToString(cred.UserName)}
+	// The passwords stored by the Credential Manager are UTF-16.
+	if n := cred.CredentialBlobSize / 2; n > 0 {
+		blob := unsafe.Slice((*uint16)(unsafe.Pointer(cred.CredentialBlob)), n)
+		auth.Password = string(utf16.Decode(blob))
+	}
+	return auth, nil
+}
+
+// utf16PtrToString returns the string of the NUL-terminated UTF-16 p.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; n++ {
+		ptr = unsafe.Add(ptr, 2)
+	}
+	return string(utf16.Decode(unsafe.Slice(p, n)))
+}
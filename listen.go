@@ -0,0 +1,170 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Binder is implemented by the dialers that can accept incoming connections
+// through their proxy, such as the SOCKS5 dialers (BIND command).
+type Binder interface {
+	// Listen asks the proxy to accept a connection from addr, the
+	// expected peer, on its side.
+	Listen(ctx context.Context, network, addr string) (net.Listener, error)
+}
+
+// ------------------------------------------------------------------
+
+// Listen returns a listener whose connections arrive through the proxy of
+// d, for callback-style protocols (FTP active mode, ...), if d implements
+// Binder. addr is the expected peer, or "0.0.0.0:0" if it is not known; the
+// address to give the peer is the Addr of the listener.
+func Listen(ctx context.Context, d Dialer, network, addr string) (net.Listener, error) {
+	b, ok := d.(Binder)
+	if !ok {
+		return nil, fmt.Errorf("proxy: listening through %T: %w", d, errors.ErrUnsupported)
+	}
+	return b.Listen(ctx, network, addr)
+}
+
+// ------------------------------------------------------------------
+
+// Listen asks the SOCKS5 proxy to accept one connection from addr (BIND
+// command, RFC 1928). The listener accepts a single connection; later calls
+// to Accept block until it is closed.
+func (s *socks5) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, s.opError("listen", network, addr, fmt.Errorf("%w %s for SOCKS5 listeners", ErrUnsupportedNetwork, network))
+	}
+
+	var bound string
+	auth, err := s.credentials(ctx)
+	if err != nil {
+		return nil, s.opError("listen", network, addr, err)
+	}
+	conn, err := s.dial(ctx, network, addr, func(conn net.Conn, target string) (net.Conn, error) {
+		return conn, s.request(conn, socks5Bind, target, auth, &bound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The peer may connect long after the dial timeout.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, s.opError("listen", network, addr, err)
+	}
+
+	// A proxy listening on all its addresses is reached at the one the
+	// client connected to.
+	ba := replyAddr(bound)
+	if tcp, ok := ba.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		if proxy, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			tcp.IP = proxy.IP
+		}
+	}
+	return &socks5Listener{s: s, network: network, conn: conn, addr: ba, closed: make(chan struct{})}, nil
+}
+
+// ------------------------------------------------------------------
+
+// socks5Listener is the net.Listener of a SOCKS5 BIND.
+type socks5Listener struct {
+	s       *socks5
+	network string
+	conn    net.Conn
+	addr    net.Addr
+
+	acceptOnce sync.Once
+	closeOnce  sync.Once
+	closed     chan struct{}
+
+	mu       sync.Mutex
+	accepted bool
+}
+
+func (l *socks5Listener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	err := net.ErrClosed
+	first := false
+	l.acceptOnce.Do(func() {
+		first = true
+		var peer string
+		err = l.s.readReply(l.conn, &peer)
+		if err != nil {
+			l.conn.Close()
+			select {
+			case <-l.closed:
+				err = net.ErrClosed
+			default:
+				err = l.s.opError("accept", l.network, l.addr.String(), err)
+			}
+			return
+		}
+		l.mu.Lock()
+		l.accepted = true
+		l.mu.Unlock()
+		conn = &bindConn{Conn: l.conn, remote: replyAddr(peer)}
+	})
+	if first {
+		return conn, err
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *socks5Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.accepted {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+func (l *socks5Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// ------------------------------------------------------------------
+
+// bindConn is a connection accepted through a proxy, from remote.
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *bindConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *bindConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *bindConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(c.Conn) }
+
+// ------------------------------------------------------------------
+
+// replyAddr returns the address of a proxy reply, "host:port".
+func replyAddr(addr string) net.Addr {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return net.TCPAddrFromAddrPort(ap)
+	}
+	return hostAddr(addr)
+}
+
+// hostAddr is a TCP address with a host name.
+type hostAddr string
+
+func (a hostAddr) Network() string { return "tcp" }
+func (a hostAddr) String() string  { return string(a) }
@@ -0,0 +1,26 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"log/slog"
+)
+
+// log writes a record to the configured Logger, if any.
+func (o *Options) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if o.Logger == nil || !o.Logger.Enabled(ctx, level) {
+		return
+	}
+	o.Logger.Log(ctx, level, msg, args...)
+}
+
+// ------------------------------------------------------------------
+
+// log writes a record about the dialer b to the configured Logger.
+func (b *base) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if b.opts.Logger == nil {
+		return
+	}
+	b.opts.log(ctx, level, msg, append([]any{"scheme", b.scheme, "proxy", b.addr}, args...)...)
+}
@@ -0,0 +1,189 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Metrics receives statistics about the dials made through a proxy and the
+// connections they return. proxy is the address of the proxy server and
+// scheme its URL scheme. Implementations must be safe for concurrent use;
+// see the metrics subpackage for a Prometheus collector.
+type Metrics interface {
+	// DialStarted is called when a dial through the proxy begins.
+	DialStarted(scheme, proxy string)
+	// DialFailed is called when connecting to the proxy or the proxy
+	// handshake fails.
+	DialFailed(scheme, proxy string, err error)
+	// DialSucceeded is called once the proxy handshake is done, with the
+	// time the handshake took.
+	DialSucceeded(scheme, proxy string, handshake time.Duration)
+	// BytesTransferred is called for each read from and write to a
+	// connection returned by a successful dial.
+	BytesTransferred(scheme, proxy string, read, written int)
+	// ConnClosed is called once when such a connection is closed.
+	ConnClosed(scheme, proxy string)
+}
+
+// ------------------------------------------------------------------
+
+// ErrorClass returns a short class for a dial error, suitable as a metric
+// label: "timeout", "canceled", "auth" for ErrProxyAuthRequired and
+// ErrProxyAuthFailed, "target" for ErrTargetRefusedByProxy, "dns",
+// "refused", "network" or "proxy" for other errors reported by the proxy
+// handshake. It returns "" for a nil error.
+func ErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, ErrProxyAuthRequired), errors.Is(err, ErrProxyAuthFailed):
+		return "auth"
+	case errors.Is(err, ErrTargetRefusedByProxy):
+		return "target"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &opErr):
+		return "network"
+	}
+	return "proxy"
+}
+
+// ------------------------------------------------------------------
+
+// multiMetrics fans the statistics out to several Metrics.
+type multiMetrics []Metrics
+
+func (mm multiMetrics) DialStarted(scheme, proxy string) {
+	for _, m := range mm {
+		m.DialStarted(scheme, proxy)
+	}
+}
+
+func (mm multiMetrics) DialFailed(scheme, proxy string, err error) {
+	for _, m := range mm {
+		m.DialFailed(scheme, proxy, err)
+	}
+}
+
+func (mm multiMetrics) DialSucceeded(scheme, proxy string, handshake time.Duration) {
+	for _, m := range mm {
+		m.DialSucceeded(scheme, proxy, handshake)
+	}
+}
+
+func (mm multiMetrics) BytesTransferred(scheme, proxy string, read, written int) {
+	for _, m := range mm {
+		m.BytesTransferred(scheme, proxy, read, written)
+	}
+}
+
+func (mm multiMetrics) ConnClosed(scheme, proxy string) {
+	for _, m := range mm {
+		m.ConnClosed(scheme, proxy)
+	}
+}
+
+// joinMetrics returns a Metrics reporting to both a and b, either of which
+// may be nil.
+func joinMetrics(a, b Metrics) Metrics {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	mm, _ := a.(multiMetrics)
+	if mm == nil {
+		mm = multiMetrics{a}
+	}
+	return append(mm[:len(mm):len(mm)], b)
+}
+
+// ------------------------------------------------------------------
+
+// meteredConn reports the traffic of a proxied connection to Metrics.
+type meteredConn struct {
+	net.Conn
+	metrics       Metrics
+	scheme, proxy string
+	closeOnce     sync.Once
+}
+
+func newMeteredConn(conn net.Conn, m Metrics, scheme, proxy string) *meteredConn {
+	return &meteredConn{
+		Conn:    conn,
+		metrics: m,
+		scheme:  scheme,
+		proxy:   proxy,
+	}
+}
+
+// ------------------------------------------------------------------
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.BytesTransferred(c.scheme, c.proxy, n, 0)
+	}
+	return n, err
+}
+
+// ------------------------------------------------------------------
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.BytesTransferred(c.scheme, c.proxy, 0, n)
+	}
+	return n, err
+}
+
+// ------------------------------------------------------------------
+
+func (c *meteredConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.metrics.ConnClosed(c.scheme, c.proxy)
+	})
+	return err
+}
+
+func (c *meteredConn) CloseWrite() error { return closeWrite(c.Conn) }
+func (c *meteredConn) CloseRead() error  { return closeRead(c.Conn) }
+
+func (c *meteredConn) SyscallConn() (syscall.RawConn, error) { return syscallConn(c.Conn) }
+
+// ------------------------------------------------------------------
+
+func (c *meteredConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := readFrom(c.Conn, r)
+	if n > 0 {
+		c.metrics.BytesTransferred(c.scheme, c.proxy, 0, int(n))
+	}
+	return n, err
+}
+
+// ------------------------------------------------------------------
+
+func (c *meteredConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := writeTo(c.Conn, w)
+	if n > 0 {
+		c.metrics.BytesTransferred(c.scheme, c.proxy, int(n), 0)
+	}
+	return n, err
+}
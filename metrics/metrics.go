@@ -0,0 +1,129 @@
+// (c) biter
+
+// Package metrics exports the statistics of netproxy dialers to Prometheus.
+//
+//	c := metrics.New("myapp")
+//	prometheus.MustRegister(c)
+//	d, err := netproxy.FromURL(u, netproxy.Direct, timeout, netproxy.WithMetrics(c))
+package metrics
+
+import (
+	"time"
+
+	"github.com/biter777/netproxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector implementing netproxy.Metrics. All of
+// its metrics are labeled by proxy address and scheme.
+type Collector struct {
+	attempts  *prometheus.CounterVec
+	successes *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	handshake *prometheus.HistogramVec
+	open      *prometheus.GaugeVec
+	bytes     *prometheus.CounterVec
+}
+
+var _ netproxy.Metrics = (*Collector)(nil)
+
+// New returns a Collector whose metric names are prefixed by namespace
+// (which may be empty) and "netproxy".
+func New(namespace string) *Collector {
+	labels := []string{"proxy", "scheme"}
+	return &Collector{
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "dial_attempts_total",
+			Help:      "Dials started through the proxy.",
+		}, labels),
+		successes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "dial_successes_total",
+			Help:      "Dials through the proxy that completed the handshake.",
+		}, labels),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "dial_failures_total",
+			Help:      "Dials through the proxy that failed, by netproxy.ErrorClass.",
+		}, append(labels, "class")),
+		handshake: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "handshake_duration_seconds",
+			Help:      "Duration of successful proxy handshakes.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, labels),
+		open: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "open_connections",
+			Help:      "Proxied connections currently open.",
+		}, labels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "netproxy",
+			Name:      "bytes_total",
+			Help:      "Bytes transferred over proxied connections, by direction.",
+		}, append(labels, "direction")),
+	}
+}
+
+// ------------------------------------------------------------------
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.attempts.Describe(ch)
+	c.successes.Describe(ch)
+	c.failures.Describe(ch)
+	c.handshake.Describe(ch)
+	c.open.Describe(ch)
+	c.bytes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.attempts.Collect(ch)
+	c.successes.Collect(ch)
+	c.failures.Collect(ch)
+	c.handshake.Collect(ch)
+	c.open.Collect(ch)
+	c.bytes.Collect(ch)
+}
+
+// ------------------------------------------------------------------
+
+// DialStarted implements netproxy.Metrics.
+func (c *Collector) DialStarted(scheme, proxy string) {
+	c.attempts.WithLabelValues(proxy, scheme).Inc()
+}
+
+// DialFailed implements netproxy.Metrics.
+func (c *Collector) DialFailed(scheme, proxy string, err error) {
+	c.failures.WithLabelValues(proxy, scheme, netproxy.ErrorClass(err)).Inc()
+}
+
+// DialSucceeded implements netproxy.Metrics.
+func (c *Collector) DialSucceeded(scheme, proxy string, handshake time.Duration) {
+	c.successes.WithLabelValues(proxy, scheme).Inc()
+	c.handshake.WithLabelValues(proxy, scheme).Observe(handshake.Seconds())
+	c.open.WithLabelValues(proxy, scheme).Inc()
+}
+
+// BytesTransferred implements netproxy.Metrics.
+func (c *Collector) BytesTransferred(scheme, proxy string, read, written int) {
+	if read > 0 {
+		c.bytes.WithLabelValues(proxy, scheme, "read").Add(float64(read))
+	}
+	if written > 0 {
+		c.bytes.WithLabelValues(proxy, scheme, "written").Add(float64(written))
+	}
+}
+
+// ConnClosed implements netproxy.Metrics.
+func (c *Collector) ConnClosed(scheme, proxy string) {
+	c.open.WithLabelValues(proxy, scheme).Dec()
+}
@@ -0,0 +1,315 @@
+// (c) biter
+
+// Package mux multiplexes the dials of a netproxy.Dialer over a single
+// connection to a cooperating endpoint, so that chatty workloads pay the
+// proxy handshake once instead of per connection. The multiplexing itself
+// is done by a library such as yamux or smux, plugged in as a Session:
+//
+//	d := mux.NewDialer(proxy, "relay.example.com:7000", func(c net.Conn) (mux.Session, error) {
+//		return yamux.Client(c, nil)
+//	})
+//	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+//
+// and on the endpoint:
+//
+//	mux.Serve(l, func(c net.Conn) (mux.ServerSession, error) {
+//		return yamux.Server(c, nil)
+//	}, netproxy.Direct)
+//
+// Each stream starts with the target address, to which the endpoint
+// connects before relaying the stream.
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// Session is the client side of a multiplexed session over a connection,
+// as *yamux.Session.
+type Session interface {
+	// Open opens a new stream.
+	Open() (net.Conn, error)
+	// Close closes the session and its streams.
+	Close() error
+	// IsClosed reports whether the session is closed.
+	IsClosed() bool
+}
+
+// ServerSession is the endpoint side of a multiplexed session, as
+// *yamux.Session.
+type ServerSession interface {
+	// Accept waits for the next stream opened by the client.
+	Accept() (net.Conn, error)
+	// Close closes the session and its streams.
+	Close() error
+}
+
+// ErrRefused is returned when the endpoint fails to connect to the target
+// of a stream.
+var ErrRefused = errors.New("mux: target refused by endpoint")
+
+// handshakeTimeout bounds the time the endpoint waits for the header of a
+// stream and for the connection to its target.
+const handshakeTimeout = 30 * time.Second
+
+// ------------------------------------------------------------------
+
+// Dialer is a netproxy.Dialer opening a stream of a session for each dial.
+// The session is established on the first dial, over a connection to the
+// endpoint made with the underlying dialer, and again once it is closed.
+type Dialer struct {
+	d       netproxy.Dialer
+	addr    string
+	session func(net.Conn) (Session, error)
+
+	mu      sync.Mutex
+	sess    Session
+	dialing *sessionCall // the establishment in progress, if any
+}
+
+// sessionCall is an establishment of the session, shared by the dials
+// waiting for it.
+type sessionCall struct {
+	done chan struct{}
+	sess Session
+	err  error
+}
+
+// NewDialer returns a Dialer multiplexing its dials over a connection to
+// the endpoint at addr, made with d and turned into a session by session.
+func NewDialer(d netproxy.Dialer, addr string, session func(net.Conn) (Session, error)) *Dialer {
+	return &Dialer{d: d, addr: addr, session: session}
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr through the endpoint.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr through the endpoint.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w %s for multiplexed connections", netproxy.ErrUnsupportedNetwork, network)
+	}
+	if len(addr) > 0xffff {
+		return nil, errors.New("mux: target address too long")
+	}
+	sess, err := d.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, fmt.Errorf("mux: opening stream: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { stream.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	header := binary.BigEndian.AppendUint16(nil, uint16(len(addr)))
+	if _, err := stream.Write(append(header, addr...)); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("mux: writing stream header: %w", err)
+	}
+	if err := readStatus(stream); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("mux: connecting to %s: %w", addr, err)
+	}
+	if !stop() {
+		stream.Close()
+		return nil, ctx.Err()
+	}
+	return stream, nil
+}
+
+// ------------------------------------------------------------------
+
+// String describes the endpoint of d, see netproxy.Describe.
+func (d *Dialer) String() string {
+	return "mux " + d.addr + " (via " + netproxy.Describe(d.d) + ")"
+}
+
+// Close closes the session of d and its streams.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sess == nil {
+		return nil
+	}
+	err := d.sess.Close()
+	d.sess = nil
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// getSession returns the session of d, establishing it if needed. A single
+// establishment runs at a time, out of the lock; the other dials wait for it
+// until their ctx is done, and try again if it failed on the context of its
+// caller.
+func (d *Dialer) getSession(ctx context.Context) (Session, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		if d.sess != nil && !d.sess.IsClosed() {
+			sess := d.sess
+			d.mu.Unlock()
+			return sess, nil
+		}
+		call := d.dialing
+		if call == nil {
+			call = &sessionCall{done: make(chan struct{})}
+			d.dialing = call
+			d.mu.Unlock()
+			call.sess, call.err = d.newSession(ctx)
+			d.mu.Lock()
+			d.dialing = nil
+			if call.err == nil {
+				d.sess = call.sess
+			}
+			d.mu.Unlock()
+			close(call.done)
+			return call.sess, call.err
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-call.done:
+			if call.err == nil {
+				return call.sess, nil
+			}
+			if !errors.Is(call.err, context.Canceled) && !errors.Is(call.err, context.DeadlineExceeded) {
+				return nil, call.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// newSession establishes a session with the endpoint.
+func (d *Dialer) newSession(ctx context.Context) (Session, error) {
+	conn, err := d.d.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	// The session outlives the dial: the dialer may have set a deadline.
+	conn.SetDeadline(time.Time{})
+	sess, err := d.session(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mux: establishing session: %w", err)
+	}
+	return sess, nil
+}
+
+// ------------------------------------------------------------------
+
+// Serve accepts connections on l, serves the streams of their sessions,
+// made by session, by connecting to their targets with d and relaying
+// them, until l fails. It returns the error of l.
+func Serve(l net.Listener, session func(net.Conn) (ServerSession, error), d netproxy.Dialer) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			sess, err := session(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			defer sess.Close()
+			for {
+				stream, err := sess.Accept()
+				if err != nil {
+					return
+				}
+				go serveStream(stream, d)
+			}
+		}()
+	}
+}
+
+// serveStream connects a stream to its target.
+func serveStream(stream net.Conn, d netproxy.Dialer) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	var n [2]byte
+	if _, err := io.ReadFull(stream, n[:]); err != nil {
+		return
+	}
+	addr := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(stream, addr); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	target, err := d.DialContext(ctx, "tcp", string(addr))
+	cancel()
+	if err != nil {
+		msg := err.Error()
+		if len(msg) > 0xff {
+			msg = msg[:0xff]
+		}
+		stream.Write(append([]byte{1, byte(len(msg))}, msg...))
+		return
+	}
+	defer target.Close()
+	if _, err := stream.Write([]byte{0}); err != nil {
+		return
+	}
+	stream.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, stream)
+		if c, ok := target.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(stream, target)
+	stream.Close()
+	<-done
+}
+
+// ------------------------------------------------------------------
+
+// readStatus reads the status of a stream sent by the endpoint: 0, or 1
+// followed by the length and text of the error.
+func readStatus(stream net.Conn) error {
+	var b [2]byte
+	if _, err := io.ReadFull(stream, b[:1]); err != nil {
+		return err
+	}
+	if b[0] == 0 {
+		return nil
+	}
+	if b[0] != 1 {
+		return fmt.Errorf("%w: unknown stream status %d", netproxy.ErrProtocol, b[0])
+	}
+	if _, err := io.ReadFull(stream, b[1:]); err != nil {
+		return err
+	}
+	msg := make([]byte, b[1])
+	if _, err := io.ReadFull(stream, msg); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrRefused, msg)
+}
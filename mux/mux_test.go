@@ -0,0 +1,223 @@
+// (c) biter
+
+package mux
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// pipeMux is a toy multiplexer for the tests: the client sends the ID of
+// its session on the connection, and the streams are pipes passed to the
+// server session with that ID.
+type pipeMux struct {
+	mu       sync.Mutex
+	next     int
+	sessions map[string]chan net.Conn
+}
+
+func (m *pipeMux) streams(id string) chan net.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		m.sessions = make(map[string]chan net.Conn)
+	}
+	if m.sessions[id] == nil {
+		m.sessions[id] = make(chan net.Conn, 16)
+	}
+	return m.sessions[id]
+}
+
+func (m *pipeMux) client(conn net.Conn) (Session, error) {
+	m.mu.Lock()
+	m.next++
+	id := fmt.Sprint(m.next)
+	m.mu.Unlock()
+	if _, err := io.WriteString(conn, id+"\n"); err != nil {
+		return nil, err
+	}
+	return &pipeClient{conn: conn, streams: m.streams(id)}, nil
+}
+
+func (m *pipeMux) server(conn net.Conn) (ServerSession, error) {
+	id, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	s := &pipeServer{conn: conn, streams: m.streams(id[:len(id)-1]), closed: make(chan struct{})}
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(s.closed)
+	}()
+	return s, nil
+}
+
+type pipeClient struct {
+	conn    net.Conn
+	streams chan net.Conn
+	closed  atomic.Bool
+}
+
+func (c *pipeClient) Open() (net.Conn, error) {
+	a, b := net.Pipe()
+	c.streams <- b
+	return a, nil
+}
+
+func (c *pipeClient) Close() error {
+	c.closed.Store(true)
+	return c.conn.Close()
+}
+
+func (c *pipeClient) IsClosed() bool { return c.closed.Load() }
+
+type pipeServer struct {
+	conn    net.Conn
+	streams chan net.Conn
+	closed  chan struct{}
+}
+
+func (s *pipeServer) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.streams:
+		return c, nil
+	case <-s.closed:
+		return nil, io.EOF
+	}
+}
+
+func (s *pipeServer) Close() error { return s.conn.Close() }
+
+// countingDialer counts the dials of a dialer.
+type countingDialer struct {
+	netproxy.Dialer
+	dials atomic.Int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+// stallDialer fails its dials once release is closed.
+type stallDialer struct {
+	netproxy.Dialer
+	release chan struct{}
+	dials   atomic.Int32
+}
+
+func (d *stallDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	<-d.release
+	return nil, errUnreachable
+}
+
+var errUnreachable = errors.New("unreachable")
+
+func TestDialerStalledSession(t *testing.T) {
+	forward := &stallDialer{Dialer: netproxy.Direct, release: make(chan struct{})}
+	d := NewDialer(forward, "relay.example:7000", new(pipeMux).client)
+	first := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "example.com:80")
+		first <- err
+	}()
+	for forward.dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A stalled establishment does not hold the dials with a done context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The waiters share the establishment and its failure.
+	second := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "example.com:80")
+		second <- err
+	}()
+	close(forward.release)
+	if err1, err2 := <-first, <-second; !errors.Is(err1, errUnreachable) || !errors.Is(err2, errUnreachable) {
+		t.Errorf("got %v and %v, want %v", err1, err2, errUnreachable)
+	}
+	if n := forward.dials.Load(); n > 2 {
+		t.Errorf("got %d connections to the endpoint, want at most 2", n)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	endpoint, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer endpoint.Close()
+	m := new(pipeMux)
+	go Serve(endpoint, m.server, netproxy.Direct)
+
+	forward := &countingDialer{Dialer: netproxy.Direct}
+	d := NewDialer(forward, endpoint.Addr().String(), m.client)
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial("tcp", target.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Errorf("got %q, %v, want ping", b, err)
+		}
+		c.Close()
+	}
+	if n := forward.dials.Load(); n != 1 {
+		t.Errorf("got %d connections to the endpoint, want 1", n)
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	if _, err := d.Dial("tcp", closed.Addr().String()); !errors.Is(err, ErrRefused) {
+		t.Errorf("got %v, want %v", err, ErrRefused)
+	}
+
+	// A closed session is established again.
+	d.Close()
+	c, err := d.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Close()
+	if n := forward.dials.Load(); n != 2 {
+		t.Errorf("got %d connections to the endpoint, want 2", n)
+	}
+}
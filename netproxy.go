@@ -9,11 +9,15 @@ package netproxy
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,16 +35,33 @@ type Auth struct {
 }
 
 // FromEnvironment returns the dialer specified by the proxy related variables in
-// the environment.
-func FromEnvironment() Dialer {
+// the environment. ALL_PROXY may omit the scheme, see ParseProxy. The
+// options are applied to the proxy dialer and to the direct connections. If ALL_PROXY is unusable, it dials directly, unless in
+// strict DNS mode (see WithStrictDNS).
+func FromEnvironment(opts ...Option) Dialer {
+	d, _ := FromEnvironmentCloser(opts...)
+	return d
+}
+
+// FromEnvironmentCloser is FromEnvironment, also returning the closer of
+// the resources held by the proxy dialer, such as the shared connection of
+// a "socks5+quic" proxy, to be closed once the dialer is no longer used.
+// See CloseDialer.
+func FromEnvironmentCloser(opts ...Option) (Dialer, io.Closer) {
+	direct := NewDirect(opts...)
 	allProxy := allProxyEnv.Get()
 	if len(allProxy) == 0 {
-		return Direct
+		return direct, dialerCloser{}
 	}
 
-	proxyURL, err := url.Parse(allProxy)
+	o := newOptions(opts)
+	proxyURL, err := ParseProxy(allProxy, opts...)
 	if err != nil {
-		return Direct
+		if o.StrictDNS {
+			return errDialer{fmt.Errorf("%w: invalid ALL_PROXY: %w", ErrDNSLeak, err)}, dialerCloser{}
+		}
+		o.log(context.Background(), slog.LevelWarn, "netproxy: invalid ALL_PROXY, dialing directly", "error", err)
+		return direct, dialerCloser{}
 	}
 
 	timeoutString := timeoutEnv.Get()
@@ -49,42 +70,179 @@ func FromEnvironment() Dialer {
 	}
 	timeout, err := strconv.Atoi(timeoutString)
 	if err != nil {
+		o.log(context.Background(), slog.LevelWarn, "netproxy: invalid TIMEOUT, using 1000ms", "error", err)
 		timeout = 1000
 	}
 
-	proxy, err := FromURL(proxyURL, Direct, time.Millisecond*time.Duration(timeout))
+	proxy, err := FromURL(proxyURL, Direct, time.Millisecond*time.Duration(timeout), opts...)
 	if err != nil {
-		return Direct
+		if o.StrictDNS {
+			return errDialer{fmt.Errorf("%w: unusable ALL_PROXY: %w", ErrDNSLeak, err)}, dialerCloser{}
+		}
+		o.log(context.Background(), slog.LevelWarn, "netproxy: unusable ALL_PROXY, dialing directly", "error", err)
+		return direct, dialerCloser{}
 	}
 
 	noProxy := noProxyEnv.Get()
 	if len(noProxy) == 0 {
-		return proxy
+		return proxy, dialerCloser{proxy}
 	}
 
-	perHost := NewPerHost(proxy, Direct)
+	perHost := NewPerHost(proxy, direct)
 	perHost.AddFromString(noProxy)
-	return perHost
+	return perHost, dialerCloser{proxy}
+}
+
+// CloseDialer closes d if it implements io.Closer, as do the dialers
+// holding resources beyond their dials, such as a ProxyPool or the dialers
+// of the schemes sharing a connection between the dials, and returns nil
+// otherwise. A closed dialer is still usable: its next dials make the
+// shared connections again, while the tunnels open over the closed ones
+// are closed.
+func CloseDialer(d Dialer) error {
+	if c, ok := d.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// dialerCloser is the io.Closer closing its dialer with CloseDialer.
+type dialerCloser struct {
+	d Dialer
+}
+
+func (c dialerCloser) Close() error {
+	if c.d == nil {
+		return nil
+	}
+	return CloseDialer(c.d)
+}
+
+// errDialer is a Dialer failing every dial with err.
+type errDialer struct {
+	err error
+}
+
+func (d errDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, d.err
+}
+
+func (d errDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, d.err
 }
 
 // proxySchemes is a map from URL schemes to a function that creates a Dialer
-// from a URL with such a scheme.
-var proxySchemes map[string]func(*url.URL, Dialer, time.Duration) (Dialer, error)
+// from a URL with such a scheme, and schemeAliases from aliases to the
+// schemes they stand for, guarded by proxySchemesMu.
+var (
+	proxySchemesMu sync.RWMutex
+	proxySchemes   map[string]func(*url.URL, Dialer, time.Duration) (Dialer, error)
+	schemeAliases  map[string]string
+)
 
 // RegisterDialerType takes a URL scheme and a function to generate Dialers from
 // a URL with that scheme and a forwarding Dialer. Registered schemes are used
-// by FromURL.
+// by FromURL, before the built-in ones: registering a built-in scheme, e.g.
+// "https", overrides it with a hardened implementation without changing the
+// callers of FromURL. It is safe for concurrent use, e.g. from the init
+// functions of several packages.
 func RegisterDialerType(scheme string, f func(*url.URL, Dialer, time.Duration) (Dialer, error)) {
+	proxySchemesMu.Lock()
+	defer proxySchemesMu.Unlock()
 	if proxySchemes == nil {
 		proxySchemes = make(map[string]func(*url.URL, Dialer, time.Duration) (Dialer, error))
 	}
 	proxySchemes[scheme] = f
 }
 
+// RegisterSchemeAlias makes FromURL handle the URLs with the scheme alias
+// as those with scheme, a built-in or registered one, e.g. "socks" for
+// "socks5".
+func RegisterSchemeAlias(alias, scheme string) {
+	proxySchemesMu.Lock()
+	defer proxySchemesMu.Unlock()
+	if schemeAliases == nil {
+		schemeAliases = make(map[string]string)
+	}
+	schemeAliases[alias] = scheme
+}
+
+// UnregisterDialerType removes the scheme or alias registered with
+// RegisterDialerType or RegisterSchemeAlias, if any. The dialers already
+// made are not affected.
+func UnregisterDialerType(scheme string) {
+	proxySchemesMu.Lock()
+	defer proxySchemesMu.Unlock()
+	delete(proxySchemes, scheme)
+	delete(schemeAliases, scheme)
+}
+
+// RegisteredSchemes returns the sorted schemes and aliases registered with
+// RegisterDialerType and RegisterSchemeAlias.
+func RegisteredSchemes() []string {
+	proxySchemesMu.RLock()
+	defer proxySchemesMu.RUnlock()
+	schemes := make([]string, 0, len(proxySchemes)+len(schemeAliases))
+	for scheme := range proxySchemes {
+		schemes = append(schemes, scheme)
+	}
+	for alias := range schemeAliases {
+		if _, ok := proxySchemes[alias]; !ok {
+			schemes = append(schemes, alias)
+		}
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+// schemeAlias returns the scheme the alias scheme stands for, or scheme.
+func schemeAlias(scheme string) string {
+	proxySchemesMu.RLock()
+	defer proxySchemesMu.RUnlock()
+	if s, ok := schemeAliases[scheme]; ok {
+		return s
+	}
+	return scheme
+}
+
+// resolveAlias returns u, or a copy of it with the scheme its scheme is an
+// alias of.
+func resolveAlias(u *url.URL) *url.URL {
+	scheme := schemeAlias(u.Scheme)
+	if scheme == u.Scheme {
+		return u
+	}
+	v := *u
+	v.Scheme = scheme
+	return &v
+}
+
+// registeredScheme returns the function registered for scheme, if any.
+func registeredScheme(scheme string) (func(*url.URL, Dialer, time.Duration) (Dialer, error), bool) {
+	proxySchemesMu.RLock()
+	defer proxySchemesMu.RUnlock()
+	f, ok := proxySchemes[scheme]
+	return f, ok
+}
+
 // FromURL returns a Dialer given a URL specification and an underlying
 // Dialer for it to make network requests.
-// Support HTTP/HTTPS/SOCKS5 proxy
-func FromURL(u *url.URL, forward Dialer, timeout time.Duration) (Dialer, error) { // add by biter
+// Support HTTP/HTTPS/SOCKS5 proxy. HTTPS and SOCKS5 over TLS ("socks5s" or
+// "socks5+tls") proxies are reached over TLS, see WithTLSConfig. The
+// "socks5+unix" and "http+unix" schemes reach the proxy over the Unix socket
+// named by the URL path, e.g. "socks5+unix:///run/tor/socks". The "srv+"
+// prefix of a scheme, e.g. "srv+socks5://_socks._tcp.example.com", dials
+// the proxies of the SRV records of the host, see SRVResolver, in the order
+// of their priority and weight, failing over from one to the next. The
+// proxy URLs of the built-in schemes without a port get the default one of
+// their scheme: 1080 for SOCKS5, 443 for HTTPS and 8080 for HTTP, see
+// WithDefaultHTTPPort. The schemes registered with RegisterDialerType and
+// RegisterSchemeAlias take precedence over the built-in ones. The options
+// apply to the built-in schemes. forward may be a golang.org/x/net/proxy
+// dialer, see WrapDialer.
+func FromURL(u *url.URL, forward ForwardDialer, timeout time.Duration, opts ...Option) (Dialer, error) { // add by biter
+	u = resolveAlias(u)
+	fwd := WrapDialer(forward)
 	var auth *Auth
 	if u.User != nil {
 		auth = new(Auth)
@@ -94,22 +252,50 @@ func FromURL(u *url.URL, forward Dialer, timeout time.Duration) (Dialer, error)
 		}
 	}
 
+	// The registered schemes override the built-in ones.
+	if f, ok := registeredScheme(u.Scheme); ok {
+		return f(u, fwd, timeout)
+	}
+
+	if strings.HasPrefix(u.Scheme, "srv+") {
+		return newSRVDialer(u, fwd, timeout, opts)
+	}
+
 	switch u.Scheme {
+	case "socks5+unix":
+		return newSOCKS5("socks5", "unix", u.Path, auth, fwd, timeout, opts), nil
+	case "http+unix":
+		return newHTTPProxy("http", "unix", u.Path, auth, fwd, timeout, opts), nil
 	case "socks5":
-		return SOCKS5("tcp", u.Host, auth, forward, timeout)
+		return SOCKS5("tcp", proxyHost(u, nil), auth, fwd, timeout, opts...)
+	case "socks5s", "socks5+tls":
+		return newSOCKS5(u.Scheme, "tcp", proxyHost(u, nil), auth, fwd, timeout, opts), nil
 	case "http", "https":
-		return HTTPProxyDialer("tcp", u.Host, auth, forward, timeout)
+		return newHTTPProxy(u.Scheme, "tcp", proxyHost(u, newOptions(opts)), auth, fwd, timeout, opts), nil
 	}
 
-	// If the scheme doesn't match any of the built-in schemes, see if it
-	// was registered by another package.
-	if proxySchemes != nil {
-		if f, ok := proxySchemes[u.Scheme]; ok {
-			return f(u, forward, timeout)
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, u.Scheme)
+}
+
+// FromURLContext is FromURL with the timeout of the options, see
+// WithTimeout, and with ctx bounding the network work of the making of the
+// dialer: it resolves the SRV records of the "srv+" schemes, to fail on
+// the unresolvable ones now rather than at the first dial. The schemes
+// registered with RegisterDialerType are made as by FromURL.
+func FromURLContext(ctx context.Context, u *url.URL, forward ForwardDialer, opts ...Option) (Dialer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := FromURL(u, forward, newOptions(opts).Timeout, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := d.(*srvDialer); ok {
+		if _, err := s.endpoints(ctx); err != nil {
+			return nil, &OpError{Op: "resolve", Scheme: u.Scheme, Proxy: s.name, Err: err}
 		}
 	}
-
-	return nil, errors.New("proxy: unknown scheme: " + u.Scheme)
+	return d, nil
 }
 
 var (
@@ -122,6 +308,9 @@ var (
 	timeoutEnv = &envOnce{ // add by biter
 		names: []string{"TIMEOUT", "timeout"},
 	}
+	keyLogEnv = &envOnce{
+		names: []string{"SSLKEYLOGFILE"},
+	}
 )
 
 // envOnce looks up an environment variable (optionally by multiple
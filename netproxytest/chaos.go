@@ -0,0 +1,160 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/biter777/netproxy"
+)
+
+// ChaosDialer is a netproxy.Dialer injecting failures into the dials of
+// another one, to test the retries and failovers built on them:
+//
+//	d := &netproxytest.ChaosDialer{Dialer: proxy, FailRate: 0.3, ResetRate: 0.1, ResetAfter: 4096}
+//
+// Its fields must not be modified after the first dial. A ChaosDialer is
+// safe for concurrent use.
+type ChaosDialer struct {
+	// Dialer makes the dials, netproxy.Direct if nil.
+	Dialer netproxy.Dialer
+
+	// FailRate is the probability that a dial fails at once with Err, by
+	// default an error wrapping netproxy.ErrProxyUnreachable.
+	FailRate float64
+	Err      error
+
+	// TimeoutRate is the probability that a dial hangs, as for a proxy
+	// never completing its handshake, until its context is done, then
+	// fails with a timeout error.
+	TimeoutRate float64
+
+	// ResetRate is the probability that a connection is reset once
+	// ResetAfter bytes have crossed it, read and written: its reads and
+	// writes fail with syscall.ECONNRESET from then on.
+	ResetRate  float64
+	ResetAfter int64
+
+	// Rand returns the random numbers in [0, 1) deciding the failures,
+	// rand.Float64 if nil, e.g. to replay a sequence.
+	Rand func() float64
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network with the
+// Dialer, unless a failure is injected.
+func (d *ChaosDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network with the
+// Dialer, unless a failure is injected.
+func (d *ChaosDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.chance(d.FailRate) {
+		err := d.Err
+		if err == nil {
+			err = fmt.Errorf("netproxytest: injected failure: %w", netproxy.ErrProxyUnreachable)
+		}
+		return nil, err
+	}
+	if d.chance(d.TimeoutRate) {
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("netproxytest: injected timeout: %w", os.ErrDeadlineExceeded)}
+	}
+	forward := d.Dialer
+	if forward == nil {
+		forward = netproxy.Direct
+	}
+	conn, err := forward.DialContext(ctx, network, addr)
+	if err != nil || !d.chance(d.ResetRate) {
+		return conn, err
+	}
+	return &resetConn{Conn: conn, left: d.ResetAfter}, nil
+}
+
+// chance reports whether an event of probability p happens.
+func (d *ChaosDialer) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f := rand.Float64
+	if d.Rand != nil {
+		f = d.Rand
+	}
+	return f() < p
+}
+
+// ------------------------------------------------------------------
+
+// resetConn is a connection reset after a number of bytes.
+type resetConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	left int64 // the bytes before the reset
+}
+
+// take takes up to n bytes from those left before the reset, and returns
+// how many may cross the connection, or the error of op once it is reset.
+func (c *resetConn) take(op string, n int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.left <= 0 {
+		if c.left == 0 {
+			c.left = -1
+			if tc, ok := c.Conn.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			c.Conn.Close()
+		}
+		return 0, &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, syscall.ECONNRESET)}
+	}
+	if int64(n) > c.left {
+		n = int(c.left)
+	}
+	c.left -= int64(n)
+	return n, nil
+}
+
+// giveBack gives back the bytes taken which did not cross the connection.
+func (c *resetConn) giveBack(taken, n int) {
+	if taken > n {
+		c.mu.Lock()
+		c.left += int64(taken - n)
+		c.mu.Unlock()
+	}
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	taken, err := c.take("read", len(b))
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b[:taken])
+	c.giveBack(taken, n)
+	return n, err
+}
+
+func (c *resetConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		taken, err := c.take("write", len(b)-written)
+		if err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(b[written : written+taken])
+		c.giveBack(taken, n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,57 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestChaosDialer(t *testing.T) {
+	srv := NewSOCKS5Server()
+	defer srv.Close()
+	proxy, _ := netproxy.FromURL(srv.URL(), netproxy.Direct, time.Second)
+
+	// The random numbers pick the failure, in the order of the checks.
+	rands := []float64{0.1}
+	d := &ChaosDialer{Dialer: proxy, FailRate: 0.5, TimeoutRate: 0.5, ResetRate: 0.5, ResetAfter: 6, Rand: func() float64 {
+		f := rands[0]
+		rands = rands[1:]
+		return f
+	}}
+	if _, err := d.Dial("tcp", "example.com:443"); !errors.Is(err, netproxy.ErrProxyUnreachable) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrProxyUnreachable)
+	}
+
+	rands = []float64{0.9, 0.1}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	rands = []float64{0.9, 0.9, 0.1}
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := make([]byte, 4)
+	n, err := io.ReadFull(c, b)
+	if n != 2 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("got %d bytes, %v, want 2 bytes and %v", n, err, syscall.ECONNRESET)
+	}
+	if _, err := c.Write([]byte("ping")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("got %v, want %v", err, syscall.ECONNRESET)
+	}
+}
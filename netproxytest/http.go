@@ -0,0 +1,179 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// StatusReset in HTTPServer.Script resets the connection instead of
+// answering the request.
+const StatusReset = -1
+
+// ------------------------------------------------------------------
+
+// HTTPServer is a fake HTTP CONNECT proxy. Its fields are set before
+// Start, and must not be modified after it.
+type HTTPServer struct {
+	// Auth, if not nil, are the Basic credentials the clients must send,
+	// or get a 407 Proxy Authentication Required.
+	Auth *netproxy.Auth
+
+	// Script are the statuses of the responses to the successive CONNECT
+	// requests with valid credentials, after which they get a 200 OK, e.g.
+	// {http.StatusForbidden, StatusReset} for a first request forbidden
+	// and a second one reset.
+	Script []int
+
+	// Delay is waited before each response, to fake a slow proxy.
+	Delay time.Duration
+
+	// Handler, if not nil, serves the tunnels to target; by default, the
+	// tunnels echo their writes. It may dial target for an actual proxy.
+	Handler func(conn net.Conn, target string)
+
+	// Listener is the listener of the server, on a port of the loopback
+	// interface, or of a MemoryDialer.
+	Listener net.Listener
+
+	conns conns
+
+	mu       sync.Mutex
+	requests []*http.Request
+	next     int // the next status of the Script
+}
+
+// NewHTTPServer returns a started HTTPServer accepting every request
+// without authentication.
+func NewHTTPServer() *HTTPServer {
+	s := NewUnstartedHTTPServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedHTTPServer returns an HTTPServer listening but not serving
+// yet, to be configured before Start.
+func NewUnstartedHTTPServer() *HTTPServer {
+	return &HTTPServer{Listener: listen()}
+}
+
+// Start starts serving the clients.
+func (s *HTTPServer) Start() {
+	s.conns.serve(s.Listener, s.serve)
+}
+
+// Close stops the server and waits for its connections to end. The
+// tunnels are closed.
+func (s *HTTPServer) Close() {
+	s.conns.close(s.Listener)
+}
+
+// ------------------------------------------------------------------
+
+// Addr returns the address of the server.
+func (s *HTTPServer) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+// URL returns the proxy URL of the server, with the credentials of Auth.
+func (s *HTTPServer) URL() *url.URL {
+	u := &url.URL{Scheme: "http", Host: s.Addr()}
+	if s.Auth != nil {
+		u.User = url.UserPassword(s.Auth.User, s.Auth.Password)
+	}
+	return u
+}
+
+// Requests returns the CONNECT requests received so far, those refused
+// included, e.g. to check their headers.
+func (s *HTTPServer) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// ------------------------------------------------------------------
+
+// serve answers the requests of a client, until one is accepted.
+func (s *HTTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		status := s.status(req)
+		if s.Delay > 0 {
+			time.Sleep(s.Delay)
+		}
+		switch status {
+		case StatusReset:
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			return
+		case http.StatusOK:
+			if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				return
+			}
+			tunnel := net.Conn(&bufferedConn{Conn: conn, r: br})
+			if s.Handler != nil {
+				s.Handler(tunnel, req.Host)
+				return
+			}
+			io.Copy(conn, tunnel)
+			return
+		}
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+		if status == http.StatusProxyAuthRequired {
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="netproxytest"`)
+		}
+		if resp.Write(conn) != nil || req.Method != http.MethodConnect {
+			return
+		}
+	}
+}
+
+// status records req and returns the status of its response.
+func (s *HTTPServer) status(req *http.Request) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	switch {
+	case req.Method != http.MethodConnect:
+		return http.StatusMethodNotAllowed
+	case s.Auth != nil && req.Header.Get("Proxy-Authorization") != basicAuth(s.Auth):
+		return http.StatusProxyAuthRequired
+	case s.next < len(s.Script):
+		s.next++
+		return s.Script[s.next-1]
+	}
+	return http.StatusOK
+}
+
+// basicAuth returns the Proxy-Authorization header of auth.
+func basicAuth(auth *netproxy.Auth) string {
+	return "Basic " + base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "%s:%s", auth.User, auth.Password))
+}
+
+// bufferedConn is a connection whose reads start with the bytes buffered
+// by r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
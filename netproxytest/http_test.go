@@ -0,0 +1,63 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestHTTPServer(t *testing.T) {
+	srv := NewUnstartedHTTPServer()
+	srv.Auth = &netproxy.Auth{User: "user", Password: "pass"}
+	srv.Script = []int{http.StatusForbidden, StatusReset}
+	srv.Start()
+	defer srv.Close()
+
+	d, err := netproxy.FromURL(srv.URL(), netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	for _, tt := range []struct {
+		d    netproxy.Dialer
+		want error // any error if nil
+	}{
+		{mustHTTPProxy(t, srv.Addr(), nil), netproxy.ErrProxyAuthRequired},
+		{mustHTTPProxy(t, srv.Addr(), &netproxy.Auth{User: "user", Password: "wrong"}), netproxy.ErrProxyAuthFailed},
+		{d, netproxy.ErrTargetRefusedByProxy},
+		{d, nil}, // reset
+	} {
+		_, err := tt.d.Dial("tcp", "example.com:443")
+		if tt.want == nil && err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("got %v, want %v", err, tt.want)
+		}
+	}
+
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v, want ping", b, err)
+	}
+	c.Close()
+	if reqs := srv.Requests(); len(reqs) != 5 || reqs[4].Host != "example.com:443" {
+		t.Errorf("got %d requests, want 5 to example.com:443", len(reqs))
+	}
+}
+
+func mustHTTPProxy(t *testing.T, addr string, auth *netproxy.Auth) netproxy.Dialer {
+	t.Helper()
+	d, err := netproxy.HTTPProxyDialer("tcp", addr, auth, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	return d
+}
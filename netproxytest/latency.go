@@ -0,0 +1,100 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// LatencyDialer is a netproxy.Dialer slowing down the dials of another
+// one and the connections they return, to test the programs against slow
+// proxies:
+//
+//	d := &netproxytest.LatencyDialer{Dialer: proxy, DialDelay: 300 * time.Millisecond, IODelay: 20 * time.Millisecond, Jitter: 0.5}
+//
+// Its fields must not be modified after the first dial. A LatencyDialer is
+// safe for concurrent use.
+type LatencyDialer struct {
+	// Dialer makes the dials, netproxy.Direct if nil.
+	Dialer netproxy.Dialer
+
+	// DialDelay is waited before each dial, unless its context is done
+	// first, and IODelay before each Read and Write of the connections.
+	DialDelay time.Duration
+	IODelay   time.Duration
+
+	// Jitter randomizes the delays: each one is drawn uniformly within
+	// Jitter times the delay around it, e.g. 50-150ms for a delay of
+	// 100ms and a Jitter of 0.5.
+	Jitter float64
+
+	// Rand returns the random numbers in [0, 1) drawing the delays,
+	// rand.Float64 if nil.
+	Rand func() float64
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network with the Dialer,
+// after the DialDelay.
+func (d *LatencyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network with the
+// Dialer, after the DialDelay.
+func (d *LatencyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if delay := d.delay(d.DialDelay); delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	forward := d.Dialer
+	if forward == nil {
+		forward = netproxy.Direct
+	}
+	conn, err := forward.DialContext(ctx, network, addr)
+	if err != nil || d.IODelay <= 0 {
+		return conn, err
+	}
+	return &slowConn{Conn: conn, d: d}, nil
+}
+
+// delay returns base with the jitter applied.
+func (d *LatencyDialer) delay(base time.Duration) time.Duration {
+	if base <= 0 || d.Jitter <= 0 {
+		return base
+	}
+	f := rand.Float64
+	if d.Rand != nil {
+		f = d.Rand
+	}
+	return base + time.Duration(float64(base)*d.Jitter*(2*f()-1))
+}
+
+// ------------------------------------------------------------------
+
+// slowConn is a connection whose reads and writes wait for the IODelay.
+type slowConn struct {
+	net.Conn
+	d *LatencyDialer
+}
+
+func (c *slowConn) Read(b []byte) (int, error) {
+	time.Sleep(c.d.delay(c.d.IODelay))
+	return c.Conn.Read(b)
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.d.delay(c.d.IODelay))
+	return c.Conn.Write(b)
+}
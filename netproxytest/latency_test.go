@@ -0,0 +1,43 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestLatencyDialer(t *testing.T) {
+	srv := NewSOCKS5Server()
+	defer srv.Close()
+	proxy, _ := netproxy.FromURL(srv.URL(), netproxy.Direct, time.Second)
+
+	// The jitter makes the delays 15ms, half of them.
+	d := &LatencyDialer{Dialer: proxy, DialDelay: 30 * time.Millisecond, IODelay: 30 * time.Millisecond, Jitter: 1, Rand: func() float64 { return 0.25 }}
+	start := time.Now()
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v, want ping", b, err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("took %v, want at least 45ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	d = &LatencyDialer{Dialer: proxy, DialDelay: time.Minute}
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
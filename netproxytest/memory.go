@@ -0,0 +1,143 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// MemoryDialer is a netproxy.Dialer connecting in process, over net.Pipe,
+// to the handlers and listeners of its addresses, to test the handshakes
+// without sockets, e.g. as the forward dialer of a proxy dialer to a fake
+// proxy:
+//
+//	mem := new(netproxytest.MemoryDialer)
+//	srv := &netproxytest.SOCKS5Server{Listener: mem.Listen("proxy:1080")}
+//	srv.Start()
+//	d, _ := netproxy.SOCKS5("tcp", "proxy:1080", nil, mem, time.Second)
+//
+// The dials to the other addresses are refused. Its zero value is ready to
+// use; a MemoryDialer is safe for concurrent use.
+type MemoryDialer struct {
+	mu    sync.Mutex
+	addrs map[string]memoryEndpoint
+}
+
+// memoryEndpoint serves the connections to an address, with either a
+// handler or a listener.
+type memoryEndpoint struct {
+	handler  func(net.Conn)
+	listener *memoryListener
+}
+
+// Handle serves the connections to addr with handler, run in a goroutine
+// of its own for each of them, in place of the previous handler or
+// listener of addr. A nil handler removes it.
+func (d *MemoryDialer) Handle(addr string, handler func(net.Conn)) {
+	if handler == nil {
+		d.set(addr, nil)
+		return
+	}
+	d.set(addr, &memoryEndpoint{handler: handler})
+}
+
+// Listen returns a listener accepting the connections to addr until it is
+// closed, in place of the previous handler or listener of addr.
+func (d *MemoryDialer) Listen(addr string) net.Listener {
+	l := &memoryListener{d: d, addr: memoryAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	d.set(addr, &memoryEndpoint{listener: l})
+	return l
+}
+
+func (d *MemoryDialer) set(addr string, e *memoryEndpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e == nil {
+		delete(d.addrs, addr)
+		return
+	}
+	if d.addrs == nil {
+		d.addrs = make(map[string]memoryEndpoint)
+	}
+	d.addrs[addr] = *e
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the handler or listener of addr.
+func (d *MemoryDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the handler or listener of addr, waiting for the
+// listener to accept the connection until ctx is done.
+func (d *MemoryDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	e, ok := d.addrs[addr]
+	d.mu.Unlock()
+	fail := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Addr: memoryAddr(addr), Err: err}
+	}
+	if !ok {
+		return nil, fail(syscall.ECONNREFUSED)
+	}
+	client, server := net.Pipe()
+	if e.handler != nil {
+		go e.handler(server)
+		return client, nil
+	}
+	select {
+	case e.listener.conns <- server:
+		return client, nil
+	case <-e.listener.done:
+		return nil, fail(syscall.ECONNREFUSED)
+	case <-ctx.Done():
+		return nil, fail(ctx.Err())
+	}
+}
+
+// ------------------------------------------------------------------
+
+// memoryAddr is the address of a MemoryDialer listener.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryListener is a listener of a MemoryDialer.
+type memoryListener struct {
+	d     *MemoryDialer
+	addr  memoryAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "memory", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close closes l, and removes it from its address unless replaced since.
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.d.mu.Lock()
+		defer l.d.mu.Unlock()
+		if e := l.d.addrs[string(l.addr)]; e.listener == l {
+			delete(l.d.addrs, string(l.addr))
+		}
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,87 @@
+// (c) biter
+
+// Package netproxytest provides fake proxies for the tests of the programs
+// using netproxy, in the manner of net/http/httptest: they listen on the
+// loopback interface, need no network access, and are scripted to fail in
+// the ways of the real proxies:
+//
+//	srv := netproxytest.NewSOCKS5Server()
+//	defer srv.Close()
+//	d, _ := netproxy.FromURL(srv.URL(), netproxy.Direct, time.Second)
+//	conn, err := d.Dial("tcp", "example.com:443") // an echo of the writes
+package netproxytest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// listen returns a listener on a port of the loopback interface.
+func listen() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic(fmt.Sprintf("netproxytest: failed to listen on a port: %v", err))
+		}
+	}
+	return l
+}
+
+// ------------------------------------------------------------------
+
+// conns are the connections of a server, closed with it.
+type conns struct {
+	mu sync.Mutex
+	m  map[net.Conn]struct{}
+	wg sync.WaitGroup
+
+	closed bool
+}
+
+// serve serves the connections accepted by l with handle, which closes
+// them, until close.
+func (c *conns) serve(l net.Listener, handle func(net.Conn)) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				conn.Close()
+				return
+			}
+			if c.m == nil {
+				c.m = make(map[net.Conn]struct{})
+			}
+			c.m[conn] = struct{}{}
+			c.mu.Unlock()
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				handle(conn)
+				c.mu.Lock()
+				delete(c.m, conn)
+				c.mu.Unlock()
+			}()
+		}
+	}()
+}
+
+// close closes l and the connections, and waits for their handlers to
+// return.
+func (c *conns) close(l net.Listener) {
+	l.Close()
+	c.mu.Lock()
+	c.closed = true
+	for conn := range c.m {
+		conn.Close()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
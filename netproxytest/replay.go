@@ -0,0 +1,261 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/biter777/netproxy"
+)
+
+// The sessions are stored one per file, named after the network, the
+// address and the number of the dial to it, e.g.
+// "tcp_proxy.example.com_1080.0.jsonl", as JSON lines: a header with the
+// network and address, then the chunks of bytes in either direction.
+type (
+	sessionHeader struct {
+		Network string `json:"network"`
+		Addr    string `json:"addr"`
+	}
+	sessionChunk struct {
+		Write bool   `json:"write,omitempty"` // sent by the client, else received
+		Data  []byte `json:"data"`
+	}
+)
+
+// sessionFile returns the name of the file of the n-th session with addr.
+func sessionFile(dir, network, addr string, n int) string {
+	name := strings.Map(func(r rune) rune {
+		if r == ':' || r == '/' || r == '\\' || r == '[' || r == ']' {
+			return '_'
+		}
+		return r
+	}, network+"_"+addr)
+	return filepath.Join(dir, fmt.Sprintf("%s.%d.jsonl", name, n))
+}
+
+// counter numbers the dials to each address.
+type counter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func (c *counter) next(network, addr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int)
+	}
+	n := c.m[network+" "+addr]
+	c.m[network+" "+addr] = n + 1
+	return n
+}
+
+// ------------------------------------------------------------------
+
+// RecordingDialer is a netproxy.Dialer recording the byte streams of the
+// connections of another one to files, for a ReplayDialer to serve them
+// back. As the forward dialer of a proxy dialer, it records the sessions
+// with the proxy, handshakes included:
+//
+//	rec := &netproxytest.RecordingDialer{Dialer: netproxy.Direct, Dir: "testdata/sessions"}
+//	d, _ := netproxy.FromURL(proxyURL, rec, timeout)
+//
+// The files of a session are complete once its connection is closed.
+type RecordingDialer struct {
+	// Dialer makes the dials, netproxy.Direct if nil.
+	Dialer netproxy.Dialer
+	// Dir is the directory of the files, which must exist.
+	Dir string
+
+	n counter
+}
+
+// Dial connects to the address addr on the given network with the Dialer,
+// recording the connection.
+func (d *RecordingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network with the
+// Dialer, recording the connection.
+func (d *RecordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	forward := d.Dialer
+	if forward == nil {
+		forward = netproxy.Direct
+	}
+	conn, err := forward.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(sessionFile(d.Dir, network, addr, d.n.next(network, addr)))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("netproxytest: recording: %w", err)
+	}
+	c := &recordingConn{Conn: conn, f: f, w: bufio.NewWriter(f)}
+	c.enc = json.NewEncoder(c.w)
+	c.enc.Encode(sessionHeader{Network: network, Addr: addr})
+	return c, nil
+}
+
+// recordingConn is a connection recording its bytes.
+type recordingConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(false, b[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(true, b[:n])
+	return n, err
+}
+
+func (c *recordingConn) record(write bool, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		c.enc.Encode(sessionChunk{Write: write, Data: b})
+	}
+}
+
+// Close closes the connection and completes its file.
+func (c *recordingConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return err
+	}
+	ferr := c.w.Flush()
+	if cerr := c.f.Close(); ferr == nil {
+		ferr = cerr
+	}
+	c.f = nil
+	if err == nil && ferr != nil {
+		err = fmt.Errorf("netproxytest: recording: %w", ferr)
+	}
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// ReplayDialer is a netproxy.Dialer serving back the sessions recorded by
+// a RecordingDialer, without network access: the n-th dial to an address
+// gets the n-th session recorded with it, whose connection returns the
+// recorded bytes as the client sends those it sent. A client departing
+// from the recording gets its connection closed, and the mismatch from
+// Err.
+type ReplayDialer struct {
+	// Dir is the directory of the files.
+	Dir string
+
+	n   counter
+	mu  sync.Mutex
+	err error
+}
+
+// Dial connects to the session recorded for the address addr on the given
+// network.
+func (d *ReplayDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the session recorded for the address addr on
+// the given network.
+func (d *ReplayDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	name := sessionFile(d.Dir, network, addr, d.n.next(network, addr))
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("netproxytest: no recorded session: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var header sessionHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("netproxytest: %s: %w", name, err)
+	}
+	var chunks []sessionChunk
+	for {
+		var chunk sessionChunk
+		if err := dec.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("netproxytest: %s: %w", name, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	client, server := net.Pipe()
+	go d.replay(server, name, chunks)
+	return client, nil
+}
+
+// replay plays chunks on conn.
+func (d *ReplayDialer) replay(conn net.Conn, name string, chunks []sessionChunk) {
+	defer conn.Close()
+	for i, chunk := range chunks {
+		if !chunk.Write {
+			if _, err := conn.Write(chunk.Data); err != nil {
+				return
+			}
+			continue
+		}
+		// The bytes are checked as they come, so that a departing client
+		// fails at once rather than waiting for the rest of the chunk.
+		b := make([]byte, len(chunk.Data))
+		for n := 0; n < len(b); {
+			m, err := conn.Read(b[n:])
+			n += m
+			if !bytes.Equal(b[:n], chunk.Data[:n]) {
+				d.fail(fmt.Errorf("netproxytest: %s: chunk %d: got %q, want %q", name, i, b[:n], chunk.Data))
+				return
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+					d.fail(fmt.Errorf("netproxytest: %s: chunk %d: %w", name, i, err))
+				}
+				return
+			}
+		}
+	}
+}
+
+func (d *ReplayDialer) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Err returns the first departure of a client from its recorded session,
+// nil if none.
+func (d *ReplayDialer) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
@@ -0,0 +1,64 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestRecordReplay(t *testing.T) {
+	srv := NewUnstartedSOCKS5Server()
+	srv.Auth = &netproxy.Auth{User: "user", Password: "pass"}
+	srv.Start()
+	defer srv.Close()
+	dir := t.TempDir()
+
+	// A session with the proxy, recorded then replayed once it is gone.
+	session := func(forward netproxy.Dialer) string {
+		t.Helper()
+		d, _ := netproxy.SOCKS5("tcp", srv.Addr(), srv.Auth, forward, time.Second)
+		c, err := d.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer c.Close()
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return string(b)
+	}
+	if got := session(&RecordingDialer{Dir: dir}); got != "ping" {
+		t.Fatalf("got %q, want ping", got)
+	}
+	addr := srv.Addr()
+	srv.Close()
+
+	replay := &ReplayDialer{Dir: dir}
+	if got := session(replay); got != "ping" || replay.Err() != nil {
+		t.Errorf("got %q, %v, want ping", got, replay.Err())
+	}
+	if _, err := replay.Dial("tcp", addr); err == nil {
+		t.Error("the second dial succeeded without a recorded session")
+	}
+
+	// A client departing from the recording.
+	replay = &ReplayDialer{Dir: dir}
+	c, err := replay.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Write([]byte{4, 1, 0})
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("the departing client got a reply")
+	}
+	c.Close()
+	if replay.Err() == nil {
+		t.Error("got no mismatch")
+	}
+}
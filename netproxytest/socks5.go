@@ -0,0 +1,261 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// The reply codes of SOCKS5 (RFC 1928), for SOCKS5Server.Script.
+const (
+	ReplySucceeded               byte = 0
+	ReplyGeneralFailure          byte = 1
+	ReplyNotAllowed              byte = 2
+	ReplyNetworkUnreachable      byte = 3
+	ReplyHostUnreachable         byte = 4
+	ReplyConnectionRefused       byte = 5
+	ReplyTTLExpired              byte = 6
+	ReplyCommandNotSupported     byte = 7
+	ReplyAddressTypeNotSupported byte = 8
+)
+
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+)
+
+// ------------------------------------------------------------------
+
+// SOCKS5Server is a fake SOCKS5 proxy. Its fields are set before Start,
+// and must not be modified after it.
+type SOCKS5Server struct {
+	// Auth, if not nil, are the credentials the clients must authenticate
+	// with, unless AuthOptional is set, in which case the clients may
+	// also choose no authentication.
+	Auth         *netproxy.Auth
+	AuthOptional bool
+
+	// Script are the reply codes of the successive CONNECT requests, after
+	// which they succeed, e.g. {ReplyConnectionRefused} for a first
+	// request refused.
+	Script []byte
+
+	// Delay is waited before each message to the clients, to fake a slow
+	// proxy.
+	Delay time.Duration
+
+	// Handler, if not nil, serves the tunnels to target; by default, the
+	// tunnels echo their writes. It may dial target for an actual proxy.
+	Handler func(conn net.Conn, target string)
+
+	// Listener is the listener of the server, on a port of the loopback
+	// interface, or of a MemoryDialer.
+	Listener net.Listener
+
+	conns conns
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewSOCKS5Server returns a started SOCKS5Server succeeding every request
+// without authentication.
+func NewSOCKS5Server() *SOCKS5Server {
+	s := NewUnstartedSOCKS5Server()
+	s.Start()
+	return s
+}
+
+// NewUnstartedSOCKS5Server returns a SOCKS5Server listening but not
+// serving yet, to be configured before Start.
+func NewUnstartedSOCKS5Server() *SOCKS5Server {
+	return &SOCKS5Server{Listener: listen()}
+}
+
+// Start starts serving the clients.
+func (s *SOCKS5Server) Start() {
+	s.conns.serve(s.Listener, s.serve)
+}
+
+// Close stops the server and waits for its connections to end. The
+// tunnels are closed.
+func (s *SOCKS5Server) Close() {
+	s.conns.close(s.Listener)
+}
+
+// ------------------------------------------------------------------
+
+// Addr returns the address of the server.
+func (s *SOCKS5Server) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+// URL returns the proxy URL of the server, with the credentials of Auth.
+func (s *SOCKS5Server) URL() *url.URL {
+	u := &url.URL{Scheme: "socks5", Host: s.Addr()}
+	if s.Auth != nil {
+		u.User = url.UserPassword(s.Auth.User, s.Auth.Password)
+	}
+	return u
+}
+
+// Requests returns the targets of the CONNECT requests received so far,
+// those refused by the Script included.
+func (s *SOCKS5Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// record records a request to target, and returns its number.
+func (s *SOCKS5Server) record(target string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, target)
+	return len(s.requests) - 1
+}
+
+// ------------------------------------------------------------------
+
+// serve speaks SOCKS5 with a client.
+func (s *SOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	target, err := s.negotiate(conn)
+	if err != nil {
+		return
+	}
+	code := ReplySucceeded
+	if n := s.record(target); n < len(s.Script) {
+		code = s.Script[n]
+	}
+	// The bound address is that of the server, as many proxies reply.
+	if err := s.write(conn, []byte{socks5Version, code, 0, 1, 127, 0, 0, 1, 0, 0}); err != nil || code != ReplySucceeded {
+		return
+	}
+	if s.Handler != nil {
+		s.Handler(conn, target)
+		return
+	}
+	io.Copy(conn, conn)
+}
+
+// negotiate runs the handshake up to the CONNECT request, and returns its
+// target.
+func (s *SOCKS5Server) negotiate(conn net.Conn) (string, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return "", err
+	}
+	if b[0] != socks5Version {
+		return "", errors.New("not SOCKS5")
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthPassword && s.Auth != nil || m == socks5AuthNone && (s.Auth == nil || s.AuthOptional) {
+			if method == socks5NoAcceptable || m == socks5AuthPassword {
+				method = m
+			}
+		}
+	}
+	if err := s.write(conn, []byte{socks5Version, method}); err != nil || method == socks5NoAcceptable {
+		return "", errors.New("no acceptable method")
+	}
+	if method == socks5AuthPassword {
+		if err := s.authenticate(conn); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socks5Connect {
+		s.write(conn, []byte{socks5Version, ReplyCommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported command")
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		s.write(conn, []byte{socks5Version, ReplyAddressTypeNotSupported, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported address type")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// authenticate runs the username/password authentication of RFC 1929.
+func (s *SOCKS5Server) authenticate(conn net.Conn) error {
+	var fields [2]string
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	for i := range fields {
+		if i > 0 {
+			if _, err := io.ReadFull(conn, b[1:]); err != nil {
+				return err
+			}
+		}
+		f := make([]byte, b[1])
+		if _, err := io.ReadFull(conn, f); err != nil {
+			return err
+		}
+		fields[i] = string(f)
+	}
+	status := byte(0)
+	if fields[0] != s.Auth.User || fields[1] != s.Auth.Password {
+		status = 1
+	}
+	if err := s.write(conn, []byte{1, status}); err != nil || status != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// write writes b to the client after the Delay.
+func (s *SOCKS5Server) write(conn net.Conn, b []byte) error {
+	if s.Delay > 0 {
+		time.Sleep(s.Delay)
+	}
+	_, err := conn.Write(b)
+	return err
+}
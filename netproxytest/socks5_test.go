@@ -0,0 +1,70 @@
+// (c) biter
+
+package netproxytest
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestSOCKS5Server(t *testing.T) {
+	srv := NewUnstartedSOCKS5Server()
+	srv.Auth = &netproxy.Auth{User: "user", Password: "pass"}
+	srv.Script = []byte{ReplyConnectionRefused}
+	srv.Start()
+	defer srv.Close()
+
+	d, err := netproxy.FromURL(srv.URL(), netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	if _, err := d.Dial("tcp", "example.com:443"); !errors.Is(err, netproxy.ErrTargetRefusedByProxy) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrTargetRefusedByProxy)
+	}
+	c, err := d.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v, want ping", b, err)
+	}
+	c.Close()
+	if got, want := srv.Requests(), []string{"example.com:443", "192.0.2.1:80"}; !slices.Equal(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+
+	// The credentials are required, unless optional.
+	d, _ = netproxy.SOCKS5("tcp", srv.Addr(), nil, netproxy.Direct, time.Second)
+	if _, err := d.Dial("tcp", "example.com:443"); err == nil {
+		t.Error("Dial without credentials succeeded, want an error")
+	}
+	d, _ = netproxy.SOCKS5("tcp", srv.Addr(), &netproxy.Auth{User: "user", Password: "wrong"}, netproxy.Direct, time.Second)
+	if _, err := d.Dial("tcp", "example.com:443"); !errors.Is(err, netproxy.ErrProxyAuthFailed) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrProxyAuthFailed)
+	}
+}
+
+func TestSOCKS5ServerDelay(t *testing.T) {
+	srv := NewUnstartedSOCKS5Server()
+	srv.Delay = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	d, _ := netproxy.SOCKS5("tcp", srv.Addr(), nil, netproxy.Direct, 20*time.Millisecond)
+	if _, err := d.Dial("tcp", "example.com:443"); err == nil {
+		t.Error("Dial succeeded, want a timeout")
+	}
+	d, _ = netproxy.SOCKS5("tcp", srv.Addr(), nil, netproxy.Direct, 5*time.Second)
+	c, err := d.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Close()
+}
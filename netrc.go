@@ -0,0 +1,111 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// WithNetrc makes the SOCKS5 and HTTP proxy dialers without credentials
+// look up those of the proxy host in the netrc file at path, read at each
+// dial, as curl --netrc does. An empty path is $NETRC, or ~/.netrc (_netrc
+// on Windows). A missing file, or one without the host nor a default entry,
+// leaves the dials unauthenticated.
+func WithNetrc(path string) Option {
+	if path == "" {
+		path = defaultNetrc()
+	}
+	return func(o *Options) {
+		o.Netrc = path
+	}
+}
+
+// defaultNetrc returns the path of the netrc file of the user.
+func defaultNetrc() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// ------------------------------------------------------------------
+
+// netrcAuth returns the credentials of host, without a port, in the netrc
+// file at path: those of its machine entry, or else of the default entry.
+func netrcAuth(path, host string) (Auth, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Auth{}, false
+	}
+	var (
+		auth, def        Auth
+		found, hasDef    bool
+		inMachine, inDef bool
+	)
+	lines := strings.Split(string(b), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			var value string
+			if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+			switch fields[j] {
+			case "machine":
+				if found {
+					return auth, true
+				}
+				inMachine, inDef = value == host, false
+				found = inMachine
+				j++
+			case "default":
+				if found {
+					return auth, true
+				}
+				inMachine, inDef, hasDef = false, true, true
+			case "login", "password", "account":
+				if inMachine || inDef {
+					a := &auth
+					if inDef {
+						a = &def
+					}
+					switch fields[j] {
+					case "login":
+						a.User = value
+					case "password":
+						a.Password = value
+					}
+				}
+				j++
+			case "macdef":
+				// The macro runs up to the next empty line.
+				for i++; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				}
+				j = len(fields)
+			}
+		}
+	}
+	if found {
+		return auth, true
+	}
+	return def, hasDef && def.User != ""
+}
+
+// netrcHost returns the host of the proxy address addr.
+func netrcHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,279 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Options holds the optional settings shared by the dialers of this package.
+// The zero value is ready to use.
+type Options struct {
+	// Metrics, if not nil, receives statistics about dials and the
+	// connections they return.
+	Metrics Metrics
+
+	// Tracer, if not nil, is notified of the phases of each dial.
+	Tracer Tracer
+
+	// Logger, if not nil, receives records about dials: attempts and
+	// successes at slog.LevelDebug, failures at slog.LevelWarn, and
+	// fallbacks to a direct connection at slog.LevelWarn. The level of
+	// the Logger's handler selects what is logged.
+	Logger *slog.Logger
+
+	// Hooks are called at the steps of each dial.
+	Hooks Hooks
+
+	// Debug, if not nil, receives a dump of each proxy handshake with
+	// credentials redacted.
+	Debug io.Writer
+
+	// TLSConfig is used to connect to proxies reached over TLS.
+	TLSConfig *tls.Config
+
+	// TLSHandshaker, if not nil, replaces crypto/tls for the handshake
+	// with proxies reached over TLS.
+	TLSHandshaker TLSHandshaker
+
+	// ClientSessionCache, if not nil, holds the TLS sessions resumed with
+	// proxies reached over TLS instead of a per dialer cache.
+	ClientSessionCache tls.ClientSessionCache
+
+	// KeyLogWriter, if not nil, receives the TLS key material of
+	// connections to proxies reached over TLS. For debugging only.
+	KeyLogWriter io.Writer
+
+	// ServerName, if not empty, is the SNI sent to proxies reached over
+	// TLS.
+	ServerName string
+
+	// ClientCertificate and GetClientCertificate authenticate the client
+	// to proxies reached over TLS.
+	ClientCertificate    *tls.Certificate
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// LocalAddr, if not nil, is the local address used for the connections
+	// made directly, to the proxy or by NewDirect, as for net.Dialer.
+	LocalAddr net.Addr
+
+	// Interface, if not empty, is the name of the network interface the
+	// direct connections are bound to.
+	Interface string
+
+	// Mark, if not zero, is the firewall mark set on the sockets of the
+	// direct connections (Linux only).
+	Mark int
+
+	// KeepAlive and KeepAliveInterval are the idle time before the
+	// first TCP keep-alive probe and the time between probes of the
+	// direct connections; zero is the system default, a negative
+	// KeepAlive disables keep-alives.
+	KeepAlive         time.Duration
+	KeepAliveInterval time.Duration
+
+	// Nagle enables Nagle's algorithm (clears TCP_NODELAY) on the
+	// direct TCP connections.
+	Nagle bool
+
+	// SendBuffer and ReceiveBuffer, if positive, are the SO_SNDBUF and
+	// SO_RCVBUF sizes of the direct TCP connections.
+	SendBuffer    int
+	ReceiveBuffer int
+
+	// MultipathTCP enables Multipath TCP on the direct TCP connections
+	// where the system supports it.
+	MultipathTCP bool
+
+	// FastOpen enables TCP Fast Open on the direct TCP connections
+	// where the system supports it.
+	FastOpen bool
+
+	// Resolver, if not nil, resolves the host names of the direct
+	// connections instead of net.DefaultResolver.
+	Resolver Resolver
+
+	// ResolveLocally makes the proxy dialers resolve the target host
+	// names themselves and send the IP address to the proxy, see
+	// WithResolveLocally.
+	ResolveLocally bool
+
+	// StrictDNS guarantees that no proxied target is resolved locally,
+	// see WithStrictDNS.
+	StrictDNS bool
+
+	// StrictProtocol makes the proxy dialers fail on the replies of their
+	// proxies deviating from the RFCs, see WithStrictProtocol.
+	StrictProtocol bool
+
+	// Family selects the address families of the direct connections.
+	Family Family
+
+	// FallbackDelay is the time the direct connections to a dual-stack
+	// host wait before racing the other address family; zero is 300ms,
+	// negative disables the race.
+	FallbackDelay time.Duration
+
+	// Control, if not nil, is called on the sockets of the direct
+	// connections before they connect, as net.Dialer.Control.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// ProxyProtocol, if not zero, is the version of the PROXY protocol
+	// header sent first on the direct connections.
+	ProxyProtocol int
+
+	// PinnedKeys, if not empty, restricts the public keys accepted from
+	// proxies reached over TLS, see WithPinnedKeys.
+	PinnedKeys []string
+
+	// ConnStats makes the proxy dialers return connections implementing
+	// ConnStats.
+	ConnStats bool
+
+	// IdleTimeout, if positive, closes the connections returned by the
+	// proxy dialers after that time without traffic.
+	IdleTimeout time.Duration
+
+	// ActivityDeadline makes the deadline of the connections returned by
+	// the proxy dialers follow their traffic, see WithActivityDeadline.
+	ActivityDeadline bool
+
+	// ReadBufferSize, if positive, is the size of the buffer reading
+	// the CONNECT responses of HTTP proxies.
+	ReadBufferSize int
+
+	// ErrorBodyLimit is how much of the body of the failed CONNECT
+	// responses is drained, see WithErrorBodyLimit.
+	ErrorBodyLimit int
+
+	// HTTP10 makes the HTTP proxy dialers speak HTTP/1.0, see WithHTTP10.
+	HTTP10 bool
+
+	// PlainHTTPForwarding makes the transports of NewTransport send the
+	// plain HTTP requests without a tunnel, see WithPlainHTTPForwarding.
+	PlainHTTPForwarding bool
+
+	// MaxHeaderBytes and MaxHeaderFields bound the header of the CONNECT
+	// responses, see WithMaxResponseHeader.
+	MaxHeaderBytes  int
+	MaxHeaderFields int
+
+	// Credentials, if not nil, supplies the credentials of the SOCKS5 and
+	// HTTP proxy dialers at each dial, see WithCredentials.
+	Credentials CredentialsProvider
+
+	// Netrc, if not empty, is the path of the netrc file holding the
+	// credentials of the proxies, see WithNetrc.
+	Netrc string
+
+	// HTTPPort, if positive, is the port of the "http" proxy URLs without
+	// one instead of 8080, see WithDefaultHTTPPort.
+	HTTPPort int
+
+	// DefaultScheme, if not empty, is the scheme of the proxy
+	// specifications without one instead of "http", see ParseProxy.
+	DefaultScheme string
+
+	// Timeout is the timeout of the dialers of FromURLContext and of
+	// DerivableDialer.With, see WithTimeout.
+	Timeout time.Duration
+
+	// ResponseTimeout, if positive, bounds the handshakes with the proxies
+	// instead of the timeout of the dialers, see WithResponseTimeout.
+	ResponseTimeout time.Duration
+
+	// Forward is the forward dialer of the dialers of
+	// DerivableDialer.With, see WithForward.
+	Forward Dialer
+
+	// ClientTimeout, MaxRedirects, Retries and RetryBackoff configure the
+	// clients of NewHTTPClient, see WithClientTimeout, WithMaxRedirects
+	// and WithRetries.
+	ClientTimeout time.Duration
+	MaxRedirects  int
+	Retries       int
+	RetryBackoff  time.Duration
+}
+
+// Option configures the optional settings of a dialer.
+type Option func(*Options)
+
+// ------------------------------------------------------------------
+
+// WithMetrics reports dial and connection statistics to m, in addition to
+// any Metrics set by previous options.
+func WithMetrics(m Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = joinMetrics(o.Metrics, m)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithTracer reports the phases of each dial to t.
+func WithTracer(t Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithLogger logs dial attempts, failures and fallbacks to l.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithTimeout sets the timeout of the dialers made by FromURLContext or
+// DerivableDialer.With, the time a dial may take to connect to the proxy
+// and complete its handshake. Zero means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// WithResponseTimeout bounds the wait for the proxy to answer the
+// handshake, the SOCKS5 replies or the CONNECT response, by d instead of the
+// timeout of the dialer, which then only bounds the connection to the proxy
+// and its TLS handshake: some proxies accept the connections at once but
+// take seconds to answer, so that a short timeout keeps failing fast on the
+// unreachable proxies while the slow handshakes are tolerated. A context
+// deadline bounds both. Zero leaves the timeout of the dialer for all.
+func WithResponseTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.ResponseTimeout = d
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithLocalAddr sets the local address (source IP and port) of the
+// connections made directly, to the proxy or by NewDirect. The address must
+// be of a type compatible with the network, e.g. a *net.TCPAddr.
+func WithLocalAddr(addr net.Addr) Option {
+	return func(o *Options) {
+		o.LocalAddr = addr
+	}
+}
+
+// ------------------------------------------------------------------
+
+func newOptions(opts []Option) *Options {
+	o := new(Options)
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	return o
+}
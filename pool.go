@@ -0,0 +1,250 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolRetry is how long a ProxyPool waits before watching its Membership
+// again after a failure.
+const poolRetry = 5 * time.Second
+
+// ErrNoProxies is returned by the dials of a ProxyPool without members.
+var ErrNoProxies = errors.New("proxy: no proxies in the pool")
+
+// ErrShutdown is returned by the dials of a ProxyPool after Shutdown.
+var ErrShutdown = errors.New("proxy: proxy pool shut down")
+
+// Membership is a source of the proxies of a ProxyPool, such as a service
+// registry, see the consul and etcd packages.
+type Membership interface {
+	// Watch calls update with the full list of the proxy URLs, first with
+	// the current one and then on every change, until ctx is done or the
+	// watch fails. It returns the error which stopped it.
+	Watch(ctx context.Context, update func([]*url.URL)) error
+}
+
+// ------------------------------------------------------------------
+
+// poolMember is a proxy of a ProxyPool.
+type poolMember struct {
+	url    *url.URL
+	dialer Dialer
+}
+
+// A ProxyPool is a Dialer spreading the dials over the proxies of a
+// Membership, in turn, and failing over from one to the next. Its members
+// follow the changes of the Membership, so that a fleet of proxies can
+// scale without reconfiguring its clients:
+//
+//	pool := netproxy.NewProxyPool(&consul.Service{Name: "egress"}, netproxy.Direct, timeout)
+//	defer pool.Close()
+//
+// The dials made before the first list of members wait for it.
+type ProxyPool struct {
+	forward Dialer
+	timeout time.Duration
+	opts    []Option
+	o       *Options
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	ready  chan struct{} // closed on the first update
+	once   sync.Once
+
+	abortCtx context.Context // canceled when Shutdown gives up draining
+	abort    context.CancelFunc
+	dials    sync.WaitGroup // the dials in progress
+
+	mu       sync.Mutex
+	members  []poolMember
+	shutdown bool
+	next     atomic.Uint32
+}
+
+// NewProxyPool returns a ProxyPool watching m, with dialers made by FromURL
+// with forward, timeout and opts. The watch is restarted when it fails, and
+// stops on Close.
+func NewProxyPool(m Membership, forward ForwardDialer, timeout time.Duration, opts ...Option) *ProxyPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &ProxyPool{
+		forward: WrapDialer(forward),
+		timeout: timeout,
+		opts:    opts,
+		o:       newOptions(opts),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+	}
+	p.abortCtx, p.abort = context.WithCancel(context.Background())
+	go p.watch(ctx, m)
+	return p
+}
+
+// Close stops watching the Membership and closes the dialers of the
+// members, see CloseDialer. The pool stays usable with its last members.
+func (p *ProxyPool) Close() error {
+	p.cancel()
+	<-p.done
+	p.mu.Lock()
+	members := p.members
+	p.mu.Unlock()
+	var errs []error
+	for _, m := range members {
+		errs = append(errs, CloseDialer(m.dialer))
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts the pool down gracefully: the new dials fail with
+// ErrShutdown, while those in progress, handshakes with the proxies
+// included, may complete until ctx is done, after which they are canceled.
+// Once they have all returned, it closes the pool as Close does, so that
+// no goroutine of the pool is left running. It returns the error of ctx if
+// it canceled dials, else that of Close. The connections made by the pool
+// are not closed.
+func (p *ProxyPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.shutdown = true
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.dials.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.abort()
+		<-drained
+	}
+	if cerr := p.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// watch follows m until ctx is done.
+func (p *ProxyPool) watch(ctx context.Context, m Membership) {
+	defer close(p.done)
+	for {
+		err := m.Watch(ctx, p.update)
+		if ctx.Err() != nil {
+			return
+		}
+		p.o.log(ctx, slog.LevelWarn, "netproxy: proxy pool watch failed", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(poolRetry):
+		}
+	}
+}
+
+// update replaces the members with the proxies of urls, keeping the
+// dialers of those already in the pool and closing those of the others.
+func (p *ProxyPool) update(urls []*url.URL) {
+	p.mu.Lock()
+	old := make(map[string]Dialer, len(p.members))
+	for _, m := range p.members {
+		old[m.url.String()] = m.dialer
+	}
+	members := make([]poolMember, 0, len(urls))
+	for _, u := range urls {
+		d, ok := old[u.String()]
+		delete(old, u.String())
+		if !ok {
+			var err error
+			if d, err = FromURL(u, p.forward, p.timeout, p.opts...); err != nil {
+				p.o.log(context.Background(), slog.LevelWarn, "netproxy: invalid proxy pool member", "proxy", u.Redacted(), "error", err)
+				continue
+			}
+		}
+		members = append(members, poolMember{url: u, dialer: d})
+	}
+	p.members = members
+	p.mu.Unlock()
+	p.once.Do(func() { close(p.ready) })
+	for _, d := range old {
+		CloseDialer(d)
+	}
+}
+
+// Members returns the URLs of the proxies in the pool, with their passwords
+// redacted.
+func (p *ProxyPool) Members() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	urls := make([]string, len(p.members))
+	for i, m := range p.members {
+		urls[i] = m.url.Redacted()
+	}
+	return urls
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network through the
+// proxies of the pool.
+func (p *ProxyPool) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network through
+// the proxies of the pool, starting with the one after that of the last
+// dial. It fails over to the next one on the failures of a proxy, not on
+// those of the target, which the next one would fail as well.
+func (p *ProxyPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	p.mu.Lock()
+	if p.shutdown {
+		p.mu.Unlock()
+		return nil, ErrShutdown
+	}
+	p.dials.Add(1)
+	p.mu.Unlock()
+	defer p.dials.Done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.abortCtx, cancel)
+	defer stop()
+
+	select {
+	case <-p.ready:
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	p.mu.Lock()
+	members := p.members
+	p.mu.Unlock()
+	if len(members) == 0 {
+		return nil, ErrNoProxies
+	}
+
+	start := int((p.next.Add(1) - 1) % uint32(len(members)))
+	var err error
+	for i := range members {
+		var conn net.Conn
+		conn, err = members[(start+i)%len(members)].dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrTargetRefusedByProxy) || errors.Is(err, ErrUnsupportedNetwork) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
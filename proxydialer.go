@@ -0,0 +1,128 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A ProxyDialer contains options for connecting to an address through a
+// proxy, in the manner of net.Dialer:
+//
+//	d := &netproxy.ProxyDialer{Proxy: proxyURL, Timeout: 5 * time.Second}
+//	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+//
+// The zero value dials directly, with no timeout. The fields must not be
+// modified after the first dial, which parses the proxy URL once for all
+// the dials. A ProxyDialer is safe for concurrent use.
+type ProxyDialer struct {
+	// Proxy is the URL of the proxy, with a scheme of FromURL; nil dials
+	// directly.
+	Proxy *url.URL
+
+	// Auth, if not nil, replaces the credentials of the Proxy URL.
+	Auth *Auth
+
+	// Timeout is the maximum amount of time a dial waits for the
+	// connection to the target, handshake with the proxy included; a
+	// context deadline takes precedence. Zero means no timeout.
+	Timeout time.Duration
+
+	// KeepAlive is the idle time before the first TCP keep-alive probe
+	// of the direct connections; zero is the system default, negative
+	// disables keep-alives.
+	KeepAlive time.Duration
+
+	// LocalAddr, if not nil, is the local address of the direct
+	// connections, see WithLocalAddr.
+	LocalAddr net.Addr
+
+	// Resolver, if not nil, resolves the host names of the direct
+	// connections, see WithResolver.
+	Resolver Resolver
+
+	// TLSConfig, if not nil, is used to connect to proxies reached over
+	// TLS, see WithTLSConfig.
+	TLSConfig *tls.Config
+
+	// Forward, if not nil, is the dialer the proxy is reached with
+	// instead of a direct connection.
+	Forward ForwardDialer
+
+	// Options are applied before the fields above that are set, for the
+	// settings without a field.
+	Options []Option
+
+	once   sync.Once
+	dialer Dialer
+	err    error
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address on the named network through the proxy.
+func (d *ProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// ------------------------------------------------------------------
+
+// DialContext connects to the address on the named network through the
+// proxy, using the provided context.
+func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.once.Do(d.init)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.Proxy == nil && d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+// ------------------------------------------------------------------
+
+// init makes the dialer of d.
+func (d *ProxyDialer) init() {
+	opts := d.Options[:len(d.Options):len(d.Options)]
+	if d.LocalAddr != nil {
+		opts = append(opts, WithLocalAddr(d.LocalAddr))
+	}
+	if d.Resolver != nil {
+		opts = append(opts, WithResolver(d.Resolver))
+	}
+	if d.TLSConfig != nil {
+		opts = append(opts, WithTLSConfig(d.TLSConfig))
+	}
+	if d.KeepAlive != 0 {
+		opts = append(opts, WithKeepAlive(d.KeepAlive, 0))
+	}
+
+	if d.Proxy == nil {
+		d.dialer = NewDirect(opts...)
+		return
+	}
+	u := d.Proxy
+	if d.Auth != nil {
+		u = new(url.URL)
+		*u = *d.Proxy
+		u.User = url.UserPassword(d.Auth.User, d.Auth.Password)
+	}
+	spec, err := NewDialerSpec(u, opts...)
+	if err != nil {
+		d.err = err
+		return
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = Direct
+	}
+	d.dialer = spec.Dialer(forward, d.Timeout)
+}
@@ -0,0 +1,94 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtoSig is the signature of the PROXY protocol version 2 headers.
+const proxyProtoSig = "\r\n\r\n\x00\r\nQUIT\n"
+
+// WithProxyProtocol sends a PROXY protocol header (HAProxy, version 1 text
+// or version 2 binary) first on the connections made directly: before the
+// proxy handshake on the connection to the proxy, for a proxy behind a load
+// balancer that wants it, and instead of a handshake on the connections of
+// NewDirect. The header announces the client address set on the dial
+// context with ContextWithClientAddr, or else the local address of the
+// connection. Version 0 sends no header.
+func WithProxyProtocol(version int) Option {
+	return func(o *Options) {
+		o.ProxyProtocol = version
+	}
+}
+
+// ------------------------------------------------------------------
+
+// clientAddrKey is the context key of ContextWithClientAddr.
+type clientAddrKey struct{}
+
+// ContextWithClientAddr returns a copy of ctx making the connections dialed
+// with it announce addr as the client in their PROXY protocol header, e.g.
+// the address of the client a server is proxying.
+func ContextWithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ------------------------------------------------------------------
+
+// sendProxyHeader writes the PROXY protocol header configured by o on conn.
+func (o *Options) sendProxyHeader(ctx context.Context, conn net.Conn) error {
+	src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	if src == nil {
+		src = conn.LocalAddr()
+	}
+	header, err := appendProxyHeader(nil, o.ProxyProtocol, src, conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// appendProxyHeader appends to b the PROXY protocol header of the version for
+// a TCP connection from src to dst. Other addresses are sent as unknown.
+func appendProxyHeader(b []byte, version int, src, dst net.Addr) ([]byte, error) {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	known := s != nil && d != nil && (s.IP.To4() == nil) == (d.IP.To4() == nil)
+
+	switch version {
+	case 1:
+		if !known {
+			return append(b, "PROXY UNKNOWN\r\n"...), nil
+		}
+		proto := "TCP4"
+		if s.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port), nil
+	case 2:
+		b = append(b, proxyProtoSig...)
+		b = append(b, 0x21) // version 2, PROXY command
+		switch {
+		case !known:
+			return append(b, 0x00, 0, 0), nil // unspecified
+		case s.IP.To4() != nil:
+			b = append(b, 0x11, 0, 12) // TCP over IPv4
+			b = append(b, s.IP.To4()...)
+			b = append(b, d.IP.To4()...)
+		default:
+			b = append(b, 0x21, 0, 36) // TCP over IPv6
+			b = append(b, s.IP.To16()...)
+			b = append(b, d.IP.To16()...)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(s.Port))
+		return binary.BigEndian.AppendUint16(b, uint16(d.Port)), nil
+	}
+	return nil, fmt.Errorf("proxy: unknown PROXY protocol version %d", version)
+}
@@ -0,0 +1,149 @@
+// (c) biter
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+	"github.com/biter777/netproxy/server"
+)
+
+// pipeConn is a fake QUIC connection whose streams are served by a SOCKS5
+// server.
+type pipeConn struct {
+	srv    *server.SOCKS5
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *pipeConn) OpenStream(ctx context.Context) (net.Conn, error) {
+	a, b := net.Pipe()
+	go c.srv.ServeConn(b)
+	return a, nil
+}
+
+func (c *pipeConn) Context() context.Context { return c.ctx }
+
+func (c *pipeConn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	srv := server.NewSOCKS5(netproxy.Direct)
+	defer srv.Close()
+
+	var dials atomic.Int32
+	var last atomic.Pointer[pipeConn]
+	Register(func(ctx context.Context, addr string, cfg *tls.Config) (Conn, error) {
+		if addr != "proxy.example:443" || cfg.ServerName != "proxy.example" || cfg.NextProtos[0] != ALPN {
+			t.Errorf("got dial to %s with %q, %q", addr, cfg.ServerName, cfg.NextProtos)
+		}
+		dials.Add(1)
+		c := &pipeConn{srv: srv}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		last.Store(c)
+		return c, nil
+	}, nil)
+
+	u, _ := url.Parse("socks5+quic://proxy.example:443")
+	d, err := netproxy.FromURL(u, netproxy.Direct, 5*time.Second)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			last.Load().Close() // the next dial reconnects
+		}
+		c, err := d.Dial("tcp", target.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+			t.Errorf("got %q, %v, want ping", b, err)
+		}
+		c.Close()
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("got %d QUIC connections, want 2", n)
+	}
+	if err := netproxy.CloseDialer(d); err != nil || last.Load().Context().Err() == nil {
+		t.Errorf("CloseDialer = %v, want the QUIC connection closed", err)
+	}
+
+	// QUIC cannot go through a forward dialer, only a direct one.
+	jump, _ := netproxy.SOCKS5("tcp", "jump:1080", nil, netproxy.Direct, time.Second)
+	if _, err := netproxy.FromURL(u, jump, time.Second); err == nil {
+		t.Error("FromURL ignored the forward dialer")
+	}
+	local := netproxy.NewDirect(netproxy.WithLocalAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if _, err := netproxy.FromURL(u, local, time.Second); err != nil {
+		t.Errorf("FromURL failed with a direct dialer: %v", err)
+	}
+}
+
+func TestPoolStalledDial(t *testing.T) {
+	release := make(chan struct{})
+	var dials atomic.Int32
+	p := newPool(func(ctx context.Context, addr string, cfg *tls.Config) (Conn, error) {
+		dials.Add(1)
+		<-release
+		c := &pipeConn{}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		return c, nil
+	}, nil, "proxy.example")
+
+	// A stalled handshake does not hold the dials with a done context.
+	got := make(chan Conn, 1)
+	go func() {
+		conn, _ := p.get(context.Background(), "proxy.example:443")
+		got <- conn
+	}()
+	for dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.get(ctx, "proxy.example:443"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The waiters share the dial.
+	waiter := make(chan Conn, 1)
+	go func() {
+		conn, _ := p.get(context.Background(), "proxy.example:443")
+		waiter <- conn
+	}()
+	close(release)
+	if a, b := <-got, <-waiter; a == nil || a != b || dials.Load() != 1 {
+		t.Errorf("got %v and %v after %d dials, want one shared connection", a, b, dials.Load())
+	}
+	p.close()
+}
@@ -0,0 +1,9 @@
+// (c) biter
+
+//go:build race
+
+package netproxy
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,192 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Resolver resolves host names to IP addresses. *net.Resolver implements
+// it, so a custom one (with its own Dial, e.g. to a private DNS server) can
+// be used as is.
+type Resolver interface {
+	// LookupNetIP looks up host for network, which is "ip", "ip4" or
+	// "ip6".
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// ------------------------------------------------------------------
+
+// WithResolver resolves the proxy host, and the target host of NewDirect,
+// with r instead of net.DefaultResolver, e.g. to send the queries through the
+// application's own DNS infrastructure.
+func WithResolver(r Resolver) Option {
+	return func(o *Options) {
+		o.Resolver = r
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithResolveLocally selects where the target host names are resolved. By
+// default the SOCKS5 and HTTP dialers send them to the proxy, which resolves
+// them: the local network sees no DNS query for the target. With local set,
+// they are resolved here, with the Resolver and Family of the options, and
+// the proxy is given the first IP address, e.g. when routing decisions are
+// made on the IP, or the proxy resolves badly. This holds whatever the
+// scheme of the proxy URL.
+func WithResolveLocally(local bool) Option {
+	return func(o *Options) {
+		o.ResolveLocally = local
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithStrictDNS, if strict is true, guarantees that the host names of the
+// targets meant to go through a proxy are never resolved locally: they are
+// always sent to the proxy (SOCKS5 domain address, CONNECT host). The code
+// paths that would resolve them here fail with ErrDNSLeak instead: the
+// proxy dialers with WithResolveLocally, and FromEnvironment, when ALL_PROXY
+// is unusable, rather than falling back to a direct connection.
+func WithStrictDNS(strict bool) Option {
+	return func(o *Options) {
+		o.StrictDNS = strict
+	}
+}
+
+// ------------------------------------------------------------------
+
+// Family selects the IP address families of the connections made directly.
+type Family int
+
+const (
+	// AnyFamily uses the addresses in the order of the resolver, racing
+	// the families of dual-stack hosts. This is the default.
+	AnyFamily Family = iota
+	// PreferIPv4 tries the IPv4 addresses first, then the IPv6 ones.
+	PreferIPv4
+	// PreferIPv6 tries the IPv6 addresses first, then the IPv4 ones.
+	PreferIPv6
+	// IPv4Only only uses IPv4 addresses.
+	IPv4Only
+	// IPv6Only only uses IPv6 addresses.
+	IPv6Only
+)
+
+// ------------------------------------------------------------------
+
+// WithFamily sets the address families used, and their order, when the
+// proxy host is resolved, and the target host by NewDirect. The order only
+// decides which family is raced first (see WithFallbackDelay).
+func WithFamily(f Family) Option {
+	return func(o *Options) {
+		o.Family = f
+	}
+}
+
+// ------------------------------------------------------------------
+
+// narrow returns network restricted to the family of f, for the only
+// modes.
+func (f Family) narrow(network string) string {
+	switch {
+	case f == IPv4Only && (network == "tcp" || network == "udp"):
+		return network + "4"
+	case f == IPv6Only && (network == "tcp" || network == "udp"):
+		return network + "6"
+	}
+	return network
+}
+
+// ------------------------------------------------------------------
+
+// sort orders ips by the preference of f, keeping the resolver order within
+// a family.
+func (f Family) sort(ips []netip.Addr) {
+	if f != PreferIPv4 && f != PreferIPv6 {
+		return
+	}
+	slices.SortStableFunc(ips, func(a, b netip.Addr) int {
+		a4, b4 := a.Unmap().Is4(), b.Unmap().Is4()
+		switch {
+		case a4 == b4:
+			return 0
+		case a4 == (f == PreferIPv4):
+			return -1
+		}
+		return 1
+	})
+}
+
+// ------------------------------------------------------------------
+
+// lookup resolves host for network to "ip:port" addresses ordered by the
+// family preference of o, which may be nil.
+func (o *Options) lookup(ctx context.Context, network, host, port string) ([]string, error) {
+	var f Family
+	var r Resolver = net.DefaultResolver
+	if o != nil {
+		f = o.Family
+		if o.Resolver != nil {
+			r = o.Resolver
+		}
+	}
+	ips, err := r.LookupNetIP(ctx, ipNetwork(f.narrow(network)), host)
+	if err != nil {
+		return nil, err
+	}
+	f.sort(ips)
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.Unmap().String(), port)
+	}
+	return addrs, nil
+}
+
+// ------------------------------------------------------------------
+
+// dial makes a direct connection to addr configured by o, which may be nil,
+// resolving the host here when the resolver or the family preference
+// needs it.
+func (o *Options) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o == nil || o.Family == AnyFamily && o.Resolver == nil || !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+		return o.dialContext(ctx, network, addr)
+	}
+	network = o.Family.narrow(network)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil || o.Resolver == nil && (o.Family == IPv4Only || o.Family == IPv6Only) {
+		return o.dialContext(ctx, network, addr)
+	}
+	addrs, err := o.lookup(ctx, network, host, port)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return o.dialAddrs(ctx, network, addrs)
+}
+
+// ------------------------------------------------------------------
+
+// ProxyResolver returns a resolver that sends its DNS queries over TCP
+// through d, e.g. a SOCKS5 dialer, to the name server ("host:port"), so that
+// they do not leak outside the tunnel. If server is empty, the name servers
+// of the system configuration are used; they must then be reachable from
+// the proxy. The resolver can be given to WithResolver, or used by the rest
+// of the application.
+func ProxyResolver(d Dialer, server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if server != "" {
+				address = server
+			}
+			// The Go resolver uses the TCP framing on a conn that is
+			// not a net.PacketConn, whatever the network.
+			return d.DialContext(ctx, "tcp", address)
+		},
+	}
+}
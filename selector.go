@@ -0,0 +1,104 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"net"
+)
+
+// SelectFunc returns the dialers to try in turn for a dial to addr, e.g. a
+// proxy and its fallbacks. The context is the one of the dial, which for a
+// dial of an http.Transport carries the values of the request context. An
+// empty result selects the default dialer.
+type SelectFunc func(ctx context.Context, network, addr string) ([]Dialer, error)
+
+// A ProxySelector is a Dialer choosing the dialers of each dial, for what
+// http.Transport.Proxy cannot express, such as SOCKS5 proxies, chains or
+// failover. It plugs into an http.Transport as its DialContext:
+//
+//	sel := netproxy.NewProxySelector(netproxy.Direct, func(ctx context.Context, network, addr string) ([]netproxy.Dialer, error) {
+//		if strings.HasSuffix(addr, ".onion:80") {
+//			return []netproxy.Dialer{tor}, nil
+//		}
+//		return []netproxy.Dialer{primary, backup}, nil
+//	})
+//	t := &http.Transport{DialContext: sel.DialContext}
+//
+// The dialers set on the context with ContextWithDialers take precedence
+// over the selection.
+type ProxySelector struct {
+	def    Dialer
+	choose SelectFunc
+}
+
+// NewProxySelector returns a ProxySelector dialing with the dialers
+// returned by choose, or with defaultDialer (Direct if nil) when it returns
+// none. choose may be nil.
+func NewProxySelector(defaultDialer Dialer, choose SelectFunc) *ProxySelector {
+	if defaultDialer == nil {
+		defaultDialer = Direct
+	}
+	return &ProxySelector{def: defaultDialer, choose: choose}
+}
+
+// ------------------------------------------------------------------
+
+type dialersKey struct{}
+
+// ContextWithDialers returns a copy of ctx making the dials of a
+// ProxySelector with it try dialers in turn, whatever its selection, e.g.
+// for a request with http.Request.WithContext.
+func ContextWithDialers(ctx context.Context, dialers ...Dialer) context.Context {
+	return context.WithValue(ctx, dialersKey{}, dialers)
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network through the
+// selected dialers.
+func (p *ProxySelector) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network through
+// the selected dialers, trying the next one when a dial fails. It returns
+// the error of the last one.
+func (p *ProxySelector) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialers, err := p.dialers(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dialers {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// ------------------------------------------------------------------
+
+// dialers returns the dialers for a dial.
+func (p *ProxySelector) dialers(ctx context.Context, network, addr string) ([]Dialer, error) {
+	if dialers, _ := ctx.Value(dialersKey{}).([]Dialer); len(dialers) > 0 {
+		return dialers, nil
+	}
+	if p.choose != nil {
+		dialers, err := p.choose(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(dialers) > 0 {
+			return dialers, nil
+		}
+	}
+	if p.def == nil {
+		return []Dialer{Direct}, nil
+	}
+	return []Dialer{p.def}, nil
+}
@@ -0,0 +1,227 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/biter777/netproxy"
+)
+
+// ErrForbidden is returned when the rules of a server deny a destination.
+var ErrForbidden = errors.New("proxy: destination not allowed")
+
+// Rule allows or denies the destinations of the requests of the clients,
+// e.g. so that a jump proxy cannot reach arbitrary internal services. A rule
+// without Domain and Net matches any host.
+type Rule struct {
+	// Deny makes the rule deny the matching destinations instead of
+	// allowing them.
+	Deny bool
+
+	// Domain, if not empty, matches the host names equal to it or
+	// ending with "." + Domain.
+	Domain string
+
+	// Net, if valid, matches the IP addresses it contains, and the host
+	// names resolving to them.
+	Net netip.Prefix
+
+	// MinPort and MaxPort, if not zero, restrict the rule to the ports
+	// from MinPort to MaxPort.
+	MinPort, MaxPort uint16
+}
+
+// ------------------------------------------------------------------
+
+// ParseRule parses a rule written as "allow" or "deny" followed by a
+// destination: a host name (optionally prefixed with "*."), an IP address or
+// CIDR prefix, or "*" for any host, optionally followed by ":port" or
+// ":first-last". The host may be omitted before a port, and IPv6 addresses
+// with a port are bracketed:
+//
+//	deny 10.0.0.0/8
+//	allow *.example.com:443
+//	deny [fd00::/8]:22
+//	deny :25
+func ParseRule(s string) (Rule, error) {
+	action, dest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	var r Rule
+	switch action {
+	case "allow":
+	case "deny":
+		r.Deny = true
+	default:
+		return Rule{}, fmt.Errorf("proxy: rule %q: want allow or deny", s)
+	}
+
+	host, ports := strings.TrimSpace(dest), ""
+	if h, p, ok := strings.Cut(host, "]"); ok && strings.HasPrefix(h, "[") {
+		host = h[1:]
+		if p != "" {
+			if ports, ok = strings.CutPrefix(p, ":"); !ok {
+				return Rule{}, fmt.Errorf("proxy: rule %q: malformed destination", s)
+			}
+		}
+	} else if strings.Count(host, ":") == 1 {
+		host, ports, _ = strings.Cut(host, ":")
+	}
+
+	if ports != "" {
+		first, last, ok := strings.Cut(ports, "-")
+		if !ok {
+			last = first
+		}
+		lo, err1 := strconv.ParseUint(first, 10, 16)
+		hi, err2 := strconv.ParseUint(last, 10, 16)
+		if err1 != nil || err2 != nil || lo == 0 || lo > hi {
+			return Rule{}, fmt.Errorf("proxy: rule %q: malformed ports %q", s, ports)
+		}
+		r.MinPort, r.MaxPort = uint16(lo), uint16(hi)
+	}
+
+	switch {
+	case host == "" || host == "*":
+		if host == "" && ports == "" {
+			return Rule{}, fmt.Errorf("proxy: rule %q: missing destination", s)
+		}
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return Rule{}, fmt.Errorf("proxy: rule %q: %w", s, err)
+		}
+		r.Net = prefix.Masked()
+	default:
+		if ip, err := netip.ParseAddr(host); err == nil {
+			r.Net = netip.PrefixFrom(ip, ip.BitLen())
+		} else {
+			r.Domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "*."), "."))
+		}
+	}
+	return r, nil
+}
+
+// ------------------------------------------------------------------
+
+// WithRules checks the destinations of the requests against rules before
+// dialing out. The first matching rule decides; a destination matching no
+// rule is denied if some rule allows, and allowed otherwise. A host name is
+// resolved locally if a rule has a Net, to match its addresses, which the
+// server then dials instead of the name. Denied requests fail with
+// ErrForbidden.
+func WithRules(rules ...Rule) Option {
+	return func(o *Options) {
+		o.Rules = append(o.Rules, rules...)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// dialer returns d, guarded by the rules of o if any.
+func (o *Options) dialer(d netproxy.Dialer) netproxy.Dialer {
+	if len(o.Rules) == 0 {
+		return d
+	}
+	return &ruleDialer{Dialer: d, rules: o.Rules}
+}
+
+// ------------------------------------------------------------------
+
+// ruleDialer is a dialer enforcing destination rules.
+type ruleDialer struct {
+	netproxy.Dialer
+	rules []Rule
+}
+
+func (d *ruleDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *ruleDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+
+	if ip, err := netip.ParseAddr(host); err == nil || !d.matchNets() {
+		name := host
+		if err == nil {
+			name = ""
+		}
+		if !d.allowed(name, ip.Unmap(), uint16(port)) {
+			return nil, fmt.Errorf("%w: %s", ErrForbidden, addr)
+		}
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !d.allowed(host, ip.Unmap(), uint16(port)) {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrForbidden, addr, ip)
+		}
+	}
+	// Dial the checked addresses: resolving the name again could give
+	// other ones.
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.Dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), portStr)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// ------------------------------------------------------------------
+
+// matchNets reports whether some rule matches IP addresses.
+func (d *ruleDialer) matchNets() bool {
+	for _, r := range d.rules {
+		if r.Net.IsValid() {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------
+
+// allowed reports whether the rules allow the destination with the host
+// name (empty for an IP address), IP address (invalid if unknown) and port.
+func (d *ruleDialer) allowed(name string, ip netip.Addr, port uint16) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	allowList := false
+	for _, r := range d.rules {
+		allowList = allowList || !r.Deny
+		if r.match(name, ip, port) {
+			return !r.Deny
+		}
+	}
+	return !allowList
+}
+
+// ------------------------------------------------------------------
+
+// match reports whether r matches a destination.
+func (r *Rule) match(name string, ip netip.Addr, port uint16) bool {
+	if r.MinPort != 0 && (port < r.MinPort || port > r.MaxPort) {
+		return false
+	}
+	switch {
+	case r.Net.IsValid():
+		return ip.IsValid() && r.Net.Contains(ip)
+	case r.Domain != "":
+		domain := strings.ToLower(r.Domain)
+		return name == domain || strings.HasSuffix(name, "."+domain)
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+// (c) biter
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Rule
+	}{
+		{"deny 10.0.0.0/8", Rule{Deny: true, Net: netip.MustParsePrefix("10.0.0.0/8")}},
+		{"allow *.Example.com:443", Rule{Domain: "example.com", MinPort: 443, MaxPort: 443}},
+		{"deny [fd00::/8]:22", Rule{Deny: true, Net: netip.MustParsePrefix("fd00::/8"), MinPort: 22, MaxPort: 22}},
+		{"deny ::1", Rule{Deny: true, Net: netip.MustParsePrefix("::1/128")}},
+		{"deny :6000-6063", Rule{Deny: true, MinPort: 6000, MaxPort: 6063}},
+		{"allow *", Rule{}},
+	} {
+		got, err := ParseRule(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRule(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "block 10.0.0.0/8", "deny", "deny 10.0.0.0/33", "allow :0", "allow :90-80", "deny [::1]x"} {
+		if _, err := ParseRule(in); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	var rules []Rule
+	for _, s := range []string{"deny :" + port, "allow 127.0.0.0/8", "allow ::1", "allow example.com"} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) failed: %v", s, err)
+		}
+		rules = append(rules, r)
+	}
+	d := (&Options{Rules: rules[1:]}).dialer(netproxy.Direct).(*ruleDialer)
+	for _, tt := range []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"", "127.0.0.1", true},
+		{"", "10.0.0.1", false},
+		{"www.example.com", "", true},
+		{"badexample.com", "", false},
+		{"localhost", "127.0.0.1", true},
+	} {
+		ip, _ := netip.ParseAddr(tt.ip)
+		if got := d.allowed(tt.name, ip, 80); got != tt.want {
+			t.Errorf("allowed(%q, %q) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+
+	// The SOCKS5 server resolves localhost to match it against the CIDR
+	// rule, and replies "not allowed" to the denied port.
+	addr := startServer(t, NewSOCKS5(netproxy.Direct, WithRules(rules[1:]...)))
+	client, err := netproxy.SOCKS5("tcp", addr, nil, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	c, err := client.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	echo(t, c)
+	c.Close()
+
+	addr = startServer(t, NewSOCKS5(netproxy.Direct, WithRules(rules...)))
+	client, err = netproxy.SOCKS5("tcp", addr, nil, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	if _, err := client.Dial("tcp", target.Addr().String()); !errors.Is(err, netproxy.SOCKS5ConnectionNotAllowed) {
+		t.Errorf("got %v, want %v", err, netproxy.SOCKS5ConnectionNotAllowed)
+	}
+}
@@ -0,0 +1,88 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/biter777/netproxy"
+)
+
+// Authenticator checks the user names and passwords of the clients of the
+// servers: SOCKS5 username/password (RFC 1929) and HTTP Basic
+// authentication. Implementations must be safe for concurrent use.
+type Authenticator interface {
+	// Authenticate returns nil if password is valid for user.
+	Authenticate(ctx context.Context, user, password string) error
+}
+
+// AuthenticatorFunc adapts a function, e.g. a call to an external service,
+// to an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, user, password string) error
+
+// Authenticate returns f(ctx, user, password).
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, user, password string) error {
+	return f(ctx, user, password)
+}
+
+// ------------------------------------------------------------------
+
+// WithAuthenticator requires the clients of the servers to authenticate,
+// with their credentials checked by a. It replaces WithBasicAuth.
+func WithAuthenticator(a Authenticator) Option {
+	return func(o *Options) {
+		o.Authenticator = a
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithAuthorizer checks each request of an authenticated client with f
+// before dialing out: f returns nil if user may connect to target
+// ("host:port"), e.g. to give the users different destinations. user is
+// empty for the servers without authentication.
+func WithAuthorizer(f func(ctx context.Context, user, target string) error) Option {
+	return func(o *Options) {
+		o.Authorize = f
+	}
+}
+
+// ------------------------------------------------------------------
+
+// authenticator returns the Authenticator of o, nil if the clients need not
+// authenticate.
+func (o *Options) authenticator() Authenticator {
+	if o.Authenticator != nil {
+		return o.Authenticator
+	}
+	if len(o.Credentials) > 0 {
+		return StaticAuth(o.Credentials)
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// authorize checks that user may connect to target.
+func (o *Options) authorize(ctx context.Context, user, target string) error {
+	if o.Authorize == nil {
+		return nil
+	}
+	return o.Authorize(ctx, user, target)
+}
+
+// ------------------------------------------------------------------
+
+// StaticAuth returns an Authenticator accepting the users of creds, which
+// maps user names to passwords.
+func StaticAuth(creds map[string]string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+		want, ok := creds[user]
+		if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(password)) != 1 {
+			return fmt.Errorf("%w for user %q", netproxy.ErrProxyAuthFailed, user)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,112 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestSOCKS5Auth(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	errDenied := errors.New("denied")
+	addr := startServer(t, NewSOCKS5(netproxy.Direct,
+		WithAuthenticator(StaticAuth(map[string]string{"alice": "secret", "bob": "hunter2"})),
+		WithAuthorizer(func(ctx context.Context, user, target string) error {
+			if user != "alice" {
+				return errDenied
+			}
+			return nil
+		}),
+	))
+
+	for _, tt := range []struct {
+		auth *netproxy.Auth
+		want error
+	}{
+		{&netproxy.Auth{User: "alice", Password: "secret"}, nil},
+		{&netproxy.Auth{User: "alice", Password: "wrong"}, netproxy.ErrProxyAuthFailed},
+		{nil, netproxy.ErrProxyAuthRequired},
+		{&netproxy.Auth{User: "bob", Password: "hunter2"}, netproxy.SOCKS5ConnectionNotAllowed},
+	} {
+		client, err := netproxy.SOCKS5("tcp", addr, tt.auth, netproxy.Direct, time.Second)
+		if err != nil {
+			t.Fatalf("SOCKS5 failed: %v", err)
+		}
+		c, err := client.Dial("tcp", target.Addr().String())
+		if tt.want == nil {
+			if err != nil {
+				t.Fatalf("%+v: Dial failed: %v", tt.auth, err)
+			}
+			echo(t, c)
+			c.Close()
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.auth, err, tt.want)
+		}
+	}
+}
+
+func TestSOCKS5ContextAuth(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	users := make(chan string, 2)
+	addr := startServer(t, NewSOCKS5(netproxy.Direct,
+		WithAuthenticator(AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+			users <- user
+			return nil
+		})),
+	))
+
+	client, err := netproxy.SOCKS5("tcp", addr, &netproxy.Auth{User: "default", Password: "x"}, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	ctx := netproxy.ContextWithAuth(context.Background(), &netproxy.Auth{User: "session1", Password: "x"})
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		c, err := client.DialContext(ctx, "tcp", target.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		echo(t, c)
+		c.Close()
+	}
+	if got := []string{<-users, <-users}; got[0] != "session1" || got[1] != "default" {
+		t.Errorf("got users %q, want session1 then default", got)
+	}
+
+	ctx = netproxy.ContextWithAuth(context.Background(), nil)
+	if _, err := client.DialContext(ctx, "tcp", target.Addr().String()); !errors.Is(err, netproxy.ErrProxyAuthRequired) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrProxyAuthRequired)
+	}
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	var got []string
+	addr := startServer(t, NewHTTP(netproxy.Direct,
+		WithBasicAuth("alice", "secret"),
+		WithAuthorizer(func(ctx context.Context, user, target string) error {
+			got = append(got, user+" "+target)
+			return errors.New("denied")
+		}),
+	))
+
+	client, err := netproxy.HTTPProxyDialer("tcp", addr, &netproxy.Auth{User: "alice", Password: "secret"}, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	if _, err := client.Dial("tcp", target.Addr().String()); err == nil {
+		t.Error("Dial succeeded, want an error")
+	}
+	if want := "alice " + target.Addr().String(); len(got) != 1 || got[0] != want {
+		t.Errorf("authorizer got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+// (c) biter
+
+// Package htpasswd authenticates the clients of the proxy servers with an
+// Apache htpasswd file:
+//
+//	auth, err := htpasswd.File("/etc/netproxy/htpasswd")
+//	...
+//	srv := server.NewSOCKS5(netproxy.Direct, server.WithAuthenticator(auth))
+//
+// It is apart from package server, which does not depend on
+// golang.org/x/crypto.
+package htpasswd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/biter777/netproxy"
+	"github.com/biter777/netproxy/server"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// File returns a server.Authenticator accepting the users of the htpasswd
+// file at path, whose passwords are hashed with bcrypt (htpasswd -B) or
+// SHA-1 (htpasswd -s). The file is read once.
+func File(path string) (server.Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("proxy: %s:%d: malformed htpasswd line", path, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("proxy: %s:%d: unsupported password hash for user %q", path, n, user)
+		}
+		hashes[user] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return server.AuthenticatorFunc(func(ctx context.Context, user, password string) error {
+		hash, ok := hashes[user]
+		if ok && check(hash, password) {
+			return nil
+		}
+		return fmt.Errorf("%w for user %q", netproxy.ErrProxyAuthFailed, user)
+	}), nil
+}
+
+// check reports whether password matches an htpasswd hash.
+func check(hash, password string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,57 @@
+// (c) biter
+
+package htpasswd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/biter777/netproxy"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# users\nalice:" + string(hash) + "\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := File(path)
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "password", false},
+		{"bob", "password", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+	} {
+		err := auth.Authenticate(ctx, tt.user, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, want ok %v", tt.user, tt.password, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, netproxy.ErrProxyAuthFailed) {
+			t.Errorf("got %v, want %v", err, netproxy.ErrProxyAuthFailed)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("alice:$apr1$salt$hash\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := File(path); err == nil {
+		t.Error("File succeeded with an MD5 hash, want an error")
+	}
+}
@@ -0,0 +1,320 @@
+// (c) biter
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// HTTP is an HTTP proxy server connecting the clients to their targets
+// through a netproxy.Dialer. It serves CONNECT tunnels and, if enabled with
+// WithHTTPForwarding, forwards plain HTTP requests for absolute URLs.
+type HTTP struct {
+	dialer    netproxy.Dialer
+	opts      *Options
+	t         tracker
+	transport *http.Transport
+}
+
+// NewHTTP returns an HTTP proxy server whose outbound connections are made
+// with d, e.g. netproxy.Direct or a chain of proxy dialers.
+func NewHTTP(d netproxy.Dialer, opts ...Option) *HTTP {
+	o := newOptions(opts)
+	s := &HTTP{dialer: o.dialer(d), opts: o}
+	if s.opts.Forwarding {
+		s.transport = &http.Transport{
+			DialContext:         s.dialer.DialContext,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+	return s
+}
+
+// ------------------------------------------------------------------
+
+// ListenAndServe listens on the network address addr and serves the HTTP
+// proxy clients connecting to it. It returns ErrServerClosed after Close.
+func (s *HTTP) ListenAndServe(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// ------------------------------------------------------------------
+
+// Serve serves the HTTP proxy clients accepted on ln, each in its own
+// goroutine, until ln fails or the server is closed. It returns
+// ErrServerClosed after Close.
+func (s *HTTP) Serve(ln net.Listener) error {
+	return s.t.serve(ln, s.handle)
+}
+
+// ------------------------------------------------------------------
+
+// ServeConn serves a single HTTP proxy client, and closes conn once done.
+func (s *HTTP) ServeConn(conn net.Conn) {
+	s.t.serveConn(conn, s.handle)
+}
+
+// ------------------------------------------------------------------
+
+// Close stops the listeners, closes the served connections and waits for
+// their handlers to return.
+func (s *HTTP) Close() error {
+	err := s.t.close()
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// handle serves the requests of one client.
+func (s *HTTP) handle(ctx context.Context, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	conn, err := s.opts.accept(conn)
+	if err != nil {
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy connection rejected", "error", err)
+		return
+	}
+	ctx = netproxy.ContextWithClientAddr(ctx, conn.RemoteAddr())
+	log := []any{"client", conn.RemoteAddr().String()}
+	size := 4096
+	if s.opts.BufferSize > 0 {
+		size = s.opts.BufferSize
+	}
+	br := bufio.NewReaderSize(conn, size)
+	for {
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy request failed", append(log, "error", err)...)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		req = req.WithContext(ctx)
+
+		user, err := s.authenticate(ctx, req)
+		if err != nil {
+			req.Body.Close()
+			resp := response(req, http.StatusProxyAuthRequired)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="netproxy"`)
+			resp.Write(conn)
+			s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy authentication failed", append(log, "error", err)...)
+			return
+		}
+		reqLog := log
+		if user != "" {
+			reqLog = append(reqLog, "user", user)
+		}
+		target := req.Host
+		if req.Method != http.MethodConnect {
+			target = canonicalAddr(req.URL)
+		}
+		if err := s.opts.authorize(ctx, user, target); err != nil {
+			req.Body.Close()
+			response(req, http.StatusForbidden).Write(conn)
+			s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy request denied", append(reqLog, "target", target, "error", err)...)
+			return
+		}
+		if req.Method == http.MethodConnect {
+			s.tunnel(ctx, conn, br, req, reqLog)
+			return
+		}
+		if !s.forward(ctx, conn, req, reqLog) {
+			return
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+
+// tunnel serves a CONNECT request.
+func (s *HTTP) tunnel(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request, log []any) {
+	target := req.Host
+	log = append(log, "target", target)
+	out, err := s.dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		response(req, errorStatus(err)).Write(conn)
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy dial failed", append(log, "error", err)...)
+		return
+	}
+	defer out.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// Data the client sent after the request goes first.
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err := out.Write(b); err != nil {
+			return
+		}
+	}
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: HTTP proxy tunnel", log...)
+	sent, received := s.opts.relay(conn, out)
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: HTTP proxy tunnel closed", append(log, "sent", sent, "received", received)...)
+}
+
+// ------------------------------------------------------------------
+
+// forward serves a plain HTTP request and reports whether the connection
+// can serve another one.
+func (s *HTTP) forward(ctx context.Context, conn net.Conn, req *http.Request, log []any) bool {
+	defer req.Body.Close()
+	switch {
+	case s.transport == nil:
+		response(req, http.StatusMethodNotAllowed).Write(conn)
+		return false
+	case req.URL.Host == "" || req.URL.Scheme != "http":
+		response(req, http.StatusBadRequest).Write(conn)
+		return false
+	}
+	log = append(log, "url", req.URL.String())
+
+	keepAlive := !req.Close
+	out := req.Clone(ctx)
+	out.RequestURI = ""
+	out.Close = false
+	removeHopHeaders(out.Header)
+	resp, err := s.transport.RoundTrip(out)
+	if err != nil {
+		response(req, errorStatus(err)).Write(conn)
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: HTTP proxy request failed", append(log, "error", err)...)
+		return false
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: HTTP proxy forwarded", append(log, "status", resp.StatusCode)...)
+	return keepAlive
+}
+
+// ------------------------------------------------------------------
+
+// authenticate checks the credentials of req, if the server requires some,
+// and returns the authenticated user.
+func (s *HTTP) authenticate(ctx context.Context, req *http.Request) (string, error) {
+	auth := s.opts.authenticator()
+	if auth == nil {
+		return "", nil
+	}
+	user, password, ok := proxyBasicAuth(req)
+	if !ok {
+		return "", fmt.Errorf("%w: no Basic credentials", netproxy.ErrProxyAuthRequired)
+	}
+	if err := auth.Authenticate(ctx, user, password); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// ------------------------------------------------------------------
+
+// canonicalAddr returns the "host:port" of u, with the default port of its
+// scheme if u has none.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// ------------------------------------------------------------------
+
+// proxyBasicAuth returns the Basic credentials of the Proxy-Authorization
+// header of req.
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	r := http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+// ------------------------------------------------------------------
+
+// hopHeaders are the hop-by-hop headers, which a proxy must not forward.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including those
+// named by Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// response returns a short text response to req with status.
+func response(req *http.Request, status int) *http.Response {
+	body := fmt.Sprintf("%d %s\n", status, http.StatusText(status))
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+}
+
+// ------------------------------------------------------------------
+
+// errorStatus maps the error of an outbound dial to an HTTP status.
+func errorStatus(err error) int {
+	var ne net.Error
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.As(err, &ne) && ne.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,100 @@
+// (c) biter
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	addr := startServer(t, NewHTTP(netproxy.Direct, WithBasicAuth("user", "password")))
+
+	client, err := netproxy.HTTPProxyDialer("tcp", addr, &netproxy.Auth{User: "user", Password: "password"}, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	c, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	echo(t, c)
+	c.Close()
+
+	client, err = netproxy.HTTPProxyDialer("tcp", addr, &netproxy.Auth{User: "user", Password: "wrong"}, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	if _, err := client.Dial("tcp", target.Addr().String()); !errors.Is(err, netproxy.ErrProxyAuthFailed) {
+		t.Errorf("got %v, want %v", err, netproxy.ErrProxyAuthFailed)
+	}
+}
+
+func TestHTTPForwarding(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("hop-by-hop header forwarded: %v", r.Header)
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	for _, forwarding := range []bool{false, true} {
+		addr := startServer(t, NewHTTP(netproxy.Direct, WithHTTPForwarding(forwarding)))
+		proxyURL := &url.URL{Scheme: "http", Host: addr}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, origin.URL+"/path", nil)
+			req.Header.Set("Proxy-Connection", "keep-alive")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !forwarding {
+				if resp.StatusCode != http.StatusMethodNotAllowed {
+					t.Errorf("got %s, want %d", resp.Status, http.StatusMethodNotAllowed)
+				}
+				continue
+			}
+			if resp.StatusCode != http.StatusOK || string(body) != "hello /path" {
+				t.Errorf("got %s %q, want 200 %q", resp.Status, body, "hello /path")
+			}
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	addr := startServer(t, NewHTTP(netproxy.Direct, WithBufferSize(64)))
+
+	client, err := netproxy.HTTPProxyDialer("tcp", addr, nil, netproxy.Direct, time.Second, netproxy.WithReadBufferSize(64))
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	c, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	msg := strings.Repeat("0123456789", 100)
+	go io.WriteString(c, msg)
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != msg {
+		t.Errorf("got %q, %v, want the message echoed", b, err)
+	}
+}
@@ -0,0 +1,186 @@
+// (c) biter
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/biter777/netproxy"
+)
+
+// proxyProtoSig is the signature of the PROXY protocol version 2 headers.
+const proxyProtoSig = "\r\n\r\n\x00\r\nQUIT\n"
+
+// WithAcceptProxyProtocol makes the servers read a PROXY protocol header
+// (HAProxy, version 1 or 2) first on each connection, if accept is true, as
+// sent by a load balancer in front of them: the client address it carries
+// is then the remote address of the connection for the rules, the logs and
+// the outbound dials (see netproxy.ContextWithClientAddr). Connections
+// without a header are rejected, so only enable it behind such a balancer.
+func WithAcceptProxyProtocol(accept bool) Option {
+	return func(o *Options) {
+		o.AcceptProxyProtocol = accept
+	}
+}
+
+// ------------------------------------------------------------------
+
+// accept reads the PROXY protocol header of conn if o requires one, and
+// returns the connection to serve.
+func (o *Options) accept(conn net.Conn) (net.Conn, error) {
+	if !o.AcceptProxyProtocol {
+		return conn, nil
+	}
+	br := bufio.NewReader(conn)
+	src, dst, err := readProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	pc := &proxyConn{Conn: conn, r: br, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if src != nil {
+		pc.remote, pc.local = src, dst
+	}
+	return pc, nil
+}
+
+// ------------------------------------------------------------------
+
+// readProxyHeader reads a PROXY protocol header from br and returns the
+// addresses it carries, nil for a LOCAL or UNKNOWN one.
+func readProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyProtoSig))
+	if err == nil && string(sig) == proxyProtoSig {
+		return readProxyHeaderV2(br)
+	}
+	if b, _ := br.Peek(6); string(b) != "PROXY " {
+		return nil, nil, fmt.Errorf("%w: no PROXY protocol header", netproxy.ErrProtocol)
+	}
+	return readProxyHeaderV1(br)
+}
+
+// ------------------------------------------------------------------
+
+// readProxyHeaderV1 reads a version 1 (text) header.
+func readProxyHeaderV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: malformed PROXY protocol header", netproxy.ErrProtocol)
+	}
+	f := strings.Split(text, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("%w: malformed PROXY protocol header %q", netproxy.ErrProtocol, text)
+	}
+	s, err1 := parseAddrPort(f[2], f[4])
+	d, err2 := parseAddrPort(f[3], f[5])
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("%w: malformed PROXY protocol header %q", netproxy.ErrProtocol, text)
+	}
+	return net.TCPAddrFromAddrPort(s), net.TCPAddrFromAddrPort(d), nil
+}
+
+// parseAddrPort parses an address and a port of a version 1 header.
+func parseAddrPort(addr, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// ------------------------------------------------------------------
+
+// readProxyHeaderV2 reads a version 2 (binary) header.
+func readProxyHeaderV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	var h [16]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return nil, nil, fmt.Errorf("proxy: failed to read PROXY protocol header: %w", err)
+	}
+	if h[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: PROXY protocol version %d", netproxy.ErrProtocol, h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("proxy: failed to read PROXY protocol header: %w", err)
+	}
+	if h[12]&0x0f == 0 { // LOCAL: health checks of the balancer
+		return nil, nil, nil
+	}
+	var n int
+	switch h[13] {
+	case 0x11: // TCP over IPv4
+		n = 4
+	case 0x21: // TCP over IPv6
+		n = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, fmt.Errorf("%w: short PROXY protocol header", netproxy.ErrProtocol)
+	}
+	s, _ := netip.AddrFromSlice(body[:n])
+	d, _ := netip.AddrFromSlice(body[n : 2*n])
+	sp := binary.BigEndian.Uint16(body[2*n:])
+	dp := binary.BigEndian.Uint16(body[2*n+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(s, sp)), net.TCPAddrFromAddrPort(netip.AddrPortFrom(d, dp)), nil
+}
+
+// ------------------------------------------------------------------
+
+// proxyConn is a connection whose addresses come from its PROXY protocol
+// header.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite half closes the underlying connection, if it supports it.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,68 @@
+// (c) biter
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	addr := startServer(t, NewSOCKS5(netproxy.Direct, WithAcceptProxyProtocol(true), WithLogger(logger)))
+
+	ctx := netproxy.ContextWithClientAddr(context.Background(), &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4321})
+	for _, version := range []int{1, 2} {
+		balancer := netproxy.NewDirect(netproxy.WithProxyProtocol(version))
+		client, err := netproxy.SOCKS5("tcp", addr, nil, balancer, time.Second)
+		if err != nil {
+			t.Fatalf("SOCKS5 failed: %v", err)
+		}
+		c, err := client.DialContext(ctx, "tcp", target.Addr().String())
+		if err != nil {
+			t.Fatalf("v%d: Dial failed: %v", version, err)
+		}
+		echo(t, c)
+		c.Close()
+	}
+	if !strings.Contains(logs.String(), "client=192.0.2.1:4321") {
+		t.Errorf("client address not logged: %s", logs.String())
+	}
+
+	client, err := netproxy.SOCKS5("tcp", addr, nil, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	if _, err := client.Dial("tcp", target.Addr().String()); err == nil {
+		t.Error("Dial without a PROXY protocol header succeeded")
+	}
+}
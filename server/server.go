@@ -0,0 +1,322 @@
+// (c) biter
+
+// Package server implements proxy servers whose outbound connections are
+// made through a netproxy.Dialer, e.g. to listen locally and exit through a
+// chain of proxies:
+//
+//	upstream, err := netproxy.FromURL(u, netproxy.Direct, timeout)
+//	srv := server.NewSOCKS5(upstream)
+//	err = srv.ListenAndServe("tcp", "127.0.0.1:1080")
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options holds the optional settings of the servers of this package. The
+// zero value is ready to use.
+type Options struct {
+	// Logger, if not nil, receives records about the served
+	// connections: tunnels at slog.LevelDebug, failures at
+	// slog.LevelWarn.
+	Logger *slog.Logger
+
+	// Credentials, if not empty, maps the user names accepted by the
+	// servers to their passwords, unless Authenticator is set.
+	Credentials map[string]string
+
+	// Authenticator, if not nil, checks the credentials of the clients.
+	Authenticator Authenticator
+
+	// Authorize, if not nil, checks the target of each request before
+	// dialing out.
+	Authorize func(ctx context.Context, user, target string) error
+
+	// Rules, if not empty, allow or deny the destinations of the
+	// requests.
+	Rules []Rule
+
+	// AcceptProxyProtocol makes the servers read a PROXY protocol
+	// header first on each connection.
+	AcceptProxyProtocol bool
+
+	// Forwarding makes the HTTP server forward the plain HTTP requests,
+	// in addition to the CONNECT tunnels.
+	Forwarding bool
+
+	// BufferSize, if positive, is the size of the buffers of the
+	// servers, see WithBufferSize.
+	BufferSize int
+
+	// UDP makes the SOCKS5 server serve UDP ASSOCIATE, with sessions
+	// ending after UDPIdleTimeout without traffic and at most
+	// UDPSessions of them.
+	UDP            bool
+	UDPIdleTimeout time.Duration
+	UDPSessions    int
+}
+
+// Option configures the optional settings of a server.
+type Option func(*Options)
+
+// ------------------------------------------------------------------
+
+// WithLogger logs the served connections to l.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithBasicAuth requires the clients of the servers to authenticate as user
+// with password: SOCKS5 username/password or HTTP Proxy-Authorization:
+// Basic. It can be given once per user.
+func WithBasicAuth(user, password string) Option {
+	return func(o *Options) {
+		if o.Credentials == nil {
+			o.Credentials = make(map[string]string)
+		}
+		o.Credentials[user] = password
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithHTTPForwarding makes the HTTP server forward the plain HTTP requests
+// for absolute http:// URLs through its dialer, if enable is true. By
+// default it only serves CONNECT.
+func WithHTTPForwarding(enable bool) Option {
+	return func(o *Options) {
+		o.Forwarding = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithBufferSize sets the size of the buffers of the servers: those copying
+// the data of a tunnel in each direction, 32KB if zero, unused when the
+// system copies it (splice), and the one reading the requests of the HTTP
+// server, 4KB if zero.
+func WithBufferSize(size int) Option {
+	return func(o *Options) {
+		o.BufferSize = size
+	}
+}
+
+// ------------------------------------------------------------------
+
+func newOptions(opts []Option) *Options {
+	o := new(Options)
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	return o
+}
+
+// ------------------------------------------------------------------
+
+// log writes a record to the configured Logger, if any.
+func (o *Options) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if o.Logger == nil || !o.Logger.Enabled(ctx, level) {
+		return
+	}
+	o.Logger.Log(ctx, level, msg, args...)
+}
+
+// ------------------------------------------------------------------
+
+// ErrServerClosed is returned by the Serve methods after Close.
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// tracker keeps the listeners and connections of a server, so that Close
+// can stop them.
+type tracker struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// ------------------------------------------------------------------
+
+// init prepares t on first use; t.mu must be held.
+func (t *tracker) init() {
+	if t.listeners == nil {
+		t.listeners = make(map[net.Listener]struct{})
+		t.conns = make(map[net.Conn]struct{})
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// ------------------------------------------------------------------
+
+// serve accepts connections on ln and runs handle for each one in its own
+// goroutine, until ln fails or t is closed. It closes ln and the
+// connections once handle returns.
+func (t *tracker) serve(ln net.Listener, handle func(ctx context.Context, conn net.Conn)) error {
+	t.mu.Lock()
+	t.init()
+	if t.closed {
+		t.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	t.listeners[ln] = struct{}{}
+	ctx := t.ctx
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.listeners, ln)
+		t.mu.Unlock()
+		ln.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			if temporary(err) {
+				// Back off on transient failures such as
+				// running out of file descriptors.
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !t.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer t.untrack(conn)
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// ------------------------------------------------------------------
+
+// temporary reports whether err, returned by Accept, is transient: the
+// listener may accept connections again later.
+func temporary(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ------------------------------------------------------------------
+
+// serveConn runs handle for conn, unless t is closed.
+func (t *tracker) serveConn(conn net.Conn, handle func(ctx context.Context, conn net.Conn)) {
+	if !t.track(conn) {
+		conn.Close()
+		return
+	}
+	defer t.untrack(conn)
+	handle(t.ctx, conn)
+}
+
+// ------------------------------------------------------------------
+
+// track records conn; it reports false if t is closed.
+func (t *tracker) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+// untrack forgets and closes conn.
+func (t *tracker) untrack(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// ------------------------------------------------------------------
+
+// close stops the listeners and connections of t and waits for their
+// handlers to return.
+func (t *tracker) close() error {
+	t.mu.Lock()
+	t.init()
+	t.closed = true
+	t.cancel()
+	var err error
+	for ln := range t.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// closeWriter is implemented by the connections that can be half closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data between a and b in both directions until both are done,
+// half closing each side when the other one reaches EOF. It returns the
+// bytes copied from a to b and from b to a.
+func (o *Options) relay(a, b net.Conn) (aToB, bToA int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bToA = o.halfCopy(a, b)
+	}()
+	aToB = o.halfCopy(b, a)
+	wg.Wait()
+	return aToB, bToA
+}
+
+// halfCopy copies src to dst, then half closes dst, or closes both on
+// errors or if that is not supported.
+func (o *Options) halfCopy(dst, src net.Conn) int64 {
+	var buf []byte
+	if o.BufferSize > 0 {
+		buf = make([]byte, o.BufferSize)
+	}
+	n, err := io.CopyBuffer(dst, src, buf)
+	if cw, ok := dst.(closeWriter); !ok || err != nil || cw.CloseWrite() != nil {
+		dst.Close()
+		src.Close()
+	}
+	return n
+}
@@ -0,0 +1,313 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+const socks5Version = 5
+
+const (
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+)
+
+const (
+	socks5Connect      = 1
+	socks5UDPAssociate = 3
+)
+
+const (
+	socks5IP4    = 1
+	socks5Domain = 3
+	socks5IP6    = 4
+)
+
+// handshakeTimeout bounds the SOCKS5 negotiation with a client.
+const handshakeTimeout = 30 * time.Second
+
+// SOCKS5 is a SOCKS5 server (RFC 1928) connecting the clients to their
+// targets through a netproxy.Dialer. It supports the CONNECT command, the
+// UDP ASSOCIATE command if enabled with WithUDPRelay, and the
+// username/password authentication (RFC 1929) if the server has an
+// Authenticator or credentials.
+type SOCKS5 struct {
+	dialer   netproxy.Dialer
+	opts     *Options
+	t        tracker
+	udpSlots chan struct{} // one per UDP session
+}
+
+// NewSOCKS5 returns a SOCKS5 server whose outbound connections are made with
+// d, e.g. netproxy.Direct or a chain of proxy dialers.
+func NewSOCKS5(d netproxy.Dialer, opts ...Option) *SOCKS5 {
+	o := newOptions(opts)
+	s := &SOCKS5{dialer: o.dialer(d), opts: o}
+	if o.UDP {
+		s.udpSlots = make(chan struct{}, o.udpSessions())
+	}
+	return s
+}
+
+// ------------------------------------------------------------------
+
+// ListenAndServe listens on the network address addr and serves the SOCKS5
+// clients connecting to it. It returns ErrServerClosed after Close.
+func (s *SOCKS5) ListenAndServe(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// ------------------------------------------------------------------
+
+// Serve serves the SOCKS5 clients accepted on ln, each in its own goroutine,
+// until ln fails or the server is closed. It returns ErrServerClosed after
+// Close.
+func (s *SOCKS5) Serve(ln net.Listener) error {
+	return s.t.serve(ln, s.handle)
+}
+
+// ------------------------------------------------------------------
+
+// ServeConn serves a single SOCKS5 client, and closes conn once done.
+func (s *SOCKS5) ServeConn(conn net.Conn) {
+	s.t.serveConn(conn, s.handle)
+}
+
+// ------------------------------------------------------------------
+
+// Close stops the listeners, closes the served connections and waits for
+// their handlers to return.
+func (s *SOCKS5) Close() error {
+	return s.t.close()
+}
+
+// ------------------------------------------------------------------
+
+// handle serves one client.
+func (s *SOCKS5) handle(ctx context.Context, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, err := s.opts.accept(conn)
+	if err != nil {
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: SOCKS5 connection rejected", "error", err)
+		return
+	}
+	ctx = netproxy.ContextWithClientAddr(ctx, conn.RemoteAddr())
+	log := []any{"client", conn.RemoteAddr().String()}
+	user, cmd, target, err := s.negotiate(ctx, conn)
+	if err != nil {
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: SOCKS5 negotiation failed", append(log, "error", err)...)
+		return
+	}
+	if user != "" {
+		log = append(log, "user", user)
+	}
+	if cmd == socks5UDPAssociate {
+		s.associate(ctx, conn, user, log)
+		return
+	}
+	log = append(log, "target", target)
+	if err := s.opts.authorize(ctx, user, target); err != nil {
+		s.reply(conn, byte(netproxy.SOCKS5ConnectionNotAllowed), nil)
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: SOCKS5 request denied", append(log, "error", err)...)
+		return
+	}
+
+	out, err := s.dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		s.reply(conn, replyCode(err), nil)
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: SOCKS5 dial failed", append(log, "error", err)...)
+		return
+	}
+	defer out.Close()
+	if err := s.reply(conn, 0, out.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: SOCKS5 tunnel", log...)
+	sent, received := s.opts.relay(conn, out)
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: SOCKS5 tunnel closed", append(log, "sent", sent, "received", received)...)
+}
+
+// ------------------------------------------------------------------
+
+// negotiate runs the method selection and the authentication, and reads the
+// request of the client, returning the authenticated user, the command and
+// its address: the target of a CONNECT.
+func (s *SOCKS5) negotiate(ctx context.Context, conn net.Conn) (user string, cmd byte, target string, err error) {
+	buf := make([]byte, 2, 4+255+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", 0, "", fmt.Errorf("proxy: failed to read greeting: %w", err)
+	}
+	if buf[0] != socks5Version {
+		return "", 0, "", fmt.Errorf("%w: unexpected SOCKS version %d", netproxy.ErrProtocol, buf[0])
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, "", fmt.Errorf("proxy: failed to read authentication methods: %w", err)
+	}
+	auth := s.opts.authenticator()
+	want := byte(socks5AuthNone)
+	if auth != nil {
+		want = socks5AuthPassword
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", 0, "", fmt.Errorf("proxy: failed to write method selection: %w", err)
+	}
+	if method == socks5AuthNoAcceptable {
+		return "", 0, "", fmt.Errorf("%w: no acceptable authentication method", netproxy.ErrProxyAuthRequired)
+	}
+	if auth != nil {
+		if user, err = s.authenticate(ctx, conn, auth); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	buf = buf[:4]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", 0, "", fmt.Errorf("proxy: failed to read request: %w", err)
+	}
+	if buf[0] != socks5Version {
+		return "", 0, "", fmt.Errorf("%w: unexpected SOCKS version %d", netproxy.ErrProtocol, buf[0])
+	}
+	typ := buf[3]
+	cmd = buf[1]
+	addrLen := 0
+	switch typ {
+	case socks5IP4:
+		addrLen = net.IPv4len
+	case socks5IP6:
+		addrLen = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", 0, "", fmt.Errorf("proxy: failed to read domain length: %w", err)
+		}
+		addrLen = int(buf[0])
+	default:
+		s.reply(conn, byte(netproxy.SOCKS5AddressTypeNotSupported), nil)
+		return "", 0, "", fmt.Errorf("%w: unknown address type %d", netproxy.ErrProtocol, typ)
+	}
+	buf = buf[:addrLen+2]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", 0, "", fmt.Errorf("proxy: failed to read address: %w", err)
+	}
+	host := string(buf[:addrLen])
+	if typ != socks5Domain {
+		host = net.IP(buf[:addrLen]).String()
+	}
+	port := int(buf[addrLen])<<8 | int(buf[addrLen+1])
+	target = net.JoinHostPort(host, strconv.Itoa(port))
+
+	if cmd != socks5Connect && (cmd != socks5UDPAssociate || !s.opts.UDP) {
+		s.reply(conn, byte(netproxy.SOCKS5CommandNotSupported), nil)
+		return "", 0, "", fmt.Errorf("%w: command %d", netproxy.SOCKS5CommandNotSupported, cmd)
+	}
+	return user, cmd, target, nil
+}
+
+// ------------------------------------------------------------------
+
+// authenticate runs the username/password subnegotiation (RFC 1929) and
+// returns the user authenticated by auth.
+func (s *SOCKS5) authenticate(ctx context.Context, conn net.Conn, auth Authenticator) (string, error) {
+	buf := make([]byte, 2, 256)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", fmt.Errorf("proxy: failed to read authentication request: %w", err)
+	}
+	if buf[0] != 1 {
+		return "", fmt.Errorf("%w: unexpected authentication version %d", netproxy.ErrProtocol, buf[0])
+	}
+	buf = buf[:int(buf[1])+1]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", fmt.Errorf("proxy: failed to read user name: %w", err)
+	}
+	user := string(buf[:len(buf)-1])
+	buf = buf[:buf[len(buf)-1]]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", fmt.Errorf("proxy: failed to read password: %w", err)
+	}
+	err := auth.Authenticate(ctx, user, string(buf))
+	status := byte(0)
+	if err != nil {
+		status = 1
+	}
+	if _, werr := conn.Write([]byte{1, status}); werr != nil && err == nil {
+		err = fmt.Errorf("proxy: failed to write authentication reply: %w", werr)
+	}
+	return user, err
+}
+
+// ------------------------------------------------------------------
+
+// reply sends a reply with code and the bound address addr, which may be
+// nil.
+func (s *SOCKS5) reply(conn net.Conn, code byte, addr net.Addr) error {
+	_, err := conn.Write(appendAddr([]byte{socks5Version, code, 0}, addr))
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// appendAddr appends to b the SOCKS5 encoding of the TCP or UDP address
+// addr: its type, IP address and port; 0.0.0.0:0 for other addresses.
+func appendAddr(b []byte, addr net.Addr) []byte {
+	ip, port := net.IPv4zero.To4(), 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5IP4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5IP6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// ------------------------------------------------------------------
+
+// replyCode maps the error of an outbound dial to a SOCKS5 reply code.
+func replyCode(err error) byte {
+	var socksErr netproxy.SOCKS5Error
+	var dnsErr *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(err, ErrForbidden):
+		return byte(netproxy.SOCKS5ConnectionNotAllowed)
+	case errors.As(err, &socksErr):
+		return byte(socksErr)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return byte(netproxy.SOCKS5ConnectionRefused)
+	case errors.Is(err, syscall.ENETUNREACH):
+		return byte(netproxy.SOCKS5NetworkUnreachable)
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), errors.As(err, &ne) && ne.Timeout():
+		return byte(netproxy.SOCKS5HostUnreachable)
+	}
+	return byte(netproxy.SOCKS5GeneralFailure)
+}
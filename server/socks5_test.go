@@ -0,0 +1,146 @@
+// (c) biter
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// echoServer echoes the connections accepted on a new listener, which the
+// caller closes.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startServer serves srv on a new listener and returns its address; srv is
+// closed at the end of the test.
+func startServer(t *testing.T, srv interface {
+	Serve(net.Listener) error
+	Close() error
+}) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// echo checks that c echoes a message.
+func echo(t *testing.T, c net.Conn) {
+	t.Helper()
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v, want ping", b, err)
+	}
+}
+
+// flakyListener fails its first Accept with err.
+type flakyListener struct {
+	net.Listener
+	err error
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if err := ln.err; err != nil {
+		ln.err = nil
+		return nil, err
+	}
+	return ln.Listener.Accept()
+}
+
+func TestServeTemporaryError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	srv := NewTransparent(netproxy.Direct)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(&flakyListener{Listener: ln, err: &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}})
+	}()
+
+	// The server keeps serving after running out of file descriptors.
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	// Served as a loop: closed without a reply.
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %d, %v, want EOF", n, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Serve returned %v", err)
+	default:
+	}
+	srv.Close()
+	if err := <-done; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	addr := startServer(t, NewSOCKS5(netproxy.Direct))
+
+	client, err := netproxy.SOCKS5("tcp", addr, nil, netproxy.Direct, time.Second)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	c, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	echo(t, c)
+	c.Close()
+
+	// A closed port of the loopback is refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	_, err = client.Dial("tcp", closed)
+	if !errors.Is(err, netproxy.SOCKS5ConnectionRefused) {
+		t.Errorf("got %v, want %v", err, netproxy.SOCKS5ConnectionRefused)
+	}
+}
@@ -0,0 +1,156 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// Transparent is a transparent proxy server: it serves the connections
+// intercepted by the firewall of a router or gateway (iptables REDIRECT or
+// TPROXY, pf divert-to) and connects each one to its original
+// destination through a netproxy.Dialer.
+type Transparent struct {
+	dialer netproxy.Dialer
+	opts   *Options
+	t      tracker
+}
+
+// NewTransparent returns a transparent proxy server whose outbound
+// connections are made with d, e.g. a SOCKS5 dialer.
+func NewTransparent(d netproxy.Dialer, opts ...Option) *Transparent {
+	o := newOptions(opts)
+	return &Transparent{dialer: o.dialer(d), opts: o}
+}
+
+// ------------------------------------------------------------------
+
+// ListenAndServe listens on the network address addr, with ListenTransparent,
+// and serves the connections redirected to it. It returns ErrServerClosed
+// after Close.
+func (s *Transparent) ListenAndServe(network, addr string) error {
+	ln, err := ListenTransparent(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// ------------------------------------------------------------------
+
+// Serve serves the intercepted connections accepted on ln, each in its own
+// goroutine, until ln fails or the server is closed. It returns
+// ErrServerClosed after Close.
+func (s *Transparent) Serve(ln net.Listener) error {
+	local := ln.Addr()
+	return s.t.serve(ln, func(ctx context.Context, conn net.Conn) {
+		s.handle(ctx, conn, local)
+	})
+}
+
+// ------------------------------------------------------------------
+
+// ServeConn serves a single intercepted connection, and closes conn once
+// done.
+func (s *Transparent) ServeConn(conn net.Conn) {
+	s.t.serveConn(conn, func(ctx context.Context, conn net.Conn) {
+		s.handle(ctx, conn, nil)
+	})
+}
+
+// ------------------------------------------------------------------
+
+// Close stops the listeners, closes the served connections and waits for
+// their handlers to return.
+func (s *Transparent) Close() error {
+	return s.t.close()
+}
+
+// ------------------------------------------------------------------
+
+// handle serves one intercepted connection; listener is the address of its
+// listener, if known.
+func (s *Transparent) handle(ctx context.Context, conn net.Conn, listener net.Addr) {
+	if s.opts.AcceptProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		var err error
+		if conn, err = s.opts.accept(conn); err != nil {
+			s.opts.log(ctx, slog.LevelWarn, "netproxy: transparent proxy connection rejected", "error", err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	ctx = netproxy.ContextWithClientAddr(ctx, conn.RemoteAddr())
+	log := []any{"client", conn.RemoteAddr().String()}
+	dst := originalDst(conn)
+	log = append(log, "target", dst.String())
+	if listener != nil && isLoop(dst, listener) {
+		// Not intercepted: dialing out would loop back here.
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: transparent proxy connection not redirected", log...)
+		return
+	}
+
+	out, err := s.dialer.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: transparent proxy dial failed", append(log, "error", err)...)
+		return
+	}
+	defer out.Close()
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: transparent proxy tunnel", log...)
+	sent, received := s.opts.relay(conn, out)
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: transparent proxy tunnel closed", append(log, "sent", sent, "received", received)...)
+}
+
+// ------------------------------------------------------------------
+
+// isLoop reports whether dst, the destination of a connection accepted by
+// listener, is the listener itself: the connection was not intercepted, and
+// dialing dst would loop back here. With a listener on the unspecified
+// address, any local address of the host with the port of the listener is.
+func isLoop(dst, listener net.Addr) bool {
+	d, err := netip.ParseAddrPort(dst.String())
+	if err != nil {
+		return false
+	}
+	l, err := netip.ParseAddrPort(listener.String())
+	if err != nil || d.Port() != l.Port() {
+		return false
+	}
+	dip, lip := d.Addr().Unmap(), l.Addr().Unmap()
+	if dip == lip {
+		return true
+	}
+	if !lip.IsUnspecified() {
+		return false
+	}
+	if dip.IsUnspecified() || dip.IsLoopback() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(n.IP); ok && ip.Unmap() == dip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------
+
+// originalDst returns the destination the client of an intercepted
+// connection asked for: the one recorded by the NAT (REDIRECT) if any, else
+// the local address of the connection (TPROXY, divert-to).
+func originalDst(conn net.Conn) net.Addr {
+	if dst, err := natDst(conn); err == nil {
+		return dst
+	}
+	return conn.LocalAddr()
+}
@@ -0,0 +1,86 @@
+// (c) biter
+
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST from <linux/netfilter_ipv4.h>,
+	// also IP6T_SO_ORIGINAL_DST.
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT from <linux/in6.h>.
+	ipv6Transparent = 75
+)
+
+// ListenTransparent listens on the network address addr for the connections
+// intercepted by the firewall. It sets IP_TRANSPARENT on the socket, which
+// TPROXY needs and which requires CAP_NET_ADMIN; for REDIRECT, a plain
+// net.Listen listener can be given to Serve instead.
+func ListenTransparent(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// ------------------------------------------------------------------
+
+// natDst returns the original destination of conn recorded by the NAT of
+// netfilter (SO_ORIGINAL_DST).
+func natDst(conn net.Conn) (net.Addr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, syscall.ENOPROTOOPT
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var ap netip.AddrPort
+	cerr := raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			// A sockaddr_in6 fits in an IPv6MTUInfo.
+			var info *syscall.IPv6MTUInfo
+			if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				ap = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), uint16(port[0])<<8|uint16(port[1]))
+			}
+			return
+		}
+		// A sockaddr_in fits in an IPv6Mreq.
+		var mreq *syscall.IPv6Mreq
+		if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			b := mreq.Multiaddr
+			ap = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), uint16(b[2])<<8|uint16(b[3]))
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
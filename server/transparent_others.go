@@ -0,0 +1,25 @@
+// (c) biter
+
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenTransparent listens on the network address addr for the connections
+// intercepted by the firewall; the original destination is the local
+// address of each connection (pf divert-to).
+func ListenTransparent(network, addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+// ------------------------------------------------------------------
+
+// natDst is not supported: the firewalls keep the original destination as
+// the local address.
+func natDst(conn net.Conn) (net.Addr, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,80 @@
+// (c) biter
+
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// interceptedConn is a connection whose local address is the original
+// destination, as with TPROXY.
+type interceptedConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (c *interceptedConn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+func TestTransparent(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	srv := NewTransparent(netproxy.Direct)
+	defer srv.Close()
+
+	client, conn := net.Pipe()
+	go srv.ServeConn(&interceptedConn{Conn: conn, dst: target.Addr()})
+	echo(t, client)
+	client.Close()
+
+	// A connection made to the listener itself is not forwarded.
+	addr := startServer(t, srv)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %d, %v, want EOF", n, err)
+	}
+}
+
+func TestIsLoop(t *testing.T) {
+	local := "127.0.0.1"
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			local = n.IP.String()
+			break
+		}
+	}
+	tests := []struct {
+		dst, listener string
+		want          bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", "[::]:8080", true},
+		{"127.0.0.2:8080", "[::]:8080", true},
+		{"[::1]:8080", "0.0.0.0:8080", true},
+		{local + ":8080", "0.0.0.0:8080", true},
+		{"127.0.0.2:8080", "192.0.2.1:8080", false},
+		{"203.0.113.5:8080", "0.0.0.0:8080", false},
+		{"203.0.113.5:8080", "127.0.0.1:8080", false},
+		{"127.0.0.1:80", "127.0.0.1:8080", false},
+		{"127.0.0.1:80", "[::]:8080", false},
+	}
+	for _, tt := range tests {
+		dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+		listener, _ := net.ResolveTCPAddr("tcp", tt.listener)
+		if got := isLoop(dst, listener); got != tt.want {
+			t.Errorf("isLoop(%s, %s) = %v, want %v", tt.dst, tt.listener, got, tt.want)
+		}
+	}
+}
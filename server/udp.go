@@ -0,0 +1,344 @@
+// (c) biter
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+const (
+	// defaultUDPIdleTimeout is the default time a UDP session lasts
+	// without traffic.
+	defaultUDPIdleTimeout = 2 * time.Minute
+	// defaultUDPSessions is the default maximum of UDP sessions of a
+	// server.
+	defaultUDPSessions = 1024
+	// udpPending is the maximum of datagrams queued for a UDP session
+	// being dialed; the next ones are dropped.
+	udpPending = 16
+)
+
+// WithUDPRelay makes the SOCKS5 server serve the UDP ASSOCIATE command:
+// it relays the datagrams of a client, received on a UDP socket of its own,
+// to their targets over connections dialed with network "udp", so with a
+// dialer able to carry UDP, e.g. netproxy.Direct. The session with a target
+// ends after idle without traffic (2 minutes if 0). At most maxSessions
+// sessions (1024 if 0), each served by a goroutine, exist in the server at
+// once: the datagrams for new targets are dropped beyond. The sessions are
+// dialed in the background, queuing their first datagrams meanwhile.
+func WithUDPRelay(idle time.Duration, maxSessions int) Option {
+	return func(o *Options) {
+		o.UDP = true
+		o.UDPIdleTimeout = idle
+		o.UDPSessions = maxSessions
+	}
+}
+
+// ------------------------------------------------------------------
+
+// udpIdleTimeout returns the time a UDP session lasts without traffic.
+func (o *Options) udpIdleTimeout() time.Duration {
+	if o.UDPIdleTimeout > 0 {
+		return o.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// udpSessions returns the maximum of UDP sessions of a server.
+func (o *Options) udpSessions() int {
+	if o.UDPSessions > 0 {
+		return o.UDPSessions
+	}
+	return defaultUDPSessions
+}
+
+// ------------------------------------------------------------------
+
+// associate serves a UDP ASSOCIATE request: the association lasts as long
+// as conn.
+func (s *SOCKS5) associate(ctx context.Context, conn net.Conn, user string, log []any) {
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if client == nil || local == nil {
+		s.reply(conn, byte(netproxy.SOCKS5GeneralFailure), nil)
+		return
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		s.reply(conn, byte(netproxy.SOCKS5GeneralFailure), nil)
+		s.opts.log(ctx, slog.LevelWarn, "netproxy: SOCKS5 UDP listen failed", append(log, "error", err)...)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &udpRelay{s: s, ctx: ctx, cancel: cancel, user: user, pc: pc, clientIP: client.IP, sessions: make(map[string]*udpSession)}
+	defer r.close()
+	if err := s.reply(conn, 0, pc.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	log = append(log, "relay", pc.LocalAddr().String())
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: SOCKS5 UDP association", log...)
+	r.wg.Add(1)
+	go r.serve()
+	io.Copy(io.Discard, conn)
+	s.opts.log(ctx, slog.LevelDebug, "netproxy: SOCKS5 UDP association closed", log...)
+}
+
+// ------------------------------------------------------------------
+
+// udpRelay relays the datagrams of a UDP association.
+type udpRelay struct {
+	s        *SOCKS5
+	ctx      context.Context
+	cancel   context.CancelFunc // cancels the dials of the sessions
+	user     string
+	pc       *net.UDPConn
+	clientIP net.IP
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	client   *net.UDPAddr // where the replies go, once known
+	sessions map[string]*udpSession
+	closed   bool
+}
+
+// udpSession is the connection of a UDP association with a target.
+type udpSession struct {
+	conn    net.Conn     // nil while being dialed
+	pending [][]byte     // the datagrams received meanwhile
+	last    atomic.Int64 // time of the last datagram, in Unix nanoseconds
+}
+
+func (sess *udpSession) touch() {
+	sess.last.Store(time.Now().UnixNano())
+}
+
+// ------------------------------------------------------------------
+
+// serve relays the datagrams of the client to their targets, until the
+// relay is closed.
+func (r *udpRelay) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := r.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(r.clientIP) {
+			continue // only the client may use the relay
+		}
+		target, payload, err := parseDatagram(buf[:n])
+		if err != nil {
+			r.s.opts.log(r.ctx, slog.LevelDebug, "netproxy: SOCKS5 UDP datagram dropped", "client", from.String(), "error", err)
+			continue
+		}
+		r.mu.Lock()
+		r.client = from
+		sess := r.session(target)
+		var conn net.Conn
+		if sess != nil {
+			if conn = sess.conn; conn == nil && len(sess.pending) < udpPending {
+				sess.pending = append(sess.pending, append([]byte(nil), payload...))
+			}
+		}
+		r.mu.Unlock()
+		if conn != nil {
+			sess.touch()
+			conn.Write(payload)
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+
+// session returns the session with target, starting to dial it if needed;
+// nil if it cannot be had. r.mu must be held.
+func (r *udpRelay) session(target string) *udpSession {
+	if sess := r.sessions[target]; sess != nil || r.closed {
+		return sess
+	}
+	select {
+	case r.s.udpSlots <- struct{}{}:
+	default:
+		r.s.opts.log(r.ctx, slog.LevelWarn, "netproxy: SOCKS5 UDP session dropped", append(r.logAttrs(target), "error", errors.New("too many sessions"))...)
+		return nil
+	}
+	sess := &udpSession{}
+	sess.touch()
+	r.sessions[target] = sess
+	r.wg.Add(1)
+	go r.open(target, sess)
+	return sess
+}
+
+// open dials a new session, sends it the datagrams queued meanwhile and
+// relays its replies.
+func (r *udpRelay) open(target string, sess *udpSession) {
+	log := r.logAttrs(target)
+	conn, err := r.dial(target)
+	if err != nil {
+		r.drop(target, sess)
+		r.s.opts.log(r.ctx, slog.LevelWarn, "netproxy: SOCKS5 UDP dial failed", append(log, "error", err)...)
+		return
+	}
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			conn.Close()
+			r.drop(target, sess)
+			return
+		}
+		pending := sess.pending
+		sess.pending = nil
+		if len(pending) == 0 {
+			// Once the queue is flushed, in order, serve writes directly.
+			sess.conn = conn
+		}
+		r.mu.Unlock()
+		if len(pending) == 0 {
+			break
+		}
+		for _, p := range pending {
+			conn.Write(p)
+		}
+	}
+	sess.touch()
+	r.s.opts.log(r.ctx, slog.LevelDebug, "netproxy: SOCKS5 UDP session", log...)
+	r.reply(target, sess)
+}
+
+// drop ends a session which could not be opened.
+func (r *udpRelay) drop(target string, sess *udpSession) {
+	r.mu.Lock()
+	if r.sessions[target] == sess {
+		delete(r.sessions, target)
+	}
+	r.mu.Unlock()
+	<-r.s.udpSlots
+	r.wg.Done()
+}
+
+// logAttrs returns the attributes logged about the session with target.
+func (r *udpRelay) logAttrs(target string) []any {
+	log := []any{"client", r.clientIP.String(), "target", target}
+	if r.user != "" {
+		log = append(log, "user", r.user)
+	}
+	return log
+}
+
+// dial connects to target, if allowed.
+func (r *udpRelay) dial(target string) (net.Conn, error) {
+	if err := r.s.opts.authorize(r.ctx, r.user, target); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, handshakeTimeout)
+	defer cancel()
+	return r.s.dialer.DialContext(ctx, "udp", target)
+}
+
+// ------------------------------------------------------------------
+
+// reply relays the datagrams of a session back to the client, until the
+// session expires or the relay is closed.
+func (r *udpRelay) reply(target string, sess *udpSession) {
+	defer r.wg.Done()
+	defer func() { <-r.s.udpSlots }()
+	defer r.remove(target, sess)
+
+	idle := r.s.opts.udpIdleTimeout()
+	buf := make([]byte, 64<<10)
+	header := len(appendAddr(append(buf[:0], 0, 0, 0), sess.conn.RemoteAddr()))
+	for {
+		sess.conn.SetReadDeadline(time.Unix(0, sess.last.Load()).Add(idle))
+		n, err := sess.conn.Read(buf[header:])
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, sess.last.Load())) < idle {
+				continue // the client sent a datagram meanwhile
+			}
+			return
+		}
+		sess.touch()
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		r.pc.WriteToUDP(buf[:header+n], client)
+	}
+}
+
+// remove ends a session.
+func (r *udpRelay) remove(target string, sess *udpSession) {
+	r.mu.Lock()
+	if r.sessions[target] == sess {
+		delete(r.sessions, target)
+	}
+	r.mu.Unlock()
+	sess.conn.Close()
+}
+
+// ------------------------------------------------------------------
+
+// close ends the association and waits for its goroutines to return.
+func (r *udpRelay) close() {
+	r.cancel()
+	r.mu.Lock()
+	r.closed = true
+	for _, sess := range r.sessions {
+		if sess.conn != nil {
+			sess.conn.Close()
+		}
+	}
+	r.mu.Unlock()
+	r.pc.Close()
+	r.wg.Wait()
+}
+
+// ------------------------------------------------------------------
+
+// parseDatagram parses the header of a datagram of a client, returning its
+// target and payload. Fragmented datagrams are not supported.
+func parseDatagram(b []byte) (target string, payload []byte, err error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		return "", nil, fmt.Errorf("%w: malformed UDP datagram", netproxy.ErrProtocol)
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("%w: fragmented UDP datagram", netproxy.ErrProtocol)
+	}
+	typ, b := b[3], b[4:]
+	var host string
+	switch typ {
+	case socks5IP4, socks5IP6:
+		n := net.IPv4len
+		if typ == socks5IP6 {
+			n = net.IPv6len
+		}
+		if len(b) < n+2 {
+			return "", nil, fmt.Errorf("%w: short UDP datagram", netproxy.ErrProtocol)
+		}
+		host, b = net.IP(b[:n]).String(), b[n:]
+	case socks5Domain:
+		if len(b) < 1 || len(b) < 1+int(b[0])+2 {
+			return "", nil, fmt.Errorf("%w: short UDP datagram", netproxy.ErrProtocol)
+		}
+		host, b = string(b[1:1+b[0]]), b[1+b[0]:]
+	default:
+		return "", nil, fmt.Errorf("%w: unknown address type %d", netproxy.ErrProtocol, typ)
+	}
+	port := int(b[0])<<8 | int(b[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), b[2:], nil
+}
@@ -0,0 +1,178 @@
+// (c) biter
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+)
+
+// udpEcho echoes the datagrams received on a new socket, which the caller
+// closes.
+func udpEcho(t *testing.T) *net.UDPConn {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP failed: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return pc
+}
+
+// udpAssociate sends a UDP ASSOCIATE request to the SOCKS5 server at addr,
+// and returns the control connection and the reply code and address.
+func udpAssociate(t *testing.T, addr string) (net.Conn, byte, *net.UDPAddr) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	b := make([]byte, 2+10)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return c, b[3], &net.UDPAddr{IP: net.IP(b[6:10]), Port: int(b[10])<<8 | int(b[11])}
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	target := udpEcho(t)
+	defer target.Close()
+	srv := NewSOCKS5(netproxy.Direct, WithUDPRelay(100*time.Millisecond, 0))
+	addr := startServer(t, srv)
+
+	c, code, relay := udpAssociate(t, addr)
+	defer c.Close()
+	if code != 0 {
+		t.Fatalf("got reply code %d, want 0", code)
+	}
+	pc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer pc.Close()
+
+	header := appendAddr([]byte{0, 0, 0}, target.LocalAddr())
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := pc.Write(append(header, msg...)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 1500)
+		n, err := pc.Read(b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if want := append(header, msg...); !bytes.Equal(b[:n], want) {
+			t.Errorf("got datagram %q, want %q", b[:n], want)
+		}
+	}
+
+	// The session expires without traffic.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.udpSlots) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP session did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stallDialer dials with netproxy.Direct, except the dials to stalled,
+// which last until their context is done.
+type stallDialer struct {
+	stalled string
+}
+
+func (d stallDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d stallDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr == d.stalled {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return netproxy.Direct.DialContext(ctx, network, addr)
+}
+
+func TestSOCKS5UDPStalledDial(t *testing.T) {
+	target := udpEcho(t)
+	defer target.Close()
+	srv := NewSOCKS5(stallDialer{stalled: "192.0.2.1:53"}, WithUDPRelay(0, 0))
+	addr := startServer(t, srv)
+
+	c, _, relay := udpAssociate(t, addr)
+	defer c.Close()
+	pc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %v", err)
+	}
+	defer pc.Close()
+
+	// A stalled session does not hold the datagrams for the others.
+	stalled := appendAddr([]byte{0, 0, 0}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53})
+	if _, err := pc.Write(append(stalled, "lost"...)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	header := appendAddr([]byte{0, 0, 0}, target.LocalAddr())
+	for _, msg := range []string{"ping", "pong"} {
+		pc.Write(append(header, msg...))
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	for _, msg := range []string{"ping", "pong"} {
+		b := make([]byte, 1500)
+		n, err := pc.Read(b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if want := append(header, msg...); !bytes.Equal(b[:n], want) {
+			t.Errorf("got datagram %q, want %q", b[:n], want)
+		}
+	}
+}
+
+func TestSOCKS5UDPDisabled(t *testing.T) {
+	addr := startServer(t, NewSOCKS5(netproxy.Direct))
+	c, code, _ := udpAssociate(t, addr)
+	defer c.Close()
+	if code != byte(netproxy.SOCKS5CommandNotSupported) {
+		t.Errorf("got reply code %d, want %d", code, netproxy.SOCKS5CommandNotSupported)
+	}
+}
+
+func TestParseDatagram(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		target  string
+		payload string
+	}{
+		{"\x00\x00\x00\x01\x7f\x00\x00\x01\x00\x35data", "127.0.0.1:53", "data"},
+		{"\x00\x00\x00\x03\x0bexample.com\x01\xbb", "example.com:443", ""},
+	} {
+		target, payload, err := parseDatagram([]byte(tt.in))
+		if err != nil || target != tt.target || string(payload) != tt.payload {
+			t.Errorf("parseDatagram(%q) = %q, %q, %v, want %q, %q", tt.in, target, payload, err, tt.target, tt.payload)
+		}
+	}
+	for _, in := range []string{"", "\x00\x00\x01\x01\x7f\x00\x00\x01\x00\x35", "\x00\x00\x00\x03\x0bexample", "\x00\x00\x00\x05"} {
+		if _, _, err := parseDatagram([]byte(in)); err == nil {
+			t.Errorf("parseDatagram(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// netDialer returns the net.Dialer making the direct connections configured
+// by o, which may be nil.
+func (o *Options) netDialer() *net.Dialer {
+	d := new(net.Dialer)
+	if o == nil {
+		return d
+	}
+	d.LocalAddr = o.LocalAddr
+	d.FallbackDelay = o.FallbackDelay
+	if o.KeepAlive != 0 || o.KeepAliveInterval != 0 {
+		d.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   o.KeepAlive >= 0,
+			Idle:     o.KeepAlive,
+			Interval: o.KeepAliveInterval,
+		}
+		if o.KeepAlive < 0 {
+			d.KeepAlive = -1
+		}
+	}
+	if o.MultipathTCP {
+		d.SetMultipathTCP(true)
+	}
+	if o.Interface != "" || o.Mark != 0 || o.FastOpen || o.Control != nil {
+		d.Control = o.control
+	}
+	return d
+}
+
+// ------------------------------------------------------------------
+
+// dialContext makes a direct connection configured by o, which may be nil.
+func (o *Options) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := o.netDialer().DialContext(ctx, network, addr)
+	if err != nil || o == nil {
+		return conn, err
+	}
+	if err := o.tune(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if o.ProxyProtocol != 0 {
+		if err := o.sendProxyHeader(ctx, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ------------------------------------------------------------------
+
+// tune applies the options of o that are set on a connected TCP socket.
+func (o *Options) tune(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.Nagle {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.ReceiveBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// control applies the socket options of o to a socket before it connects.
+func (o *Options) control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if o.Interface != "" {
+			if err = bindToInterface(fd, network, o.Interface); err != nil {
+				return
+			}
+		}
+		if o.Mark != 0 {
+			if err = setMark(fd, o.Mark); err != nil {
+				return
+			}
+		}
+		if o.FastOpen && strings.HasPrefix(network, "tcp") {
+			setFastOpen(fd)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+	if o.Control != nil {
+		return o.Control(network, address, c)
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// WithInterface binds the connections made directly, to the proxy or by
+// NewDirect, to the network interface name, e.g. "eth1" or "wg0", so that
+// traffic leaves via that interface whatever the routing table says. It is
+// supported on Linux (SO_BINDTODEVICE) and macOS (IP_BOUND_IF); elsewhere
+// dials fail.
+func WithInterface(name string) Option {
+	return func(o *Options) {
+		o.Interface = name
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithMark sets the firewall mark (SO_MARK) of the sockets of the
+// connections made directly, to the proxy or by NewDirect, for policy
+// routing, e.g. to exclude the connection to the proxy from a transparent
+// redirect. It is only supported on Linux and needs CAP_NET_ADMIN;
+// elsewhere dials fail.
+func WithMark(mark int) Option {
+	return func(o *Options) {
+		o.Mark = mark
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithControl calls f on the sockets of the connections made directly, to
+// the proxy or by NewDirect, after they are created and before they connect,
+// like net.Dialer.Control. It can set arbitrary socket options (TTL, TOS,
+// buffer sizes...). f runs after the options set by this package.
+func WithControl(f func(network, address string, c syscall.RawConn) error) Option {
+	return func(o *Options) {
+		o.Control = f
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithKeepAlive sets the TCP keep-alive of the connections made directly, to
+// the proxy or by NewDirect: idle is the time a connection stays idle before
+// the first probe, interval the time between probes; zero keeps the system
+// default of each. A negative idle disables keep-alives. The tunnel runs over
+// the connection to the proxy, so the probes also keep the NAT mappings of
+// an idle tunnel alive.
+func WithKeepAlive(idle, interval time.Duration) Option {
+	return func(o *Options) {
+		o.KeepAlive = idle
+		o.KeepAliveInterval = interval
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithNagle enables Nagle's algorithm on the TCP connections made directly,
+// to the proxy or by NewDirect, if enable is true. Go disables it
+// (TCP_NODELAY) by default, which suits latency-sensitive traffic; enabling
+// it trades latency for fewer small packets.
+func WithNagle(enable bool) Option {
+	return func(o *Options) {
+		o.Nagle = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithSocketBuffers sets the send (SO_SNDBUF) and receive (SO_RCVBUF) buffer
+// sizes in bytes of the TCP connections made directly, to the proxy or by
+// NewDirect; zero keeps the system default. The system may round or cap the
+// sizes.
+func WithSocketBuffers(send, receive int) Option {
+	return func(o *Options) {
+		o.SendBuffer = send
+		o.ReceiveBuffer = receive
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithMultipathTCP enables Multipath TCP on the TCP connections made
+// directly, to the proxy or by NewDirect, so that a long-lived tunnel
+// survives the loss of one of the links of a multi-homed host. Connections
+// fall back to plain TCP where MPTCP is not supported by the host or the
+// proxy.
+func WithMultipathTCP(enable bool) Option {
+	return func(o *Options) {
+		o.MultipathTCP = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithFastOpen enables TCP Fast Open on the TCP connections made directly,
+// to the proxy or by NewDirect, so that the SOCKS greeting or the CONNECT
+// request goes in the SYN to a proxy that accepts it, saving a round trip.
+// It is only effective on Linux 4.11+ and elsewhere does nothing. With Fast
+// Open, a refused connection to the proxy only shows at the first write, in
+// the handshake.
+func WithFastOpen(enable bool) Option {
+	return func(o *Options) {
+		o.FastOpen = enable
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithFallbackDelay sets how long a connection made directly, to the proxy or
+// by NewDirect, to a dual-stack host waits for the first address family
+// before racing the other one (RFC 8305 "Happy Eyeballs"). Zero is the
+// default of 300ms; a negative delay disables the race, so the addresses are
+// tried in turn.
+func WithFallbackDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.FallbackDelay = d
+	}
+}
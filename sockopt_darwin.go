@@ -0,0 +1,34 @@
+// (c) biter
+
+//go:build darwin
+
+package netproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ipv6BoundIf is IPV6_BOUND_IF from <netinet6/in6.h>.
+const ipv6BoundIf = 125
+
+func bindToInterface(fd uintptr, network, name string) error {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	switch network {
+	case "tcp6", "udp6":
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6BoundIf, ifi.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+}
+
+func setMark(fd uintptr, mark int) error {
+	return fmt.Errorf("proxy: setting the socket mark: %w on darwin", errors.ErrUnsupported)
+}
+
+// setFastOpen does nothing: TCP Fast Open needs connectx on darwin.
+func setFastOpen(fd uintptr) {}
@@ -0,0 +1,25 @@
+// (c) biter
+
+//go:build linux
+
+package netproxy
+
+import "syscall"
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT from <linux/tcp.h> (Linux 4.11+).
+const tcpFastOpenConnect = 30
+
+func bindToInterface(fd uintptr, network, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
+
+func setMark(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
+
+// setFastOpen enables TCP Fast Open on a socket before it connects: the
+// connect completes at once and the first write goes in the SYN. Kernels
+// without support leave the socket as it is.
+func setFastOpen(fd uintptr) {
+	syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
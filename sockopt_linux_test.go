@@ -0,0 +1,206 @@
+// (c) biter
+
+//go:build linux
+
+package netproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterface(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := NewDirect(WithInterface("lo")).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial bound to lo failed: %v", err)
+	}
+	c.Close()
+
+	if _, err := NewDirect(WithInterface("netproxy-none0")).Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Dial bound to a missing interface succeeded")
+	}
+}
+
+func TestMark(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := NewDirect(WithMark(0x42)).Dial("tcp", ln.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	if got := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_MARK); got != 0x42 {
+		t.Errorf("got mark %#x, want 0x42", got)
+	}
+}
+
+func TestControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	ttl := WithControl(func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, 7)
+		})
+		return err
+	})
+	c, err := NewDirect(ttl).Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	if got := getsockopt(t, c, syscall.IPPROTO_IP, syscall.IP_TTL); got != 7 {
+		t.Errorf("got TTL %d, want 7", got)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := NewDirect(WithKeepAlive(42*time.Second, 7*time.Second)).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	if got := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got != 1 {
+		t.Errorf("got SO_KEEPALIVE %d, want 1", got)
+	}
+	if got := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 42 {
+		t.Errorf("got TCP_KEEPIDLE %d, want 42", got)
+	}
+	if got := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); got != 7 {
+		t.Errorf("got TCP_KEEPINTVL %d, want 7", got)
+	}
+}
+
+func TestSocketTuning(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := NewDirect(WithNagle(true), WithSocketBuffers(64<<10, 32<<10)).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	if got := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != 0 {
+		t.Errorf("got TCP_NODELAY %d, want 0", got)
+	}
+	// Linux doubles the requested sizes for its bookkeeping.
+	if got := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < 64<<10 {
+		t.Errorf("got SO_SNDBUF %d, want >= %d", got, 64<<10)
+	}
+	if got := getsockopt(t, c, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < 32<<10 {
+		t.Errorf("got SO_RCVBUF %d, want >= %d", got, 32<<10)
+	}
+}
+
+func TestFastOpen(t *testing.T) {
+	endSystem, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer endSystem.Close()
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer gateway.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go socks5Gateway(t, gateway, endSystem, socks5IP4, &wg)
+
+	proxy, err := SOCKS5("tcp", gateway.Addr().String(), nil, Direct, time.Second, WithFastOpen(true))
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %v", err)
+	}
+	c, err := proxy.Dial("tcp", endSystem.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() {
+		c.Close()
+		wg.Wait()
+	}()
+
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+	})
+	if err != nil {
+		t.Skipf("TCP_FASTOPEN_CONNECT not supported: %v", err)
+	}
+	if v != 1 {
+		t.Errorf("got TCP_FASTOPEN_CONNECT %d, want 1", v)
+	}
+}
+
+func getsockopt(t *testing.T, c net.Conn, level, opt int) int {
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatalf("GetsockoptInt failed: %v", err)
+	}
+	return v
+}
+
+func TestSyscallConn(t *testing.T) {
+	gateway := echoGateway(t)
+	defer gateway.Close()
+
+	proxy, err := HTTPProxyDialer("tcp", gateway.Addr().String(), nil, Direct, time.Second,
+		WithNagle(true), WithConnStats(true), WithIdleTimeout(time.Minute), WithActivityDeadline(true), WithMetrics(new(recordingMetrics)))
+	if err != nil {
+		t.Fatalf("HTTPProxyDialer failed: %v", err)
+	}
+	c, err := proxy.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if v := getsockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Errorf("got TCP_NODELAY %d through %T, want 0", v, c)
+	}
+}
@@ -0,0 +1,22 @@
+// (c) biter
+
+//go:build !linux && !darwin
+
+package netproxy
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+func bindToInterface(fd uintptr, network, name string) error {
+	return fmt.Errorf("proxy: binding to an interface: %w on %s", errors.ErrUnsupported, runtime.GOOS)
+}
+
+func setMark(fd uintptr, mark int) error {
+	return fmt.Errorf("proxy: setting the socket mark: %w on %s", errors.ErrUnsupported, runtime.GOOS)
+}
+
+// setFastOpen does nothing: TCP Fast Open is only supported on Linux.
+func setFastOpen(fd uintptr) {}
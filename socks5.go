@@ -7,34 +7,54 @@ package netproxy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
 	"time"
 )
 
 // SOCKS5 returns a Dialer that makes SOCKSv5 connections to the given address
 // with an optional username and password. See RFC 1928 and RFC 1929.
-func SOCKS5(network, addr string, auth *Auth, forward Dialer, timeout time.Duration) (Dialer, error) {
+func SOCKS5(network, addr string, auth *Auth, forward Dialer, timeout time.Duration, opts ...Option) (Dialer, error) {
+	return newSOCKS5("socks5", network, addr, auth, forward, timeout, opts), nil
+}
+
+// SOCKS5TLS is like SOCKS5, but the connection to the proxy is made over
+// TLS first and the SOCKS5 negotiation runs inside it, as for the
+// "socks5s" scheme. See WithTLSConfig.
+func SOCKS5TLS(network, addr string, auth *Auth, forward Dialer, timeout time.Duration, opts ...Option) (Dialer, error) {
+	return newSOCKS5("socks5s", network, addr, auth, forward, timeout, opts), nil
+}
+
+func newSOCKS5(scheme, network, addr string, auth *Auth, forward Dialer, timeout time.Duration, opts []Option) *socks5 {
 	s := &socks5{
-		network: network,
-		addr:    addr,
-		forward: forward,
-		timeout: timeout, // add by biter
+		base: base{
+			scheme:  scheme,
+			network: network,
+			addr:    addr,
+			forward: forward,
+			timeout: timeout, // add by biter
+			opts:    newOptions(opts),
+		},
+	}
+	if scheme != "socks5" {
+		s.initTLS()
 	}
 	if auth != nil {
 		s.user = auth.User
 		s.password = auth.Password
 	}
 
-	return s, nil
+	return s
 }
 
 type socks5 struct {
+	base
 	user, password string
-	network, addr  string
-	forward        Dialer
-	timeout        time.Duration // add by biter
 }
 
 const socks5Version = 5
@@ -44,7 +64,10 @@ const (
 	socks5AuthPassword = 2
 )
 
-const socks5Connect = 1
+const (
+	socks5Connect = 1
+	socks5Bind    = 2
+)
 
 const (
 	socks5IP4    = 1
@@ -52,6 +75,27 @@ const (
 	socks5IP6    = 4
 )
 
+// SOCKS5Error is a reply code sent by a SOCKS5 proxy that failed to connect
+// to the target (RFC 1928, section 6). Errors returned by dials through a
+// SOCKS5 proxy wrap the reply code, so callers can test for a specific one:
+//
+//	if errors.Is(err, netproxy.SOCKS5HostUnreachable) { ... }
+type SOCKS5Error byte
+
+const socks5Succeeded = 0
+
+// SOCKS5 reply codes.
+const (
+	SOCKS5GeneralFailure          SOCKS5Error = 1
+	SOCKS5ConnectionNotAllowed    SOCKS5Error = 2
+	SOCKS5NetworkUnreachable      SOCKS5Error = 3
+	SOCKS5HostUnreachable         SOCKS5Error = 4
+	SOCKS5ConnectionRefused       SOCKS5Error = 5
+	SOCKS5TTLExpired              SOCKS5Error = 6
+	SOCKS5CommandNotSupported     SOCKS5Error = 7
+	SOCKS5AddressTypeNotSupported SOCKS5Error = 8
+)
+
 var socks5Errors = []string{
 	"",
 	"general failure",
@@ -64,55 +108,107 @@ var socks5Errors = []string{
 	"address type not supported",
 }
 
-// ------------------------------------------------------------------
-
-// DialContext - golang.org/x/net/proxy need to add DialContext
-func (s *socks5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	if ctx != nil {
-		if deadline, ok := ctx.Deadline(); ok {
-			s.timeout = deadline.Sub(time.Now())
-		}
+func (e SOCKS5Error) Error() string {
+	if int(e) < len(socks5Errors) && e != 0 {
+		return socks5Errors[e]
 	}
-	if s.timeout < 0 {
-		s.timeout = 1
+	return "unknown error " + strconv.Itoa(int(e))
+}
+
+// Temporary reports whether a later attempt may succeed: general failures,
+// unreachable networks and hosts and expired TTLs are transient conditions
+// on the proxy side, the other codes are not.
+func (e SOCKS5Error) Temporary() bool {
+	switch e {
+	case SOCKS5GeneralFailure, SOCKS5NetworkUnreachable, SOCKS5HostUnreachable, SOCKS5TTLExpired:
+		return true
 	}
-	return s.Dial(network, addr)
+	return false
 }
 
 // ------------------------------------------------------------------
 
-// Dial connects to the address addr on the given network via the SOCKS5 proxy.
-func (s *socks5) Dial(network, addr string) (net.Conn, error) {
+// DialContext - golang.org/x/net/proxy need to add DialContext
+func (s *socks5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp6", "tcp4", "udp", "udp4", "udp6":
 	default:
-		return nil, errors.New("proxy: no support for SOCKS5 proxy connections of type " + network)
+		return nil, s.opError("dial", network, addr, fmt.Errorf("%w %s for SOCKS5 proxy connections", ErrUnsupportedNetwork, network))
 	}
 
-	conn, err := s.forward.Dial(s.network, s.addr)
+	auth, err := s.credentials(ctx)
 	if err != nil {
-		return nil, err
+		return nil, s.opError("dial", network, addr, err)
 	}
+	return s.dial(ctx, network, addr, func(conn net.Conn, target string) (net.Conn, error) {
+		return conn, s.connect(conn, target, auth)
+	})
+}
 
-	if s.timeout > 0 {
-		err = conn.SetDeadline(time.Now().Add(s.timeout))
-		if err != nil {
-			conn.Close()
-			return nil, err
-		}
+// ------------------------------------------------------------------
+
+type authKey struct{}
+
+// ContextWithAuth returns a copy of ctx making the SOCKS5 dials with it
+// authenticate with auth instead of the credentials of the dialer. Tor
+// isolates the streams with different SOCKS5 credentials on different
+// circuits (IsolateSOCKSAuth), so giving each logical session its own
+// credentials gives it its own circuit:
+//
+//	ctx = netproxy.ContextWithAuth(ctx, &netproxy.Auth{User: sessionID, Password: "x"})
+//	conn, err := tor.DialContext(ctx, "tcp", "example.com:443")
+//
+// A nil auth, or one with an empty User, makes the dials unauthenticated.
+func ContextWithAuth(ctx context.Context, auth *Auth) context.Context {
+	if auth == nil {
+		auth = new(Auth)
 	}
+	return context.WithValue(ctx, authKey{}, *auth)
+}
 
-	if err := s.connect(conn, addr); err != nil {
-		conn.Close()
-		return nil, err
+// credentials returns the credentials of a dial with ctx: those of
+// WithDialAuth, of ContextWithAuth, of the CredentialsProvider, or of the
+// dialer.
+func (s *socks5) credentials(ctx context.Context) (Auth, error) {
+	if o := dialOptionsFrom(ctx); o != nil && o.auth != nil {
+		return *o.auth, nil
 	}
-	return conn, nil
+	if ctx != nil {
+		if auth, ok := ctx.Value(authKey{}).(Auth); ok {
+			return auth, nil
+		}
+	}
+	return s.base.credentials(ctx, Auth{User: s.user, Password: s.password})
+}
+
+// ------------------------------------------------------------------
+
+// Dial connects to the address addr on the given network via the SOCKS5 proxy.
+func (s *socks5) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
 }
 
 // connect takes an existing connection to a socks5 proxy server,
 // and commands the server to extend that connection to target,
 // which must be a canonical address with a host and port.
-func (s *socks5) connect(conn net.Conn, target string) error {
+func (s *socks5) connect(conn net.Conn, target string, auth Auth) error {
+	return s.request(conn, socks5Connect, target, auth, nil)
+}
+
+// socks5BufSize fits the largest message of the handshake: the
+// username/password request of RFC 1929.
+const socks5BufSize = 1 + 1 + 255 + 1 + 255
+
+// socks5Bufs pools the buffers of the handshakes, so that a dial allocates
+// none.
+var socks5Bufs = sync.Pool{
+	New: func() any { return new([socks5BufSize]byte) },
+}
+
+// request negotiates the authentication with auth on an existing connection
+// to a socks5 proxy server, sends the command cmd for target and, if bound
+// is not nil, stores the address of the reply in it.
+func (s *socks5) request(conn net.Conn, cmd byte, target string, auth Auth, bound *string) error {
 	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
 		return err
@@ -122,67 +218,83 @@ func (s *socks5) connect(conn net.Conn, target string) error {
 	if err != nil {
 		return errors.New("proxy: failed to parse port number: " + portStr)
 	}
-	if port < 1 || port > 0xffff {
+	if port < 0 || port > 0xffff || port == 0 && cmd == socks5Connect {
 		return errors.New("proxy: port number out of range: " + portStr)
 	}
 
-	// the size here is just an estimate
-	buf := make([]byte, 0, 6+len(host))
+	p := socks5Bufs.Get().(*[socks5BufSize]byte)
+	defer socks5Bufs.Put(p)
+	buf := p[:0]
 
 	buf = append(buf, socks5Version)
-	if len(s.user) > 0 && len(s.user) < 256 && len(s.password) < 256 {
+	password := len(auth.User) > 0 && len(auth.User) < 256 && len(auth.Password) < 256
+	if password {
 		buf = append(buf, 2 /* num auth methods */, socks5AuthNone, socks5AuthPassword)
 	} else {
 		buf = append(buf, 1 /* num auth methods */, socks5AuthNone)
 	}
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write greeting to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to write greeting to SOCKS5 proxy at %s: %w", s.addr, err)
 	}
 
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read greeting from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to read greeting from SOCKS5 proxy at %s: %w", s.addr, err)
 	}
 	if buf[0] != 5 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " has unexpected version " + strconv.Itoa(int(buf[0])))
+		return fmt.Errorf("%w: SOCKS5 proxy at %s has unexpected version %d", ErrProtocol, s.addr, buf[0])
 	}
 	if buf[1] == 0xff {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " requires authentication")
+		return fmt.Errorf("%w by SOCKS5 proxy at %s", ErrProxyAuthRequired, s.addr)
+	}
+	if err := s.checkMethod(buf[1], password); err != nil {
+		return err
 	}
 
 	// See RFC 1929
 	if buf[1] == socks5AuthPassword {
+		s.log(context.Background(), slog.LevelDebug, "netproxy: SOCKS5 username/password authentication")
 		buf = buf[:0]
 		buf = append(buf, 1 /* password protocol version */)
-		buf = append(buf, uint8(len(s.user)))
-		buf = append(buf, s.user...)
-		buf = append(buf, uint8(len(s.password)))
-		buf = append(buf, s.password...)
+		buf = append(buf, uint8(len(auth.User)))
+		buf = append(buf, auth.User...)
+		buf = append(buf, uint8(len(auth.Password)))
+		buf = append(buf, auth.Password...)
 
 		if _, err := conn.Write(buf); err != nil {
-			return errors.New("proxy: failed to write authentication request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return fmt.Errorf("proxy: failed to write authentication request to SOCKS5 proxy at %s: %w", s.addr, err)
 		}
 
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return errors.New("proxy: failed to read authentication reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return fmt.Errorf("proxy: failed to read authentication reply from SOCKS5 proxy at %s: %w", s.addr, err)
+		}
+		if err := s.checkAuthReply(buf[0]); err != nil {
+			return err
 		}
 
 		if buf[1] != 0 {
-			return errors.New("proxy: SOCKS5 proxy at " + s.addr + " rejected username/password")
+			return fmt.Errorf("%w: SOCKS5 proxy at %s rejected username/password", ErrProxyAuthFailed, s.addr)
 		}
 	}
 
 	buf = buf[:0]
-	buf = append(buf, socks5Version, socks5Connect, 0 /* reserved */)
+	buf = append(buf, socks5Version, cmd, 0 /* reserved */)
 
-	if ip := net.ParseIP(host); ip != nil {
-		if ip4 := ip.To4(); ip4 != nil {
+	// Parsing a host name as an IP address would allocate its error.
+	var ip netip.Addr
+	if maybeIP(host) {
+		ip, _ = netip.ParseAddr(host)
+	}
+	if ip.IsValid() && ip.Zone() == "" {
+		if ip = ip.Unmap(); ip.Is4() {
+			a := ip.As4()
 			buf = append(buf, socks5IP4)
-			ip = ip4
+			buf = append(buf, a[:]...)
 		} else {
+			a := ip.As16()
 			buf = append(buf, socks5IP6)
+			buf = append(buf, a[:]...)
 		}
-		buf = append(buf, ip...)
 	} else {
 		if len(host) > 255 {
 			return errors.New("proxy: destination host name too long: " + host)
@@ -194,51 +306,75 @@ func (s *socks5) connect(conn net.Conn, target string) error {
 	buf = append(buf, byte(port>>8), byte(port))
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to write request to SOCKS5 proxy at %s: %w", s.addr, err)
 	}
 
-	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + s.addr + ": " + err.Error())
-	}
+	return s.readReply(conn, bound)
+}
 
-	failure := "unknown error"
-	if int(buf[1]) < len(socks5Errors) {
-		failure = socks5Errors[buf[1]]
+// readReply reads a reply of the socks5 proxy server on conn and, if bound
+// is not nil, stores its address in it.
+func (s *socks5) readReply(conn net.Conn, bound *string) error {
+	p := socks5Bufs.Get().(*[socks5BufSize]byte)
+	defer socks5Bufs.Put(p)
+	buf := p[:4]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("proxy: failed to read reply from SOCKS5 proxy at %s: %w", s.addr, err)
+	}
+	if err := s.checkReply(buf); err != nil {
+		return err
 	}
 
-	if len(failure) > 0 {
-		return errors.New("proxy: SOCKS5 proxy at " + s.addr + " failed to connect: " + failure)
+	if buf[1] != socks5Succeeded {
+		return fmt.Errorf("%w: SOCKS5 proxy at %s failed to connect: %w", ErrTargetRefusedByProxy, s.addr, SOCKS5Error(buf[1]))
 	}
 
-	bytesToDiscard := 0
+	addrLen := 0
 	switch buf[3] {
 	case socks5IP4:
-		bytesToDiscard = net.IPv4len
+		addrLen = net.IPv4len
 	case socks5IP6:
-		bytesToDiscard = net.IPv6len
+		addrLen = net.IPv6len
 	case socks5Domain:
 		_, err := io.ReadFull(conn, buf[:1])
 		if err != nil {
-			return errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+			return fmt.Errorf("proxy: failed to read domain length from SOCKS5 proxy at %s: %w", s.addr, err)
+		}
+		addrLen = int(buf[0])
+		if err := s.checkDomain(addrLen); err != nil {
+			return err
 		}
-		bytesToDiscard = int(buf[0])
 	default:
-		return errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + s.addr)
+		return fmt.Errorf("%w: got unknown address type %d from SOCKS5 proxy at %s", ErrProtocol, buf[3], s.addr)
 	}
+	typ := buf[3]
 
-	if cap(buf) < bytesToDiscard {
-		buf = make([]byte, bytesToDiscard)
-	} else {
-		buf = buf[:bytesToDiscard]
-	}
+	buf = buf[:addrLen+2]
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return errors.New("proxy: failed to read address from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+		return fmt.Errorf("proxy: failed to read address from SOCKS5 proxy at %s: %w", s.addr, err)
 	}
-
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read port from SOCKS5 proxy at " + s.addr + ": " + err.Error())
+	if bound == nil {
+		return nil
 	}
 
+	host := string(buf[:addrLen])
+	if typ != socks5Domain {
+		host = net.IP(buf[:addrLen]).String()
+	}
+	port := int(buf[addrLen])<<8 | int(buf[addrLen+1])
+	*bound = net.JoinHostPort(host, strconv.Itoa(port))
 	return nil
 }
+
+// maybeIP reports whether host may be an IP address rather than a name: it
+// has a colon or only digits and dots.
+func maybeIP(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c == ':' {
+			return true
+		} else if c != '.' && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvTTL is how long the SRV records of a "srv+" proxy URL are kept.
+const srvTTL = time.Minute
+
+// SRVResolver looks up SRV records. *net.Resolver implements it. The
+// Resolver of WithResolver, if it implements SRVResolver, is used for the
+// "srv+" schemes of FromURL instead of net.DefaultResolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// ------------------------------------------------------------------
+
+// srvDialer is the Dialer of a "srv+<scheme>" URL: it dials the proxies of
+// the SRV records of the URL host, e.g. "_socks._tcp.example.com", in the
+// order of their priority and weight, until one of them succeeds.
+type srvDialer struct {
+	url      *url.URL // the proxy URL of the endpoints, without the host
+	name     string
+	forward  Dialer
+	timeout  time.Duration
+	opts     []Option
+	resolver SRVResolver
+
+	mu      sync.Mutex
+	records []*net.SRV
+	expires time.Time
+	dialers map[string]Dialer // by endpoint address
+	now     func() time.Time
+	intn    func(n int) int // rand.IntN
+}
+
+// newSRVDialer returns the dialer of u, a "srv+<scheme>" URL.
+func newSRVDialer(u *url.URL, forward Dialer, timeout time.Duration, opts []Option) (Dialer, error) {
+	scheme := schemeAlias(strings.TrimPrefix(u.Scheme, "srv+"))
+	if u.Hostname() == "" || u.Port() != "" {
+		return nil, fmt.Errorf("proxy: invalid proxy URL %q: want a SRV name as host", u.Redacted())
+	}
+	switch _, ok := registeredScheme(scheme); {
+	case ok, scheme == "socks5", scheme == "socks5s", scheme == "socks5+tls", scheme == "http", scheme == "https":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, u.Scheme)
+	}
+	d := &srvDialer{
+		url:      &url.URL{Scheme: scheme, User: u.User, Path: u.Path, RawQuery: u.RawQuery},
+		name:     u.Hostname(),
+		forward:  forward,
+		timeout:  timeout,
+		opts:     opts,
+		resolver: net.DefaultResolver,
+		dialers:  make(map[string]Dialer),
+		now:      time.Now,
+		intn:     rand.IntN,
+	}
+	if r, ok := newOptions(opts).Resolver.(SRVResolver); ok {
+		d.resolver = r
+	}
+	return d, nil
+}
+
+// ------------------------------------------------------------------
+
+func (d *srvDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials addr through the proxies of the SRV records in turn.
+// It fails over to the next one on the failures of a proxy, not on those
+// of the target, which the next one would fail as well.
+func (d *srvDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	endpoints, err := d.endpoints(ctx)
+	if err != nil {
+		return nil, &OpError{Op: "resolve", Scheme: "srv+" + d.url.Scheme, Proxy: d.name, Err: err}
+	}
+	for _, endpoint := range endpoints {
+		var pd Dialer
+		pd, err = d.dialer(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		conn, err = pd.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrTargetRefusedByProxy) || errors.Is(err, ErrUnsupportedNetwork) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// ------------------------------------------------------------------
+
+// endpoints returns the proxy addresses of the SRV records, in the order
+// of RFC 2782: by priority, and at random among the records of a priority
+// in proportion to their weight.
+func (d *srvDialer) endpoints(ctx context.Context) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.records == nil || !d.now().Before(d.expires) {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		// A single record with the target "." means no service.
+		records = slices.DeleteFunc(records, func(r *net.SRV) bool { return r.Target == "." })
+		if len(records) == 0 {
+			return nil, fmt.Errorf("proxy: no SRV records for %s", d.name)
+		}
+		d.records, d.expires = records, d.now().Add(srvTTL)
+		for endpoint := range d.dialers {
+			if !slices.ContainsFunc(records, func(r *net.SRV) bool { return srvEndpoint(r) == endpoint }) {
+				delete(d.dialers, endpoint)
+			}
+		}
+	}
+
+	records := slices.Clone(d.records)
+	slices.SortStableFunc(records, func(a, b *net.SRV) int { return int(a.Priority) - int(b.Priority) })
+	endpoints := make([]string, 0, len(records))
+	for len(records) > 0 {
+		// The records of the lowest priority left.
+		n := 1
+		for n < len(records) && records[n].Priority == records[0].Priority {
+			n++
+		}
+		group := records[:n]
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.Weight)
+			}
+			i := 0
+			if total > 0 {
+				sum, pick := 0, d.intn(total)
+				for i = range group {
+					if sum += int(group[i].Weight); pick < sum {
+						break
+					}
+				}
+			}
+			endpoints = append(endpoints, srvEndpoint(group[i]))
+			group = slices.Delete(group, i, i+1)
+		}
+		records = records[n:]
+	}
+	return endpoints, nil
+}
+
+// srvEndpoint returns the proxy address of r.
+func srvEndpoint(r *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+}
+
+// ------------------------------------------------------------------
+
+// Close closes the dialers of the endpoints which implement io.Closer, see
+// CloseDialer, and forgets them.
+func (d *srvDialer) Close() error {
+	d.mu.Lock()
+	dialers := d.dialers
+	d.dialers = make(map[string]Dialer)
+	d.mu.Unlock()
+	var errs []error
+	for _, pd := range dialers {
+		errs = append(errs, CloseDialer(pd))
+	}
+	return errors.Join(errs...)
+}
+
+// dialer returns the dialer of the proxy at endpoint, made once.
+func (d *srvDialer) dialer(endpoint string) (Dialer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pd, ok := d.dialers[endpoint]; ok {
+		return pd, nil
+	}
+	u := *d.url
+	u.Host = endpoint
+	pd, err := FromURL(&u, d.forward, d.timeout, d.opts...)
+	if err != nil {
+		return nil, err
+	}
+	d.dialers[endpoint] = pd
+	return pd, nil
+}
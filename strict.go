@@ -0,0 +1,88 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// WithStrictProtocol, if strict is true, makes the SOCKS5 and HTTP proxy
+// dialers check that the replies of their proxies conform to the RFCs, and
+// fail at the first deviation with an error wrapping ErrProtocol, rather
+// than making the most of them: some "proxies" in the wild are honeypots or
+// broken middleboxes sending garbage. The SOCKS5 replies (RFC 1928, 1929)
+// must have the right versions, a method offered by the client, a zero
+// reserved byte, a known reply code and a non-empty domain; the CONNECT
+// responses (RFC 9110) must be HTTP/1.x, with at most 16 KiB of header,
+// and no Content-Length nor Transfer-Encoding when successful.
+func WithStrictProtocol(strict bool) Option {
+	return func(o *Options) {
+		o.StrictProtocol = strict
+	}
+}
+
+// ------------------------------------------------------------------
+
+// strictMaxHeaderBytes bounds the header of the CONNECT responses in strict
+// mode.
+const strictMaxHeaderBytes = 16 << 10
+
+// checkMethod checks the authentication method chosen by the socks5 proxy
+// server, password if offered.
+func (s *socks5) checkMethod(method byte, password bool) error {
+	if !s.opts.StrictProtocol || method == socks5AuthNone || method == 0xff || method == socks5AuthPassword && password {
+		return nil
+	}
+	return fmt.Errorf("%w: SOCKS5 proxy at %s chose the authentication method %d, which was not offered", ErrProtocol, s.addr, method)
+}
+
+// checkAuthReply checks the version of the username/password
+// authentication reply of the socks5 proxy server.
+func (s *socks5) checkAuthReply(version byte) error {
+	if !s.opts.StrictProtocol || version == 1 {
+		return nil
+	}
+	return fmt.Errorf("%w: SOCKS5 proxy at %s has unexpected authentication version %d", ErrProtocol, s.addr, version)
+}
+
+// checkReply checks the version, the reply code and the reserved byte of
+// the reply of the socks5 proxy server, the first 4 bytes of which are
+// head.
+func (s *socks5) checkReply(head []byte) error {
+	if !s.opts.StrictProtocol {
+		return nil
+	}
+	switch {
+	case head[0] != socks5Version:
+		return fmt.Errorf("%w: SOCKS5 proxy at %s has unexpected version %d in its reply", ErrProtocol, s.addr, head[0])
+	case head[1] > 8:
+		return fmt.Errorf("%w: SOCKS5 proxy at %s sent the unknown reply code %d", ErrProtocol, s.addr, head[1])
+	case head[2] != 0:
+		return fmt.Errorf("%w: SOCKS5 proxy at %s sent the reserved byte %d, want 0", ErrProtocol, s.addr, head[2])
+	}
+	return nil
+}
+
+// checkDomain checks the length of a domain in the reply of the socks5
+// proxy server.
+func (s *socks5) checkDomain(n int) error {
+	if !s.opts.StrictProtocol || n > 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: SOCKS5 proxy at %s sent an empty domain", ErrProtocol, s.addr)
+}
+
+// checkResponse checks the CONNECT response of the HTTP proxy.
+func (s *httpProxy) checkResponse(resp *http.Response) error {
+	if !s.opts.StrictProtocol {
+		return nil
+	}
+	switch {
+	case resp.ProtoMajor != 1:
+		return fmt.Errorf("%w: HTTP proxy at %s answered with %s, want HTTP/1.x", ErrProtocol, s.addr, resp.Proto)
+	case resp.StatusCode/100 == 2 && !s.http10(resp) && (resp.Header.Get("Content-Length") != "" || len(resp.TransferEncoding) > 0):
+		return fmt.Errorf("%w: HTTP proxy at %s sent a body with its successful CONNECT response", ErrProtocol, s.addr)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TLSHandshaker runs the TLS handshake with proxies reached over TLS and
+// returns the TLS connection. cfg is the configuration the package would
+// use with crypto/tls. The default uses crypto/tls; the utls subpackage
+// provides one mimicking the ClientHello of common browsers.
+type TLSHandshaker interface {
+	Handshake(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error)
+}
+
+// ------------------------------------------------------------------
+
+// WithTLSHandshaker replaces crypto/tls by h for the TLS handshake with
+// proxies reached over TLS.
+func WithTLSHandshaker(h TLSHandshaker) Option {
+	return func(o *Options) {
+		o.TLSHandshaker = h
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithTLSConfig sets the TLS configuration used to connect to proxies
+// reached over TLS, such as "https" ones: root CAs, minimum version, cipher
+// suites... The config is cloned; if its ServerName is empty, the host of
+// the proxy address is used.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *Options) {
+		o.TLSConfig = cfg
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithServerName sets the SNI sent to proxies reached over TLS, independently
+// of the proxy host and of the target, e.g. for proxies behind a shared TLS
+// terminator. The proxy certificate is verified against name. It takes
+// precedence over the ServerName of WithTLSConfig.
+func WithServerName(name string) Option {
+	return func(o *Options) {
+		o.ServerName = name
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithClientCertificate presents cert to proxies that authenticate clients
+// by TLS certificate.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(o *Options) {
+		o.ClientCertificate = &cert
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithGetClientCertificate calls f to obtain the certificate presented to
+// proxies that request one, see tls.Config.GetClientCertificate. It takes
+// precedence over WithClientCertificate.
+func WithGetClientCertificate(f func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) Option {
+	return func(o *Options) {
+		o.GetClientCertificate = f
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithPinnedKeys accepts a TLS connection to the proxy only if the public
+// key of its certificate matches one of pins, in addition to the usual
+// verification (unless TLSConfig.InsecureSkipVerify is set). A pin is
+// "sha256/" followed by the base64 SHA-256 hash of the DER encoded
+// SubjectPublicKeyInfo, the format used by curl --pinnedpubkey; see
+// SPKIPin.
+func WithPinnedKeys(pins ...string) Option {
+	return func(o *Options) {
+		o.PinnedKeys = append(o.PinnedKeys, pins...)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// SPKIPin returns the pin of the public key of cert, as accepted by
+// WithPinnedKeys.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ------------------------------------------------------------------
+
+// verifyPins checks the certificate presented by the proxy against pins.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: no certificate presented", ErrCertificatePin)
+		}
+		pin := SPKIPin(cs.PeerCertificates[0])
+		for _, p := range pins {
+			if strings.TrimSpace(p) == pin {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: got %s", ErrCertificatePin, pin)
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithClientSessionCache sets the cache of TLS sessions used to resume
+// sessions with proxies reached over TLS, so that dialers can share one. By
+// default each such dialer has its own cache, see ClientSessionCache.
+func WithClientSessionCache(cache tls.ClientSessionCache) Option {
+	return func(o *Options) {
+		o.ClientSessionCache = cache
+	}
+}
+
+// ------------------------------------------------------------------
+
+// ClientSessionCache returns the TLS session cache of d, or nil if d is not
+// a dialer of this package reaching its proxy over TLS. It can be passed to
+// WithClientSessionCache or a tls.Config to share the sessions.
+func ClientSessionCache(d Dialer) tls.ClientSessionCache {
+	if s, ok := d.(interface{ sessionCache() tls.ClientSessionCache }); ok {
+		return s.sessionCache()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// WithKeyLogWriter writes the TLS key material of connections to proxies
+// reached over TLS to w, in NSS key log format, so that captures can be
+// decrypted by tools like Wireshark. It compromises the security of the
+// connections and is meant for debugging only.
+func WithKeyLogWriter(w io.Writer) Option {
+	return func(o *Options) {
+		o.KeyLogWriter = w
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithSSLKeyLogFile writes the TLS key material like WithKeyLogWriter, to
+// the file named by the SSLKEYLOGFILE environment variable. It does nothing
+// if the variable is not set.
+func WithSSLKeyLogFile() Option {
+	return func(o *Options) {
+		if w := sslKeyLogFile(); w != nil {
+			o.KeyLogWriter = w
+		}
+	}
+}
+
+var (
+	keyLogOnce sync.Once
+	keyLog     io.Writer
+)
+
+// sslKeyLogFile opens the SSLKEYLOGFILE once for the process.
+func sslKeyLogFile() io.Writer {
+	keyLogOnce.Do(func() {
+		name := keyLogEnv.Get()
+		if name == "" {
+			return
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return
+		}
+		keyLog = f
+	})
+	return keyLog
+}
+
+// ------------------------------------------------------------------
+
+// initTLS sets up the TLS state of a dialer reaching its proxy over TLS.
+func (b *base) initTLS() {
+	b.tls = true
+	b.sessions = b.opts.ClientSessionCache
+	if b.sessions == nil {
+		b.sessions = tls.NewLRUClientSessionCache(0)
+	}
+}
+
+func (b *base) sessionCache() tls.ClientSessionCache {
+	return b.sessions
+}
+
+// ------------------------------------------------------------------
+
+// tlsConfig returns the TLS configuration for the connection to the proxy.
+func (b *base) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if b.opts.TLSConfig != nil {
+		cfg = b.opts.TLSConfig.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if b.opts.ClientCertificate != nil {
+		cfg.Certificates = append(cfg.Certificates[:len(cfg.Certificates):len(cfg.Certificates)], *b.opts.ClientCertificate)
+	}
+	if b.opts.GetClientCertificate != nil {
+		cfg.GetClientCertificate = b.opts.GetClientCertificate
+	}
+	if pins := b.opts.PinnedKeys; len(pins) > 0 {
+		verify := verifyPins(pins)
+		if next := cfg.VerifyConnection; next != nil {
+			cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+				if err := next(cs); err != nil {
+					return err
+				}
+				return verify(cs)
+			}
+		} else {
+			cfg.VerifyConnection = verify
+		}
+	}
+	if b.opts.ServerName != "" {
+		cfg.ServerName = b.opts.ServerName
+	}
+	if cfg.KeyLogWriter == nil {
+		cfg.KeyLogWriter = b.opts.KeyLogWriter
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = b.sessions
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(b.addr)
+		if err != nil {
+			host = b.addr
+		}
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// ------------------------------------------------------------------
+
+// tlsHandshake runs the TLS handshake with the proxy over conn.
+func (b *base) tlsHandshake(ctx context.Context, conn net.Conn, network, target string) (_ net.Conn, err error) {
+	ctx, end := b.trace(ctx, PhaseTLS, network, target)
+	defer func() { end(PhaseEnd{Err: err}) }()
+
+	if h := b.opts.TLSHandshaker; h != nil {
+		var c net.Conn
+		if c, err = h.Handshake(ctx, conn, b.tlsConfig()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	tc := tls.Client(conn, b.tlsConfig())
+	if err = tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
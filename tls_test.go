@@ -0,0 +1,315 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTLSProxy starts an HTTPS proxy answering every CONNECT with 200 OK
+// and then closing the tunnel. cfg, if not nil, is its TLS configuration.
+func newTLSProxy(t *testing.T, cfg *tls.Config) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+	}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	return srv
+}
+
+func dialTLSProxy(t *testing.T, srv *httptest.Server, opts ...Option) error {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	proxy, err := FromURL(u, Direct, time.Second, opts...)
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	c, err := proxy.Dial("tcp", "example.com:443")
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := newTLSProxy(t, nil)
+	defer srv.Close()
+
+	if err := dialTLSProxy(t, srv); err == nil {
+		t.Error("dial succeeded with an unknown CA")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	if err := dialTLSProxy(t, srv, WithTLSConfig(&tls.Config{RootCAs: pool})); err != nil {
+		t.Errorf("dial failed: %v", err)
+	}
+}
+
+// selfSigned returns a self-signed certificate, valid for ips.
+func selfSigned(t *testing.T, ips ...net.IP) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netproxy test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert := selfSigned(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert.Leaf)
+	srv := newTLSProxy(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs})
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	rootCAs := WithTLSConfig(&tls.Config{RootCAs: pool})
+	if err := dialTLSProxy(t, srv, rootCAs); err == nil {
+		t.Error("dial succeeded without a client certificate")
+	}
+	if err := dialTLSProxy(t, srv, rootCAs, WithClientCertificate(cert)); err != nil {
+		t.Errorf("dial with WithClientCertificate failed: %v", err)
+	}
+	get := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+	if err := dialTLSProxy(t, srv, rootCAs, WithGetClientCertificate(get)); err != nil {
+		t.Errorf("dial with WithGetClientCertificate failed: %v", err)
+	}
+}
+
+func TestPinnedKeys(t *testing.T) {
+	srv := newTLSProxy(t, nil)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	rootCAs := WithTLSConfig(&tls.Config{RootCAs: pool})
+	if err := dialTLSProxy(t, srv, rootCAs, WithPinnedKeys(SPKIPin(srv.Certificate()))); err != nil {
+		t.Errorf("dial with the right pin failed: %v", err)
+	}
+	err := dialTLSProxy(t, srv, rootCAs, WithPinnedKeys(SPKIPin(selfSigned(t).Leaf)))
+	if !errors.Is(err, ErrCertificatePin) {
+		t.Errorf("got error %v, want %v", err, ErrCertificatePin)
+	}
+	insecure := WithTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	if err := dialTLSProxy(t, srv, insecure, WithPinnedKeys(SPKIPin(srv.Certificate()))); err != nil {
+		t.Errorf("dial with pin only failed: %v", err)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	sni := make(chan string, 1)
+	srv := newTLSProxy(t, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}})
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	if err := dialTLSProxy(t, srv, WithTLSConfig(&tls.Config{RootCAs: pool}), WithServerName("example.com")); err != nil {
+		t.Errorf("dial failed: %v", err)
+	}
+	if got := <-sni; got != "example.com" {
+		t.Errorf("got SNI %q, want example.com", got)
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	srv := newTLSProxy(t, nil)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	var resumed []bool
+	proxy, err := FromURL(u, Direct, time.Second, WithTLSConfig(&tls.Config{
+		RootCAs: pool,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			resumed = append(resumed, cs.DidResume)
+			return nil
+		},
+	}))
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	if ClientSessionCache(proxy) == nil {
+		t.Fatal("no session cache")
+	}
+	for i := 0; i < 2; i++ {
+		c, err := proxy.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		// Read the session ticket sent after the handshake.
+		c.Read(make([]byte, 1))
+		c.Close()
+	}
+	if len(resumed) != 2 || resumed[0] || !resumed[1] {
+		t.Errorf("got resumptions %v, want [false true]", resumed)
+	}
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	srv := newTLSProxy(t, nil)
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	var buf bytes.Buffer
+	if err := dialTLSProxy(t, srv, WithTLSConfig(&tls.Config{RootCAs: pool}), WithKeyLogWriter(&buf)); err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Errorf("no key material logged, got %q", buf.String())
+	}
+}
+
+func TestSOCKS5TLS(t *testing.T) {
+	endSystem, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer endSystem.Close()
+	cert := selfSigned(t, net.IPv4(127, 0, 0, 1))
+	gateway, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %v", err)
+	}
+	defer gateway.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go socks5Gateway(t, gateway, endSystem, socks5IP4, &wg)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	u := &url.URL{Scheme: "socks5+tls", Host: gateway.Addr().String()}
+	proxy, err := FromURL(u, Direct, time.Second, WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("FromURL failed: %v", err)
+	}
+	c, err := proxy.Dial("tcp", endSystem.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if _, ok := c.(*tls.Conn); !ok {
+		t.Errorf("got %T, want *tls.Conn", c)
+	}
+	c.Close()
+	wg.Wait()
+}
+
+func TestDNSResolver(t *testing.T) {
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.9")}
+	lookup := func(r *net.Resolver) {
+		t.Helper()
+		ips, err := r.LookupNetIP(context.Background(), "ip4", "encrypted.example.")
+		if err != nil {
+			t.Fatalf("LookupNetIP failed: %v", err)
+		}
+		if !slices.Equal(ips, want) {
+			t.Errorf("got %v, want %v", ips, want)
+		}
+	}
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(q, net.IPv4(192, 0, 2, 9)))
+	}))
+	defer doh.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+	r, err := DNSResolver(doh.URL+"/dns-query", Direct, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("DNSResolver failed: %v", err)
+	}
+	lookup(r)
+
+	cert := selfSigned(t, net.IPv4(127, 0, 0, 1))
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveDNS(c, net.IPv4(192, 0, 2, 9))
+		}
+	}()
+	roots = x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	r, err = DNSResolver("tls://"+ln.Addr().String(), Direct, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("DNSResolver failed: %v", err)
+	}
+	lookup(r)
+
+	if _, err := DNSResolver("udp://1.1.1.1", Direct, nil); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedScheme)
+	}
+}
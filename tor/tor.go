@@ -0,0 +1,347 @@
+// (c) biter
+
+// Package tor talks to the control port of Tor, to authenticate, request
+// new identities (SIGNAL NEWNYM) and follow the stream and circuit events,
+// and provides a dialer requesting a new identity after a number of dials.
+//
+//	c, err := tor.Dial(ctx, "tcp", "127.0.0.1:9051")
+//	...
+//	err = c.Authenticate("")
+//	...
+//	socks, _ := netproxy.SOCKS5("tcp", "127.0.0.1:9050", nil, netproxy.Direct, timeout)
+//	d := tor.NewDialer(socks, c, 100)
+package tor
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/biter777/netproxy"
+)
+
+// ReplyError is the error returned for a command refused by Tor.
+type ReplyError struct {
+	Code int    // status code, e.g. 515 for a failed authentication
+	Text string // text of the reply
+}
+
+func (e *ReplyError) Error() string {
+	return "tor: " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// Event is an asynchronous event of Tor, see SetEvents.
+type Event struct {
+	Type string // e.g. "STREAM" or "CIRC"
+	Data string // the rest of the event, lines separated by "\n"
+}
+
+// reply is a reply of Tor: its status code and lines, without the codes.
+type reply struct {
+	code  int
+	lines []string
+}
+
+// ------------------------------------------------------------------
+
+// Controller is a connection to the control port of Tor. It is safe for
+// concurrent use; commands are sent one at a time.
+type Controller struct {
+	conn    net.Conn
+	replies chan reply
+	err     error // read error, once replies is closed
+
+	mu      sync.Mutex // serializes the commands
+	handler atomic.Pointer[func(Event)]
+}
+
+// Dial connects to the control port of Tor at addr.
+func Dial(ctx context.Context, network, addr string) (*Controller, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewController(conn), nil
+}
+
+// NewController returns a Controller speaking over conn, a connection to the
+// control port of Tor.
+func NewController(conn net.Conn) *Controller {
+	c := &Controller{conn: conn, replies: make(chan reply)}
+	go c.read(textproto.NewReader(bufio.NewReader(conn)))
+	return c
+}
+
+// Close closes the connection to Tor.
+func (c *Controller) Close() error {
+	return c.conn.Close()
+}
+
+// ------------------------------------------------------------------
+
+// read reads the replies of Tor, passing the events to the handler, until
+// the connection fails.
+func (c *Controller) read(r *textproto.Reader) {
+	defer close(c.replies)
+	for {
+		rep, err := readReply(r)
+		if err != nil {
+			c.err = fmt.Errorf("tor: reading reply: %w", err)
+			return
+		}
+		if rep.code != 650 {
+			c.replies <- rep
+			continue
+		}
+		if h := c.handler.Load(); h != nil {
+			typ, data, _ := strings.Cut(strings.Join(rep.lines, "\n"), " ")
+			(*h)(Event{Type: typ, Data: data})
+		}
+	}
+}
+
+// readReply reads a reply: lines "code-text" or "code+text" followed by a
+// data block, ended by a line "code text".
+func readReply(r *textproto.Reader) (reply, error) {
+	var rep reply
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return rep, err
+		}
+		if len(line) < 4 {
+			return rep, fmt.Errorf("malformed line %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return rep, fmt.Errorf("malformed line %q", line)
+		}
+		rep.code = code
+		text := line[4:]
+		switch line[3] {
+		case ' ':
+			rep.lines = append(rep.lines, text)
+			return rep, nil
+		case '-':
+			rep.lines = append(rep.lines, text)
+		case '+':
+			data, err := r.ReadDotLines()
+			if err != nil {
+				return rep, err
+			}
+			rep.lines = append(rep.lines, text+"\n"+strings.Join(data, "\n"))
+		default:
+			return rep, fmt.Errorf("malformed line %q", line)
+		}
+	}
+}
+
+// ------------------------------------------------------------------
+
+// command sends a command line and returns the lines of its reply, failing
+// if its code is not 250.
+func (c *Controller) command(line string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		return nil, fmt.Errorf("tor: sending command: %w", err)
+	}
+	rep, ok := <-c.replies
+	if !ok {
+		return nil, c.err
+	}
+	if rep.code != 250 {
+		return nil, &ReplyError{Code: rep.code, Text: strings.Join(rep.lines, "\n")}
+	}
+	return rep.lines, nil
+}
+
+// ------------------------------------------------------------------
+
+// Authenticate authenticates the controller with the first method Tor
+// offers of: the password if not empty (HashedControlPassword), the
+// authentication cookie (CookieAuthentication, with SAFECOOKIE if
+// possible), or none.
+func (c *Controller) Authenticate(password string) error {
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods, cookieFile string
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "AUTH "); ok {
+			methods, cookieFile = parseAuth(rest)
+		}
+	}
+	has := func(m string) bool {
+		return strings.Contains(","+methods+",", ","+m+",")
+	}
+
+	switch {
+	case password != "" && has("HASHEDPASSWORD"):
+		_, err = c.command("AUTHENTICATE " + hex.EncodeToString([]byte(password)))
+	case has("SAFECOOKIE") && cookieFile != "":
+		err = c.safeCookie(cookieFile)
+	case has("COOKIE") && cookieFile != "":
+		var cookie []byte
+		if cookie, err = os.ReadFile(cookieFile); err != nil {
+			return fmt.Errorf("tor: reading the authentication cookie: %w", err)
+		}
+		_, err = c.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+	case has("NULL"):
+		_, err = c.command("AUTHENTICATE")
+	default:
+		return fmt.Errorf("tor: no usable authentication method in %q", methods)
+	}
+	return err
+}
+
+// parseAuth parses the AUTH line of PROTOCOLINFO:
+//
+//	METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/control.authcookie"
+func parseAuth(s string) (methods, cookieFile string) {
+	if rest, ok := strings.CutPrefix(s, "METHODS="); ok {
+		methods, _, _ = strings.Cut(rest, " ")
+	}
+	if _, rest, ok := strings.Cut(s, ` COOKIEFILE="`); ok {
+		for i := 0; i < len(rest); i++ {
+			switch rest[i] {
+			case '\\':
+				i++
+			case '"':
+				cookieFile, _ = strconv.Unquote(`"` + rest[:i+1])
+				return methods, cookieFile
+			}
+		}
+	}
+	return methods, ""
+}
+
+// safeCookie authenticates with the SAFECOOKIE method, which proves the
+// knowledge of the cookie without sending it, to Tor only.
+func (c *Controller) safeCookie(cookieFile string) error {
+	cookie, err := os.ReadFile(cookieFile)
+	if err != nil {
+		return fmt.Errorf("tor: reading the authentication cookie: %w", err)
+	}
+	clientNonce := make([]byte, 32)
+	rand.Read(clientNonce)
+	lines, err := c.command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+
+	var serverHash, serverNonce []byte
+	for _, field := range strings.Fields(strings.TrimPrefix(lines[0], "AUTHCHALLENGE ")) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "SERVERHASH":
+			serverHash, _ = hex.DecodeString(value)
+		case "SERVERNONCE":
+			serverNonce, _ = hex.DecodeString(value)
+		}
+	}
+	msg := append(append(append([]byte(nil), cookie...), clientNonce...), serverNonce...)
+	if !hmac.Equal(serverHash, safeCookieHash("Tor safe cookie authentication server-to-controller hash", msg)) {
+		return errors.New("tor: SAFECOOKIE server hash mismatch")
+	}
+	_, err = c.command("AUTHENTICATE " + hex.EncodeToString(safeCookieHash("Tor safe cookie authentication controller-to-server hash", msg)))
+	return err
+}
+
+func safeCookieHash(key string, msg []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// ------------------------------------------------------------------
+
+// Signal sends a signal to Tor, e.g. "NEWNYM" or "RELOAD".
+func (c *Controller) Signal(name string) error {
+	_, err := c.command("SIGNAL " + name)
+	return err
+}
+
+// NewIdentity asks Tor to use new circuits for the next connections
+// (SIGNAL NEWNYM). The connections already open keep their circuits. Tor
+// may delay the switch when asked too often.
+func (c *Controller) NewIdentity() error {
+	return c.Signal("NEWNYM")
+}
+
+// ------------------------------------------------------------------
+
+// SetEvents subscribes to the events of types (e.g. "STREAM" and "CIRC"),
+// replacing the previous subscription, and passes them to handler. An empty
+// types unsubscribes. The handler is called from the goroutine reading the
+// replies of Tor: it must return quickly and not call the methods of c.
+func (c *Controller) SetEvents(handler func(Event), types ...string) error {
+	if handler != nil {
+		c.handler.Store(&handler)
+	}
+	words := append([]string{"SETEVENTS"}, types...)
+	_, err := c.command(strings.Join(words, " "))
+	return err
+}
+
+// ------------------------------------------------------------------
+
+// Dialer is a dialer through Tor requesting a new identity from a
+// Controller every n dials, or on demand with Renew, so that the dials
+// after it use different circuits.
+type Dialer struct {
+	d     netproxy.Dialer
+	c     *Controller
+	n     int64
+	dials atomic.Int64
+}
+
+// NewDialer returns a Dialer dialing with d, a dialer through the SOCKS
+// port of the Tor controlled by c, and requesting a new identity before
+// every n-th dial; never if n is zero.
+func NewDialer(d netproxy.Dialer, c *Controller, n int) *Dialer {
+	return &Dialer{d: d, c: c, n: int64(n)}
+}
+
+// Dial connects to the address addr on the given network through Tor.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the given network through
+// Tor. The dial fails if the new identity due before it cannot be had.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if n := d.dials.Add(1); d.n > 0 && n > 1 && (n-1)%d.n == 0 {
+		if err := d.Renew(); err != nil {
+			return nil, err
+		}
+	}
+	return d.d.DialContext(ctx, network, addr)
+}
+
+// String describes the Tor dialer of d, see netproxy.Describe.
+func (d *Dialer) String() string {
+	if d.n == 0 {
+		return netproxy.Describe(d.d)
+	}
+	return fmt.Sprintf("%s (new identity every %d dials)", netproxy.Describe(d.d), d.n)
+}
+
+// Renew requests a new identity now.
+func (d *Dialer) Renew() error {
+	return d.c.NewIdentity()
+}
@@ -0,0 +1,168 @@
+// (c) biter
+
+package tor
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTor serves the control port protocol on a new connection, with the
+// authentication methods and cookie, and counts the NEWNYM signals.
+type fakeTor struct {
+	methods    string
+	cookieFile string
+	cookie     []byte
+	password   string
+	newnyms    atomic.Int32
+}
+
+func (f *fakeTor) start(t *testing.T) *Controller {
+	client, server := net.Pipe()
+	go f.serve(server)
+	c := NewController(client)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (f *fakeTor) serve(conn net.Conn) {
+	defer conn.Close()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	var clientNonce, serverNonce []byte
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		var reply string
+		switch cmd {
+		case "PROTOCOLINFO":
+			reply = fmt.Sprintf("250-PROTOCOLINFO 1\r\n250-AUTH METHODS=%s COOKIEFILE=%q\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n", f.methods, f.cookieFile)
+		case "AUTHCHALLENGE":
+			clientNonce, _ = hex.DecodeString(strings.TrimPrefix(arg, "SAFECOOKIE "))
+			serverNonce = []byte("0123456789abcdef0123456789abcdef")
+			msg := append(append(append([]byte(nil), f.cookie...), clientNonce...), serverNonce...)
+			reply = fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X\r\n",
+				safeCookieHash("Tor safe cookie authentication server-to-controller hash", msg), serverNonce)
+		case "AUTHENTICATE":
+			b, _ := hex.DecodeString(arg)
+			msg := append(append(append([]byte(nil), f.cookie...), clientNonce...), serverNonce...)
+			if string(b) == f.password && f.password != "" ||
+				hmac.Equal(b, safeCookieHash("Tor safe cookie authentication controller-to-server hash", msg)) {
+				reply = "250 OK\r\n"
+			} else {
+				reply = "515 Authentication failed: Password did not match HashedControlPassword value from configuration\r\n"
+			}
+		case "SIGNAL":
+			f.newnyms.Add(1)
+			reply = "250 OK\r\n"
+		case "SETEVENTS":
+			reply = "250 OK\r\n650 STREAM 42 NEW 0 example.com:443 SOURCE_ADDR=127.0.0.1:50000 PURPOSE=USER\r\n"
+		default:
+			reply = "510 Unrecognized command \"" + cmd + "\"\r\n"
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), "control auth cookie")
+	cookie := []byte("01234567890123456789012345678901")
+	if err := os.WriteFile(cookieFile, cookie, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	f := &fakeTor{methods: "COOKIE,SAFECOOKIE", cookieFile: cookieFile, cookie: cookie}
+	if err := f.start(t).Authenticate(""); err != nil {
+		t.Errorf("SAFECOOKIE: Authenticate failed: %v", err)
+	}
+
+	f = &fakeTor{methods: "HASHEDPASSWORD", password: "secret"}
+	if err := f.start(t).Authenticate("secret"); err != nil {
+		t.Errorf("HASHEDPASSWORD: Authenticate failed: %v", err)
+	}
+	var replyErr *ReplyError
+	if err := f.start(t).Authenticate("wrong"); !errors.As(err, &replyErr) || replyErr.Code != 515 {
+		t.Errorf("got %v, want a 515 reply", err)
+	}
+	if err := f.start(t).Authenticate(""); err == nil {
+		t.Error("Authenticate succeeded without a usable method")
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	methods, file := parseAuth(`METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/a \"b\".cookie"`)
+	if methods != "COOKIE,SAFECOOKIE" || file != `/run/tor/a "b".cookie` {
+		t.Errorf("got %q, %q", methods, file)
+	}
+	if methods, file := parseAuth("METHODS=NULL"); methods != "NULL" || file != "" {
+		t.Errorf("got %q, %q", methods, file)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := new(fakeTor).start(t)
+	events := make(chan Event, 1)
+	if err := c.SetEvents(func(ev Event) { events <- ev }, "STREAM", "CIRC"); err != nil {
+		t.Fatalf("SetEvents failed: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != "STREAM" || !strings.HasPrefix(ev.Data, "42 NEW 0 example.com:443") {
+			t.Errorf("got event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	// The event did not disturb the replies.
+	if err := c.Signal("RELOAD"); err != nil {
+		t.Errorf("Signal failed: %v", err)
+	}
+}
+
+// countingDialer counts its dials, which fail.
+type countingDialer struct {
+	dials atomic.Int32
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return nil, errors.New("no network")
+}
+
+func TestDialer(t *testing.T) {
+	f := new(fakeTor)
+	socks := new(countingDialer)
+	d := NewDialer(socks, f.start(t), 2)
+	for i := 0; i < 5; i++ {
+		d.Dial("tcp", "example.com:80")
+	}
+	if n := socks.dials.Load(); n != 5 {
+		t.Errorf("got %d dials, want 5", n)
+	}
+	if n := f.newnyms.Load(); n != 2 {
+		t.Errorf("got %d NEWNYM before 5 dials every 2, want 2", n)
+	}
+	if err := d.Renew(); err != nil || f.newnyms.Load() != 3 {
+		t.Errorf("Renew: %v, got %d NEWNYM, want 3", err, f.newnyms.Load())
+	}
+}
@@ -0,0 +1,110 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"time"
+)
+
+// Phase identifies a step of a dial through a proxy.
+type Phase string
+
+// Phases reported to a Tracer. PhaseDial covers the whole dial, the others
+// are nested in it. PhaseDNS is only reported when the proxy host name is
+// resolved by this package rather than by the forward dialer, PhaseTLS only
+// for proxies reached over TLS.
+const (
+	PhaseDial      Phase = "dial"
+	PhaseDNS       Phase = "dns"
+	PhaseConnect   Phase = "connect"
+	PhaseTLS       Phase = "tls"
+	PhaseHandshake Phase = "handshake"
+)
+
+// PhaseInfo describes the dial a phase belongs to.
+type PhaseInfo struct {
+	Phase   Phase
+	Scheme  string // scheme of the proxy, e.g. "socks5"
+	Proxy   string // address of the proxy server
+	Network string // network of the target
+	Target  string // address the proxy is asked to connect to
+}
+
+// PhaseEnd reports the outcome of a phase. The byte counts are those
+// exchanged with the proxy during PhaseHandshake.
+type PhaseEnd struct {
+	Err          error
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Tracer is notified of the phases of the dials made by the proxy dialers of
+// this package, e.g. to record them as spans (see the tracing subpackage).
+// Start is called when a phase begins; the returned context is used for the
+// rest of the phase and the phases nested in it, and the returned function
+// is called exactly once when the phase ends.
+type Tracer interface {
+	Start(ctx context.Context, info PhaseInfo) (context.Context, func(PhaseEnd))
+}
+
+// ------------------------------------------------------------------
+
+// DialTimings are the time spent by a dial in each phase, to tell a slow
+// network from a slow proxy or target, see ConnStats and DialEvent. A
+// phase which did not run, e.g. TLS for a plain proxy, takes zero.
+type DialTimings struct {
+	DNS       time.Duration // resolving the proxy host, unless by the forward dialer, and the target with WithResolveLocally
+	Connect   time.Duration // connecting to the proxy through the forward dialer
+	TLS       time.Duration // TLS handshake with the proxy
+	Handshake time.Duration // proxy handshake, up to the connection to the target
+}
+
+type timingsKey struct{}
+
+// timings returns the DialTimings recorded by the dial with ctx, nil if
+// none.
+func timings(ctx context.Context) *DialTimings {
+	tm, _ := ctx.Value(timingsKey{}).(*DialTimings)
+	return tm
+}
+
+// add adds d to the time spent in phase.
+func (tm *DialTimings) add(phase Phase, d time.Duration) {
+	switch phase {
+	case PhaseDNS:
+		tm.DNS += d
+	case PhaseConnect:
+		tm.Connect += d
+	case PhaseTLS:
+		tm.TLS += d
+	case PhaseHandshake:
+		tm.Handshake += d
+	}
+}
+
+// ------------------------------------------------------------------
+
+// trace starts phase with the Tracer of b, if any, and records its time
+// in the DialTimings of ctx, if any.
+func (b *base) trace(ctx context.Context, phase Phase, network, target string) (context.Context, func(PhaseEnd)) {
+	t, tm := b.opts.Tracer, timings(ctx)
+	end := func(PhaseEnd) {}
+	if t != nil {
+		ctx, end = t.Start(ctx, PhaseInfo{
+			Phase:   phase,
+			Scheme:  b.scheme,
+			Proxy:   b.addr,
+			Network: network,
+			Target:  target,
+		})
+	}
+	if tm == nil {
+		return ctx, end
+	}
+	start := time.Now()
+	return ctx, func(e PhaseEnd) {
+		tm.add(phase, time.Since(start))
+		end(e)
+	}
+}
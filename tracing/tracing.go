@@ -0,0 +1,73 @@
+// (c) biter
+
+// Package tracing records the dials of netproxy dialers as OpenTelemetry
+// spans: one span per dial with child spans for DNS resolution of the proxy
+// host, the TCP connect to the proxy, the TLS handshake with proxies reached
+// over TLS and the proxy handshake.
+//
+//	d, err := netproxy.FromURL(u, netproxy.Direct, timeout, netproxy.WithTracer(tracing.New(nil)))
+package tracing
+
+import (
+	"context"
+
+	"github.com/biter777/netproxy"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/biter777/netproxy/tracing"
+
+// Attribute keys set on the spans.
+const (
+	ProxyKey        = attribute.Key("netproxy.proxy")
+	SchemeKey       = attribute.Key("netproxy.scheme")
+	NetworkKey      = attribute.Key("netproxy.network")
+	TargetKey       = attribute.Key("netproxy.target")
+	BytesReadKey    = attribute.Key("netproxy.bytes_read")
+	BytesWrittenKey = attribute.Key("netproxy.bytes_written")
+)
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+// New returns a netproxy.Tracer creating spans with a tracer from tp, or from
+// the global TracerProvider if tp is nil.
+func New(tp trace.TracerProvider) netproxy.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &tracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+// ------------------------------------------------------------------
+
+// Start implements netproxy.Tracer.
+func (t *tracer) Start(ctx context.Context, info netproxy.PhaseInfo) (context.Context, func(netproxy.PhaseEnd)) {
+	kind := trace.SpanKindInternal
+	if info.Phase == netproxy.PhaseDial {
+		kind = trace.SpanKindClient
+	}
+	ctx, span := t.tracer.Start(ctx, "netproxy."+string(info.Phase),
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			ProxyKey.String(info.Proxy),
+			SchemeKey.String(info.Scheme),
+			NetworkKey.String(info.Network),
+			TargetKey.String(info.Target),
+		))
+
+	return ctx, func(end netproxy.PhaseEnd) {
+		if end.BytesRead > 0 || end.BytesWritten > 0 {
+			span.SetAttributes(BytesReadKey.Int64(end.BytesRead), BytesWrittenKey.Int64(end.BytesWritten))
+		}
+		if end.Err != nil {
+			span.RecordError(end.Err)
+			span.SetStatus(codes.Error, end.Err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,177 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultDialTimeout is the timeout of the dialers of NewTransport, the one
+// of the dialer of http.DefaultTransport.
+const defaultDialTimeout = 30 * time.Second
+
+// ------------------------------------------------------------------
+
+// NewTransport returns an *http.Transport making all its connections
+// through the proxy at proxyURL, with the schemes of FromURL and the
+// options applied to the dialer. Its other settings are those of
+// http.DefaultTransport, but the proxy environment variables are ignored:
+//
+//	t, err := netproxy.NewTransport("socks5://127.0.0.1:9050")
+//	...
+//	client := &http.Client{Transport: t}
+//
+// The TLS connections to the targets are made over the tunnels with
+// Transport.TLSClientConfig, while WithTLSConfig configures the TLS
+// connections to the proxy. The dials have a timeout of 30 seconds, unless
+// the request context has a deadline. With WithPlainHTTPForwarding, the
+// plain HTTP requests are sent to an HTTP proxy without a tunnel.
+func NewTransport(proxyURL string, opts ...Option) (*http.Transport, error) {
+	spec, err := ParseDialerSpec(proxyURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	d := spec.Dialer(Direct, defaultDialTimeout)
+	t.DialContext = d.DialContext
+	if spec.opts.PlainHTTPForwarding {
+		hp, ok := d.(*httpProxy)
+		if !ok {
+			return nil, fmt.Errorf("%w: plain HTTP forwarding needs an HTTP proxy, not %s", ErrUnsupportedScheme, spec.url.Redacted())
+		}
+		if err := hp.forwardPlainHTTP(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ------------------------------------------------------------------
+
+// defaultMaxRedirects is the number of redirects followed by http.Client.
+const defaultMaxRedirects = 10
+
+// NewHTTPClient returns an *http.Client sending its requests through the
+// proxy at proxyURL, with a transport made by NewTransport and the timeout,
+// redirect and retry policies set by WithClientTimeout, WithMaxRedirects
+// and WithRetries:
+//
+//	client, err := netproxy.NewHTTPClient("socks5://127.0.0.1:9050",
+//		netproxy.WithClientTimeout(30*time.Second), netproxy.WithRetries(2, time.Second))
+func NewHTTPClient(proxyURL string, opts ...Option) (*http.Client, error) {
+	t, err := NewTransport(proxyURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	c := &http.Client{Transport: t, Timeout: o.ClientTimeout}
+	if o.Retries > 0 {
+		c.Transport = &retryTransport{next: t, retries: o.Retries, backoff: o.RetryBackoff}
+	}
+	switch max := o.MaxRedirects; {
+	case max < 0:
+		c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	case max > 0 && max != defaultMaxRedirects:
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= max {
+				return fmt.Errorf("stopped after %d redirects", max)
+			}
+			return nil
+		}
+	}
+	return c, nil
+}
+
+// ------------------------------------------------------------------
+
+// WithClientTimeout sets the time limit of the requests of the clients of
+// NewHTTPClient, response bodies included, as http.Client.Timeout. Zero
+// means no limit.
+func WithClientTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.ClientTimeout = d
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithMaxRedirects sets the number of redirects followed by the clients of
+// NewHTTPClient; zero is 10, as http.Client. With a negative n, redirects
+// are not followed and the redirect responses are returned.
+func WithMaxRedirects(n int) Option {
+	return func(o *Options) {
+		o.MaxRedirects = n
+	}
+}
+
+// ------------------------------------------------------------------
+
+// WithRetries makes the clients of NewHTTPClient retry a request up to n
+// times when it could not be sent because the dial through the proxy
+// failed with a temporary error (see OpError.Temporary), e.g. the proxy
+// was unreachable or a SOCKS5 host unreachable reply. The retries wait
+// backoff, doubled after each attempt. Requests with a body are retried
+// only if it can be replayed (http.Request.GetBody).
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *Options) {
+		o.Retries = n
+		o.RetryBackoff = backoff
+	}
+}
+
+// ------------------------------------------------------------------
+
+// retryTransport retries the requests whose dial failed temporarily.
+type retryTransport struct {
+	next    *http.Transport
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil || attempt == t.retries || !retryable(err) {
+			return resp, err
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, err
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections of the transport, for
+// http.Client.CloseIdleConnections.
+func (t *retryTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
+
+// retryable reports whether err is a temporary dial failure of a dialer of
+// this package, before the request was sent.
+func retryable(err error) bool {
+	var opErr *OpError
+	return errors.As(err, &opErr) && opErr.Temporary()
+}
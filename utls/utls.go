@@ -0,0 +1,130 @@
+// (c) biter
+
+// Package utls provides a netproxy.TLSHandshaker backed by uTLS, so that the
+// TLS handshake with the proxy mimics the ClientHello of a common browser
+// instead of the easily fingerprinted one of crypto/tls.
+//
+//	d, err := netproxy.FromURL(u, netproxy.Direct, timeout,
+//		netproxy.WithTLSHandshaker(utls.New(utls.HelloChrome)))
+package utls
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"net"
+
+	"github.com/biter777/netproxy"
+	tls "github.com/refraction-networking/utls"
+)
+
+// Fingerprints accepted by New. Any other tls.ClientHelloID of uTLS works
+// too, except HelloCustom.
+var (
+	HelloChrome  = tls.HelloChrome_Auto
+	HelloFirefox = tls.HelloFirefox_Auto
+	HelloSafari  = tls.HelloSafari_Auto
+	HelloIOS     = tls.HelloIOS_Auto
+	HelloEdge    = tls.HelloEdge_Auto
+)
+
+type handshaker struct {
+	id tls.ClientHelloID
+}
+
+// New returns a netproxy.TLSHandshaker sending the ClientHello of id. The
+// ALPN protocols of the fingerprint are replaced by those of the config, or
+// by "http/1.1", since proxies are spoken to over HTTP/1.1. The crypto/tls
+// ClientSessionCache of the config cannot be used by uTLS and is ignored.
+func New(id tls.ClientHelloID) netproxy.TLSHandshaker {
+	return &handshaker{id: id}
+}
+
+// ------------------------------------------------------------------
+
+// Handshake implements netproxy.TLSHandshaker.
+func (h *handshaker) Handshake(ctx context.Context, conn net.Conn, cfg *stdtls.Config) (net.Conn, error) {
+	spec, err := tls.UTLSIdToSpec(h.id)
+	if err != nil {
+		return nil, err
+	}
+	protos := cfg.NextProtos
+	if len(protos) == 0 {
+		protos = []string{"http/1.1"}
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*tls.ALPNExtension); ok {
+			alpn.AlpnProtocols = protos
+		}
+	}
+
+	uconn := tls.UClient(conn, convertConfig(cfg), tls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// ------------------------------------------------------------------
+
+// convertConfig translates the crypto/tls settings netproxy uses to uTLS.
+func convertConfig(cfg *stdtls.Config) *tls.Config {
+	c := &tls.Config{
+		ServerName:         cfg.ServerName,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         cfg.MinVersion,
+		MaxVersion:         cfg.MaxVersion,
+		KeyLogWriter:       cfg.KeyLogWriter,
+		Time:               cfg.Time,
+		Rand:               cfg.Rand,
+	}
+	for _, cert := range cfg.Certificates {
+		c.Certificates = append(c.Certificates, convertCertificate(&cert))
+	}
+	if get := cfg.GetClientCertificate; get != nil {
+		c.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			info := &stdtls.CertificateRequestInfo{
+				AcceptableCAs: cri.AcceptableCAs,
+				Version:       cri.Version,
+			}
+			for _, s := range cri.SignatureSchemes {
+				info.SignatureSchemes = append(info.SignatureSchemes, stdtls.SignatureScheme(s))
+			}
+			cert, err := get(info)
+			if err != nil || cert == nil {
+				return nil, err
+			}
+			uc := convertCertificate(cert)
+			return &uc, nil
+		}
+	}
+	if verify := cfg.VerifyConnection; verify != nil {
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verify(stdtls.ConnectionState{
+				Version:            cs.Version,
+				HandshakeComplete:  cs.HandshakeComplete,
+				DidResume:          cs.DidResume,
+				CipherSuite:        cs.CipherSuite,
+				NegotiatedProtocol: cs.NegotiatedProtocol,
+				ServerName:         cs.ServerName,
+				PeerCertificates:   cs.PeerCertificates,
+				VerifiedChains:     cs.VerifiedChains,
+			})
+		}
+	}
+	return c
+}
+
+// ------------------------------------------------------------------
+
+func convertCertificate(cert *stdtls.Certificate) tls.Certificate {
+	return tls.Certificate{
+		Certificate: cert.Certificate,
+		PrivateKey:  cert.PrivateKey,
+		OCSPStaple:  cert.OCSPStaple,
+		Leaf:        cert.Leaf,
+	}
+}
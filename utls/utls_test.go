@@ -0,0 +1,56 @@
+// (c) biter
+
+package utls
+
+import (
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/biter777/netproxy"
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestHandshake(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+	}))
+	// With HTTP/2 enabled the proxy would pick h2 if the fingerprint's ALPN
+	// was sent as is.
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	for _, id := range []tls.ClientHelloID{HelloChrome, HelloFirefox} {
+		proxy, err := netproxy.FromURL(u, netproxy.Direct, time.Second,
+			netproxy.WithTLSConfig(&stdtls.Config{RootCAs: pool}),
+			netproxy.WithPinnedKeys(netproxy.SPKIPin(srv.Certificate())),
+			netproxy.WithTLSHandshaker(New(id)))
+		if err != nil {
+			t.Fatalf("FromURL failed: %v", err)
+		}
+		c, err := proxy.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Errorf("%s: dial failed: %v", id.Str(), err)
+			continue
+		}
+		c.Close()
+	}
+}
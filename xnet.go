@@ -0,0 +1,72 @@
+// (c) biter
+
+package netproxy
+
+import (
+	"context"
+	"net"
+)
+
+// ForwardDialer is the dialer FromURL connects to the proxy with. It is the
+// interface of golang.org/x/net/proxy.Dialer, so that the dialers of both
+// packages can be mixed: the dialers of this package satisfy
+// proxy.Dialer and proxy.ContextDialer, and the dialers of x/net/proxy
+// can forward the dials of this package.
+type ForwardDialer interface {
+	// Dial connects to the given address.
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ------------------------------------------------------------------
+
+// WrapDialer returns d as a Dialer: d itself if it is one, otherwise a
+// Dialer using the DialContext method of d if it has one, as
+// proxy.ContextDialer, or its Dial method, abandoning the dial when the
+// context is done. It returns nil if d is nil.
+func WrapDialer(d ForwardDialer) Dialer {
+	switch v := d.(type) {
+	case nil:
+		return nil
+	case Dialer:
+		return v
+	}
+	return forwardDialer{d}
+}
+
+// ------------------------------------------------------------------
+
+// forwardDialer is a Dialer made from a ForwardDialer.
+type forwardDialer struct {
+	ForwardDialer
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d, ok := d.ForwardDialer.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	// As golang.org/x/net/proxy.dialContext: dial in the background, and
+	// close the connection if the context is done before it is made.
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}